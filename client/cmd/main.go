@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"github.com/iyarkov2/chat/core/tlsconfig"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
@@ -19,6 +22,23 @@ import (
 	"path"
 )
 
+var (
+	address  = flag.String("addr", "localhost:8888", "Chat server address")
+	tlsFlags = tlsconfig.RegisterClientFlags(flag.CommandLine)
+)
+
+// transportCredentials returns the credentials of the TLS options, see tlsconfig.RegisterClientFlags
+func transportCredentials() grpc.DialOption {
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalln("Failed to load certificates:", err)
+	}
+	if config == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
 func registerProtoFile(srcDir string, filename string) error {
 	// First, convert the .proto file to a file descriptor set.
 	tmpFile := path.Join(srcDir, filename + ".pb")
@@ -63,6 +83,7 @@ func registerProtoFile(srcDir string, filename string) error {
 }
 
 func main() {
+	flag.Parse()
 
 	/*
 		Step 1 - Register all known proto files with protoregistry.
@@ -176,7 +197,7 @@ func main() {
 		fmt.Printf("\u001b[32mService Descriptor\u001B[0m  %v\n\n", serviceDesc)
 
 		//var opts []grpc.DialOption
-		conn, err := grpc.Dial("localhost:8888", grpc.WithInsecure())
+		conn, err := grpc.Dial(*address, transportCredentials())
 		if err != nil {
 			log.Fatalln("Connection error:", err)
 		}
@@ -3,8 +3,9 @@ module github.com/iyarkov2/chat/client
 go 1.17
 
 require (
+	github.com/iyarkov2/chat/core v0.0.0
 	github.com/pkg/errors v0.9.1
-	github.com/rs/zerolog v1.24.0
+	github.com/rs/zerolog v1.25.0
 	google.golang.org/grpc v1.40.0
 	google.golang.org/protobuf v1.27.1
 )
@@ -16,3 +17,5 @@ require (
 	golang.org/x/text v0.3.3 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
+
+replace github.com/iyarkov2/chat/core v0.0.0 => ../core
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff doubles the delay on every attempt up to the max, the delays are randomized by up to a half
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	switch {
+	case b.current == 0:
+		b.current = b.min
+	case b.current < b.max:
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/resume"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+const help = `Commands:
+  /join <room>     joins the room, creates it if it does not exist. Lines are posted to the last joined room
+  /leave           leaves the current room
+  /rooms           lists the rooms
+  /history [n]     shows the last n messages of the current room
+  /who             shows the presence of the current room members
+  /quit            exits`
+
+var errNameTaken = errors.New("name taken, the previous session may still be open")
+
+type clientConfig struct {
+	Name string
+	// Room joined after connecting
+	Room        string
+	HistorySize int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+type client struct {
+	config clientConfig
+	// Opens a new connection to the server
+	dial    func() (*grpc.ClientConn, error)
+	backoff *backoff
+	// Seen messages of the joined rooms, survives reconnects
+	tracker *resume.Tracker
+
+	outMtx *sync.Mutex
+	out    io.Writer
+
+	// Connection and session state, used by the run goroutine only. The server binds the session to the connection,
+	// the session token stays valid as long as the connection is up
+	conn         *grpc.ClientConn
+	api          api.ChatServiceClient
+	token        string
+	userId       int32
+	ctx          context.Context
+	stream       *postStream
+	lastClientId int32
+	room         *api.Room
+	// Room names by id, for display
+	roomNames map[int32]string
+	stopWatch context.CancelFunc
+
+	// Presence of the current room members, updated by the watcher
+	presenceMtx *sync.Mutex
+	presence    map[int32]*api.PresenceEvent
+}
+
+func newClient(dial func() (*grpc.ClientConn, error), config clientConfig, out io.Writer) *client {
+	return &client{
+		config:      config,
+		dial:        dial,
+		backoff:     &backoff{min: config.MinBackoff, max: config.MaxBackoff},
+		tracker:     resume.NewTracker(),
+		outMtx:      new(sync.Mutex),
+		out:         out,
+		roomNames:   make(map[int32]string),
+		presenceMtx: new(sync.Mutex),
+		presence:    make(map[int32]*api.PresenceEvent),
+	}
+}
+
+// run keeps the session open until /quit, the end of the input or the context cancellation
+func (c *client) run(ctx context.Context, lines <-chan string) {
+	defer c.hangUp()
+	for {
+		err := c.session(ctx, lines)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if !c.streamOnly(err) {
+			// A new session on the same connection would find the name taken by the old one
+			c.hangUp()
+		}
+		wait := c.backoff.next()
+		c.printf("* Disconnected: %s. Reconnecting in %s", describe(err), wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// streamOnly tells if the error ended the Post stream but not the session, e.g. the rate limit
+func (c *client) streamOnly(err error) bool {
+	if c.conn == nil || c.token == "" {
+		return false
+	}
+	if state := c.conn.GetState(); state == connectivity.TransientFailure || state == connectivity.Shutdown {
+		return false
+	}
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// hangUp closes the connection, the server ends the session
+func (c *client) hangUp() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.api = nil
+	c.token = ""
+}
+
+// session serves the user until the connection fails, returns nil if the user quits. The session of a connection
+// that is still up is resumed with a new Post stream, otherwise a new connection is opened
+func (c *client) session(ctx context.Context, lines <-chan string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.token != "" {
+		c.ctx = auth.AppendToken(ctx, c.token)
+		stream, err := c.openStream(c.tracker.Positions())
+		if err != nil {
+			return err
+		}
+		c.stream = stream
+		c.backoff.reset()
+		c.printf("* Stream reopened")
+		// The presence watcher ended with the context of the previous session
+		if c.room != nil {
+			c.watch(c.room.Id)
+		}
+		return c.serve(ctx, lines)
+	}
+
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+		c.api = api.NewChatServiceClient(conn)
+	}
+	response, err := c.api.Connect(ctx, &api.ConnectRequest{Name: c.config.Name})
+	if err != nil {
+		return err
+	}
+	if response.Status == api.ConnectResponse_NAME_TAKEN {
+		return errNameTaken
+	}
+	c.userId = response.UserId
+	c.token = response.Token
+	c.ctx = auth.AppendToken(ctx, response.Token)
+	c.room = nil
+	// The server forgets the rooms of a closed session, only the rejoined room is resumed
+	for roomId := range c.tracker.Positions() {
+		if c.roomNames[roomId] != c.config.Room {
+			c.tracker.Forget(roomId)
+			delete(c.roomNames, roomId)
+		}
+	}
+	// Not a member of any room yet, the rooms resume once joined
+	if c.stream, err = c.openStream(nil); err != nil {
+		return err
+	}
+	c.backoff.reset()
+	c.printf("* Connected as user %d, /help lists the commands", c.userId)
+
+	if c.config.Room != "" {
+		if err := c.join(c.config.Room); err != nil {
+			if isConnectionError(err) {
+				return err
+			}
+			c.printf("* Failed to join %s: %s", c.config.Room, describe(err))
+			for roomId := range c.tracker.Positions() {
+				c.tracker.Forget(roomId)
+			}
+		}
+	}
+	return c.serve(ctx, lines)
+}
+
+// serve handles the input and the Post stream of the session
+func (c *client) serve(ctx context.Context, lines <-chan string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			quit, err := c.handle(line)
+			if quit {
+				return nil
+			}
+			if isConnectionError(err) {
+				return err
+			}
+			if err != nil {
+				c.printf("* %s", describe(err))
+			}
+		case msg := <-c.stream.received:
+			result := c.observe(msg)
+			if result == resume.Duplicate {
+				continue
+			}
+			c.show(msg)
+			if result == resume.Gap {
+				c.printf("* Missed %d messages of %s, they follow", c.tracker.Missing(msg.RoomId), c.roomName(msg.RoomId))
+				if err := c.resume(); err != nil {
+					return err
+				}
+			}
+		case err := <-c.stream.errs:
+			if err == io.EOF {
+				return errors.New("the server closed the stream")
+			}
+			return err
+		}
+	}
+}
+
+// postStream is a Post stream of the session, messages are received in a separate goroutine
+type postStream struct {
+	api.ChatService_PostClient
+	received chan *api.PostResponse
+	errs     chan error
+	cancel   context.CancelFunc
+}
+
+// openStream opens the Post stream, the rooms of the positions resume after the last seen message
+func (c *client) openStream(positions resume.Positions) (*postStream, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	stream, err := c.api.Post(resume.AppendPositions(ctx, positions))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	result := &postStream{
+		ChatService_PostClient: stream,
+		received:               make(chan *api.PostResponse),
+		errs:                   make(chan error, 1),
+		cancel:                 cancel,
+	}
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				result.errs <- err
+				return
+			}
+			select {
+			case result.received <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return result, nil
+}
+
+// resume replaces the Post stream, the server sends the missed messages first
+func (c *client) resume() error {
+	c.stream.cancel()
+	stream, err := c.openStream(c.tracker.Positions())
+	if err != nil {
+		return err
+	}
+	c.stream = stream
+	return nil
+}
+
+// observe tracks the sequence numbers of the posted messages, including the acknowledgements of own posts and the
+// placeholders of the messages of blocked users
+func (c *client) observe(msg *api.PostResponse) resume.Result {
+	if (msg.Event != api.PostResponse_POSTED && msg.Event != api.PostResponse_HIDDEN) || msg.Seq == 0 {
+		return resume.Accepted
+	}
+	return c.tracker.Observe(msg.RoomId, msg.Seq)
+}
+
+// handle runs the command or posts the line, returns true if the user quits
+func (c *client) handle(line string) (bool, error) {
+	command, argument := parseCommand(line)
+	switch command {
+	case "":
+		return false, c.post(argument)
+	case "join":
+		if argument == "" {
+			return false, errors.New("room name required")
+		}
+		return false, c.join(argument)
+	case "leave":
+		return false, c.leave()
+	case "rooms":
+		return false, c.listRooms()
+	case "history":
+		limit := c.config.HistorySize
+		if argument != "" {
+			n, err := strconv.Atoi(argument)
+			if err != nil || n <= 0 {
+				return false, fmt.Errorf("invalid number of messages %s", argument)
+			}
+			limit = n
+		}
+		return false, c.history(limit)
+	case "who":
+		return false, c.who()
+	case "help":
+		c.printf("%s", help)
+		return false, nil
+	case "quit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command /%s, /help lists the commands", command)
+	}
+}
+
+// parseCommand splits "/command argument", the command is empty if the line is a message
+func parseCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "/") {
+		return "", line
+	}
+	parts := strings.SplitN(line[1:], " ", 2)
+	if len(parts) == 1 {
+		return strings.ToLower(parts[0]), ""
+	}
+	return strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+}
+
+func (c *client) post(text string) error {
+	if text == "" {
+		return nil
+	}
+	if c.room == nil {
+		return errors.New("join a room first")
+	}
+	c.lastClientId++
+	return c.stream.Send(&api.PostRequest{
+		ClientId: c.lastClientId,
+		Text:     text,
+		RoomId:   c.room.Id,
+	})
+}
+
+// join joins the room with the name or creates it
+func (c *client) join(name string) error {
+	rooms, err := c.api.ListRooms(c.ctx, &api.ListRoomsRequest{})
+	if err != nil {
+		return err
+	}
+	var joined *api.Room
+	for _, r := range rooms.Rooms {
+		if r.Name != name {
+			continue
+		}
+		response, err := c.api.JoinRoom(c.ctx, &api.JoinRoomRequest{RoomId: r.Id})
+		if err != nil {
+			return err
+		}
+		joined = response.Room
+	}
+	if joined == nil {
+		response, err := c.api.CreateRoom(c.ctx, &api.CreateRoomRequest{Name: name})
+		if err != nil {
+			return err
+		}
+		if response.Status == api.CreateRoomResponse_NAME_TAKEN {
+			return fmt.Errorf("room %s was just created, join again", name)
+		}
+		joined = response.Room
+	}
+	c.room = joined
+	c.roomNames[joined.Id] = joined.Name
+	c.config.Room = joined.Name
+	c.watch(joined.Id)
+	c.printf("* Joined %s, %d members", joined.Name, joined.MemberCount)
+	// Rejoined after a reconnect, the messages posted in between follow
+	if _, ok := c.tracker.Positions()[joined.Id]; ok {
+		return c.resume()
+	}
+	return nil
+}
+
+func (c *client) leave() error {
+	if c.room == nil {
+		return errors.New("not in a room")
+	}
+	if _, err := c.api.LeaveRoom(c.ctx, &api.LeaveRoomRequest{RoomId: c.room.Id}); err != nil {
+		return err
+	}
+	c.printf("* Left %s", c.room.Name)
+	c.unwatch()
+	c.tracker.Forget(c.room.Id)
+	delete(c.roomNames, c.room.Id)
+	c.room = nil
+	c.config.Room = ""
+	return nil
+}
+
+func (c *client) listRooms() error {
+	response, err := c.api.ListRooms(c.ctx, &api.ListRoomsRequest{})
+	if err != nil {
+		return err
+	}
+	if len(response.Rooms) == 0 {
+		c.printf("* No rooms, /join creates one")
+	}
+	for _, r := range response.Rooms {
+		c.printf("* %s, %d members", r.Name, r.MemberCount)
+	}
+	return nil
+}
+
+func (c *client) history(limit int) error {
+	if c.room == nil {
+		return errors.New("join a room first")
+	}
+	response, err := c.api.GetHistory(c.ctx, &api.GetHistoryRequest{RoomId: c.room.Id, Limit: int32(limit)})
+	if err != nil {
+		return err
+	}
+	for _, msg := range response.Messages {
+		if !msg.Deleted {
+			c.printf("%s", c.format(msg, msg.Text))
+		}
+	}
+	return nil
+}
+
+func (c *client) who() error {
+	if c.room == nil {
+		return errors.New("join a room first")
+	}
+	c.presenceMtx.Lock()
+	members := make([]*api.PresenceEvent, 0, len(c.presence))
+	for _, e := range c.presence {
+		members = append(members, e)
+	}
+	c.presenceMtx.Unlock()
+	if len(members) == 0 {
+		c.printf("* Presence is not known yet, try again")
+		return nil
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserId < members[j].UserId
+	})
+	for _, e := range members {
+		state := strings.ToLower(e.State.String())
+		if e.TypingRoomId == c.room.Id {
+			state += ", typing"
+		}
+		c.printf("* %s %s", c.userLabel(e.UserId), state)
+	}
+	return nil
+}
+
+// watch follows the presence of the room members, replaces the previous watcher
+func (c *client) watch(roomId int32) {
+	c.unwatch()
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.stopWatch = cancel
+	presence := make(map[int32]*api.PresenceEvent)
+	c.presenceMtx.Lock()
+	c.presence = presence
+	c.presenceMtx.Unlock()
+
+	stream, err := c.api.WatchPresence(ctx, &api.WatchPresenceRequest{RoomId: roomId})
+	if err != nil {
+		c.printf("* Presence is not available: %s", describe(err))
+		return
+	}
+	go func() {
+		for {
+			e, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			c.presenceMtx.Lock()
+			previous, known := presence[e.UserId]
+			presence[e.UserId] = e
+			c.presenceMtx.Unlock()
+			if known && previous.State != e.State {
+				c.printf("* %s is %s", c.userLabel(e.UserId), strings.ToLower(e.State.String()))
+			}
+		}
+	}()
+}
+
+func (c *client) unwatch() {
+	if c.stopWatch != nil {
+		c.stopWatch()
+		c.stopWatch = nil
+	}
+}
+
+// show prints the event of the Post stream
+func (c *client) show(msg *api.PostResponse) {
+	switch msg.Event {
+	case api.PostResponse_POSTED:
+		// Acknowledgement of an own post, the text is on the screen already
+		if msg.UserId == c.userId && msg.ClientId != 0 {
+			return
+		}
+		if msg.ParentId != 0 {
+			c.printf("%s", c.format(msg, fmt.Sprintf("(reply to %d) %s", msg.ParentId, msg.Text)))
+			return
+		}
+		c.printf("%s", c.format(msg, msg.Text))
+	case api.PostResponse_EDITED:
+		c.printf("%s", c.format(msg, fmt.Sprintf("(edited %d) %s", msg.Id, msg.Text)))
+	case api.PostResponse_DELETED:
+		c.printf("%s", c.format(msg, fmt.Sprintf("(deleted %d)", msg.Id)))
+	case api.PostResponse_EXPIRED:
+		c.printf("%s", c.format(msg, fmt.Sprintf("(expired %d)", msg.Id)))
+	case api.PostResponse_THROTTLED:
+		c.printf("* Not posted, slow down. Retry in %s", time.Duration(msg.RetryAfterMs)*time.Millisecond)
+	case api.PostResponse_REJECTED:
+		c.printf("* Not posted: %s", msg.Reason)
+	case api.PostResponse_SYSTEM:
+		c.printf("* System: %s", msg.Text)
+	}
+}
+
+// format renders "15:04 [room] user: text"
+func (c *client) format(msg *api.PostResponse, text string) string {
+	room := c.roomName(msg.RoomId)
+	if n := len(msg.AttachmentIds); n > 0 {
+		text = fmt.Sprintf("%s [%d attachments]", text, n)
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", msg.Ts.AsTime().Local().Format("15:04"), room, c.userLabel(msg.UserId), text)
+}
+
+func (c *client) roomName(roomId int32) string {
+	if name, ok := c.roomNames[roomId]; ok {
+		return name
+	}
+	return fmt.Sprintf("room %d", roomId)
+}
+
+func (c *client) userLabel(userId int32) string {
+	if userId == c.userId {
+		return "you"
+	}
+	return fmt.Sprintf("#%d", userId)
+}
+
+func (c *client) printf(format string, args ...interface{}) {
+	c.outMtx.Lock()
+	defer c.outMtx.Unlock()
+	fmt.Fprintf(c.out, format+"\n", args...)
+}
+
+// isConnectionError tells if the session has to be reopened
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unauthenticated, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// describe drops the gRPC prefix of the error
+func describe(err error) string {
+	if s, ok := status.FromError(err); ok {
+		return s.Message()
+	}
+	return err.Error()
+}
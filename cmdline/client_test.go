@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		command  string
+		argument string
+	}{
+		{"hello world", "", "hello world"},
+		{"  /JOIN  general  ", "join", "general"},
+		{"/quit", "quit", ""},
+		{"/history 5", "history", "5"},
+	} {
+		command, argument := parseCommand(test.line)
+		if command != test.command || argument != test.argument {
+			t.Errorf("[%s] expected [%s] [%s], actual [%s] [%s]", test.line, test.command, test.argument, command, argument)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: 100 * time.Millisecond, max: time.Second}
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if wait := b.next(); wait < max/2 || wait > max {
+			t.Errorf("attempt %d expected between %s and %s, actual %s", i, max/2, max, wait)
+		}
+	}
+	b.reset()
+	if wait := b.next(); wait > 100*time.Millisecond {
+		t.Errorf("expected the min delay after reset, actual %s", wait)
+	}
+}
+
+func TestShow(t *testing.T) {
+	out := new(bytes.Buffer)
+	c := newClient(nil, clientConfig{}, out)
+	c.userId = 1
+	c.roomNames[3] = "general"
+	ts := timestamppb.New(time.Date(2021, 1, 1, 10, 30, 0, 0, time.Local))
+
+	c.show(&api.PostResponse{Id: 1, UserId: 1, ClientId: 1, RoomId: 3, Text: "own", Ts: ts})
+	c.show(&api.PostResponse{Id: 2, UserId: 2, RoomId: 3, Text: "hello", Ts: ts})
+	c.show(&api.PostResponse{Id: 3, UserId: 2, RoomId: 4, Text: "elsewhere", Ts: ts, AttachmentIds: []string{"a"}})
+	c.show(&api.PostResponse{Event: api.PostResponse_REJECTED, UserId: 1, Reason: "links are not allowed"})
+
+	expected := []string{
+		"10:30 [general] #2: hello",
+		"10:30 [room 4] #2: elsewhere [1 attachments]",
+		"* Not posted: links are not allowed",
+	}
+	if actual := strings.TrimSpace(out.String()); actual != strings.Join(expected, "\n") {
+		t.Errorf("unexpected output\n%s", actual)
+	}
+}
+
+// limitedServer ends the first Post stream over the rate limit once the room is watched, the session stays open
+type limitedServer struct {
+	api.UnimplementedChatServiceServer
+	connects int32
+	streams  int32
+	posts    chan string
+	watches  chan int32
+	watched  chan struct{}
+	once     sync.Once
+}
+
+func (s *limitedServer) ListRooms(ctx context.Context, request *api.ListRoomsRequest) (*api.ListRoomsResponse, error) {
+	return &api.ListRoomsResponse{}, nil
+}
+
+func (s *limitedServer) CreateRoom(ctx context.Context, request *api.CreateRoomRequest) (*api.CreateRoomResponse, error) {
+	return &api.CreateRoomResponse{
+		Status: api.CreateRoomResponse_SUCCESS,
+		Room:   &api.Room{Id: 1, Name: request.Name, MemberCount: 1},
+	}, nil
+}
+
+func (s *limitedServer) WatchPresence(request *api.WatchPresenceRequest, stream api.ChatService_WatchPresenceServer) error {
+	s.watches <- request.RoomId
+	s.once.Do(func() {
+		close(s.watched)
+	})
+	<-stream.Context().Done()
+	return nil
+}
+
+func (s *limitedServer) Connect(ctx context.Context, request *api.ConnectRequest) (*api.ConnectResponse, error) {
+	if atomic.AddInt32(&s.connects, 1) > 1 {
+		return &api.ConnectResponse{Status: api.ConnectResponse_NAME_TAKEN}, nil
+	}
+	return &api.ConnectResponse{Status: api.ConnectResponse_SUCCESS, UserId: 1, Token: "token"}, nil
+}
+
+func (s *limitedServer) Post(stream api.ChatService_PostServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	token := ""
+	if values := md.Get(auth.Header); len(values) > 0 {
+		token, _ = auth.TokenFromHeader(values[0])
+	}
+	s.posts <- token
+	if atomic.AddInt32(&s.streams, 1) == 1 {
+		<-s.watched
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestStreamReopenedAfterRateLimit(t *testing.T) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := &limitedServer{posts: make(chan string, 2), watches: make(chan int32, 2), watched: make(chan struct{})}
+	s := grpc.NewServer()
+	api.RegisterChatServiceServer(s, server)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	dials := 0
+	c := newClient(func() (*grpc.ClientConn, error) {
+		dials++
+		return grpc.Dial("bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return listener.Dial()
+			}),
+			grpc.WithInsecure())
+	}, clientConfig{Name: "John", Room: "general", MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}, ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx, make(chan string))
+	}()
+
+	// The second stream uses the token of the first session
+	for i := 0; i < 2; i++ {
+		select {
+		case token := <-server.posts:
+			if token != "token" {
+				t.Errorf("expected the session token, actual [%s]", token)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream %d was not opened", i+1)
+		}
+	}
+	// The presence watcher of the room is restarted with the stream
+	for i := 0; i < 2; i++ {
+		select {
+		case roomId := <-server.watches:
+			if roomId != 1 {
+				t.Errorf("expected room 1 watched, actual %d", roomId)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watcher %d was not started", i+1)
+		}
+	}
+	cancel()
+	<-done
+	if connects := atomic.LoadInt32(&server.connects); connects != 1 || dials != 1 {
+		t.Errorf("expected one connection and one session, actual %d %d", dials, connects)
+	}
+}
@@ -1,13 +1,77 @@
 package main
 
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/iyarkov2/chat/core/tlsconfig"
+	"github.com/iyarkov2/chat/server/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/*
+	Line mode chat client. Lines are posted to the current room, commands start with a slash, see /help
+*/
+
+var (
+	address    = flag.String("addr", "localhost:8888", "Chat server address")
+	name       = flag.String("name", "", "Chat name. With mutual TLS it must match the certificate, empty uses the certificate name")
+	room       = flag.String("room", "", "Room to join after connecting, created if it does not exist")
+	history    = flag.Int("history", 20, "Number of messages /history shows by default")
+	minBackoff = flag.Duration("min-backoff", 500*time.Millisecond, "First reconnect delay")
+	maxBackoff = flag.Duration("max-backoff", 30*time.Second, "Longest reconnect delay")
+	tlsFlags   = tlsconfig.RegisterClientFlags(flag.CommandLine)
+)
+
+// transportCredentials returns the credentials of the TLS options, see tlsconfig.RegisterClientFlags
+func transportCredentials() grpc.DialOption {
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalln("Failed to load certificates:", err)
+	}
+	if config == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// readLines sends the standard input lines to the channel, the channel is closed at the end of the input
+func readLines() <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
 func main() {
-	//num := flag.Int("n", 0, "# of iterations (Required)")
-	//str := flag.String("s", "John", "Your name")
-	//flag.Parse()
-	//
-	//flag.PrintDefaults()
-	//
-	//fmt.Printf("# of iterations: %d\n", *num)
-	//fmt.Printf("Your name: %s\n", *str)
-
-}
\ No newline at end of file
+	flag.Parse()
+	if *name == "" && tlsFlags.Config().CertFile == "" {
+		log.Fatalln("Name required")
+	}
+	options := append(api.WithClientVersion(), transportCredentials())
+	dial := func() (*grpc.ClientConn, error) {
+		return grpc.Dial(*address, options...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c := newClient(dial, clientConfig{
+		Name:        *name,
+		Room:        *room,
+		HistorySize: *history,
+		MinBackoff:  *minBackoff,
+		MaxBackoff:  *maxBackoff,
+	}, os.Stdout)
+	c.run(ctx, readLines())
+}
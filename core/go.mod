@@ -3,11 +3,8 @@ module github.com/iyarkov2/chat/core
 go 1.17
 
 require (
+	github.com/confluentinc/confluent-kafka-go v1.7.0
 	github.com/google/uuid v1.3.0
+	github.com/lib/pq v1.10.3
 	github.com/rs/zerolog v1.25.0
 )
-
-require (
-	github.com/confluentinc/confluent-kafka-go v1.7.0 // indirect
-	github.com/lib/pq v1.10.3 // indirect
-)
@@ -13,7 +13,7 @@ const (
 )
 
 type Config struct {
-	bootstrapServers string
+	BootstrapServers string
 }
 
 type Worker struct {
@@ -22,7 +22,7 @@ type Worker struct {
 
 func NewProducer(config Config) (Worker, error) {
 	producer, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers":       config.bootstrapServers,
+		"bootstrap.servers":       config.BootstrapServers,
 	})
 	if err != nil {
 		return Worker{}, fmt.Errorf("failed to create producer: %w", err)
@@ -30,6 +30,12 @@ func NewProducer(config Config) (Worker, error) {
 	return Worker{ producer: producer }, nil
 }
 
+// Close waits up to timeoutMs for the outstanding messages to be delivered and releases the producer
+func (p Worker) Close(timeoutMs int) {
+	p.producer.Flush(timeoutMs)
+	p.producer.Close()
+}
+
 func (p Worker) Do(ctx context.Context, task outbox.Task) error {
 	if task.Type != TaskType {
 		return fmt.Errorf("unsupported task type %s", task.Type)
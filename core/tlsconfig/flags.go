@@ -0,0 +1,42 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"flag"
+	"time"
+)
+
+// ClientFlags are the TLS options of the command line clients, see RegisterClientFlags
+type ClientFlags struct {
+	enabled bool
+	config  Config
+}
+
+// RegisterClientFlags defines the -tls, -tls-ca, -tls-cert, -tls-key, -tls-server-name and -tls-reload options
+func RegisterClientFlags(flags *flag.FlagSet) *ClientFlags {
+	f := &ClientFlags{}
+	flags.BoolVar(&f.enabled, "tls", false, "Connect with TLS, implied by the other TLS options")
+	flags.StringVar(&f.config.CAFile, "tls-ca", "", "Server CA PEM file, the system pool is used if not set")
+	flags.StringVar(&f.config.CertFile, "tls-cert", "", "Client certificate PEM file for mutual TLS")
+	flags.StringVar(&f.config.KeyFile, "tls-key", "", "Client key PEM file for mutual TLS")
+	flags.StringVar(&f.config.ServerName, "tls-server-name", "", "Overrides the server name taken from the address")
+	flags.DurationVar(&f.config.ReloadInterval, "tls-reload", time.Minute, "How often the client certificate files are checked for changes, 0 disables the reload")
+	return f
+}
+
+// Config returns the parsed options
+func (f *ClientFlags) Config() Config {
+	return f.config
+}
+
+// ClientConfig loads the files, returns nil if TLS is not enabled
+func (f *ClientFlags) ClientConfig() (*tls.Config, error) {
+	if !f.enabled && f.config.CAFile == "" && f.config.CertFile == "" {
+		return nil, nil
+	}
+	loader, err := NewLoader(f.config)
+	if err != nil {
+		return nil, err
+	}
+	return loader.ClientConfig(), nil
+}
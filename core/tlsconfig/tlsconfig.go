@@ -0,0 +1,191 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iyarkov2/chat/core/util"
+)
+
+/*
+	TLS configuration loaded from PEM files. The files are checked for changes at most once per
+	Config.ReloadInterval during handshakes, so rotated certificates are picked up without a restart. A broken
+	rotation keeps the previously loaded certificates
+*/
+
+type Config struct {
+	// Own certificate and key. Required for servers, clients present them for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Servers verify client certificates against this CA, that enables mutual TLS. Clients verify the server
+	// certificate against it, the system pool is used if not set
+	CAFile string
+	// Clients only, overrides the server name taken from the dial address
+	ServerName string
+	// How often the files are checked for changes, 0 disables the reload
+	ReloadInterval time.Duration
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		validation = append(validation, "certificate and key files must be set together")
+	}
+	if config.ReloadInterval < 0 {
+		validation = append(validation, "reload interval must not be negative")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Loader struct {
+	config Config
+
+	mtx       *sync.Mutex
+	checkedAt time.Time
+	modTimes  map[string]time.Time
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+}
+
+// NewLoader loads the files, the loader fails if any of them is invalid
+func NewLoader(config Config) (*Loader, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	l := &Loader{
+		config: config,
+		mtx:    new(sync.Mutex),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	l.checkedAt = time.Now()
+	return l, nil
+}
+
+// ServerConfig returns the configuration of a TLS server, mutual TLS is required if the CA file is set. The ALPN
+// protocols must be given here, gRPC servers need "h2": the configuration of every handshake replaces the returned
+// one, the protocols credentials.NewTLS adds to it are not seen
+func (l *Loader) ServerConfig(nextProtos ...string) (*tls.Config, error) {
+	if l.config.CertFile == "" {
+		return nil, errors.New("server certificate required")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := l.current(hello.Context())
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   nextProtos,
+			}
+			if pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns the configuration of a TLS client. The client certificate is reloaded, the CA pool is not:
+// the standard library does not let a client replace it after the configuration is created
+func (l *Loader) ClientConfig() *tls.Config {
+	l.mtx.Lock()
+	pool := l.pool
+	l.mtx.Unlock()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: l.config.ServerName,
+		RootCAs:    pool,
+	}
+	if l.config.CertFile != "" {
+		config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := l.current(info.Context())
+			return cert, nil
+		}
+	}
+	return config
+}
+
+// current returns the loaded certificates, reloads them if the files changed
+func (l *Loader) current(ctx context.Context) (*tls.Certificate, *x509.CertPool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.config.ReloadInterval > 0 && time.Since(l.checkedAt) >= l.config.ReloadInterval {
+		l.checkedAt = time.Now()
+		if l.changed() {
+			log := util.GetLogger(ctx)
+			if err := l.load(); err != nil {
+				log.Error().Msgf("Certificate reload failed, keeping the previous certificates: %s", err)
+			} else {
+				log.Info().Msg("Certificates reloaded")
+			}
+		}
+	}
+	return l.cert, l.pool
+}
+
+// changed tells if any of the files was modified since the last load, must be called under the lock
+func (l *Loader) changed() bool {
+	for file, modTime := range l.modTimes {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the files, must be called under the lock. Nothing is changed if any file is invalid
+func (l *Loader) load() error {
+	modTimes := make(map[string]time.Time)
+	var cert *tls.Certificate
+	if l.config.CertFile != "" {
+		for _, file := range []string{l.config.CertFile, l.config.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return fmt.Errorf("failed to read %s, %w", file, err)
+			}
+			modTimes[file] = info.ModTime()
+		}
+		loaded, err := tls.LoadX509KeyPair(l.config.CertFile, l.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate, %w", err)
+		}
+		cert = &loaded
+	}
+
+	var pool *x509.CertPool
+	if l.config.CAFile != "" {
+		info, err := os.Stat(l.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s, %w", l.config.CAFile, err)
+		}
+		modTimes[l.config.CAFile] = info.ModTime()
+		pem, err := ioutil.ReadFile(l.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s, %w", l.config.CAFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", l.config.CAFile)
+		}
+	}
+
+	l.modTimes = modTimes
+	l.cert = cert
+	l.pool = pool
+	return nil
+}
@@ -0,0 +1,273 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{serial: 1}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("failed to parse CA: %s", err)
+	}
+	ca.key = key
+	return ca
+}
+
+// issue writes the certificate and the key signed by the CA
+func (ca *testCA) issue(t *testing.T, commonName string, certFile string, keyFile string) {
+	ca.serial++
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+}
+
+func (ca *testCA) write(t *testing.T, file string) {
+	writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+}
+
+func writePEM(t *testing.T, file string, blockType string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err)
+	}
+}
+
+// handshake returns the server certificate common name seen by the client and the client certificate common name
+// seen by the server
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (string, string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+	serverErr := make(chan error, 1)
+	serverState := make(chan tls.ConnectionState, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		tlsServer := tls.Server(conn, server)
+		if err := tlsServer.Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+		serverState <- tlsServer.ConnectionState()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	tlsClient := tls.Client(conn, client)
+	if err := tlsClient.Handshake(); err != nil {
+		return "", "", err
+	}
+	var state tls.ConnectionState
+	select {
+	case err := <-serverErr:
+		return "", "", err
+	case state = <-serverState:
+	}
+	serverName := tlsClient.ConnectionState().PeerCertificates[0].Subject.CommonName
+	clientName := ""
+	if peers := state.PeerCertificates; len(peers) > 0 {
+		clientName = peers[0].Subject.CommonName
+	}
+	return serverName, clientName, nil
+}
+
+func TestMutualTLSWithReload(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	ca := newTestCA(t)
+	ca.write(t, file("ca.pem"))
+	ca.issue(t, "localhost", file("server.pem"), file("server.key"))
+	ca.issue(t, "John", file("client.pem"), file("client.key"))
+
+	server, err := NewLoader(Config{
+		CertFile:       file("server.pem"),
+		KeyFile:        file("server.key"),
+		CAFile:         file("ca.pem"),
+		ReloadInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to load server files: %s", err)
+	}
+	serverConfig, err := server.ServerConfig()
+	if err != nil {
+		t.Fatalf("failed to create server config: %s", err)
+	}
+	client, err := NewLoader(Config{
+		CertFile:       file("client.pem"),
+		KeyFile:        file("client.key"),
+		CAFile:         file("ca.pem"),
+		ServerName:     "localhost",
+		ReloadInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to load client files: %s", err)
+	}
+
+	serverName, clientName, err := handshake(t, serverConfig, client.ClientConfig())
+	if err != nil || serverName != "localhost" || clientName != "John" {
+		t.Fatalf("unexpected handshake result %s %s %v", serverName, clientName, err)
+	}
+
+	// Rotated client certificate, the modification time must differ from the loaded one
+	ca.issue(t, "Jane", file("client.pem"), file("client.key"))
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{"client.pem", "client.key"} {
+		if err := os.Chtimes(file(name), later, later); err != nil {
+			t.Fatalf("chtimes failed: %s", err)
+		}
+	}
+	if _, clientName, err := handshake(t, serverConfig, client.ClientConfig()); err != nil || clientName != "Jane" {
+		t.Errorf("expected the rotated certificate, actual %s %v", clientName, err)
+	}
+
+	// A client without a certificate is rejected
+	anonymous, err := NewLoader(Config{CAFile: file("ca.pem"), ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("failed to load client files: %s", err)
+	}
+	if _, _, err := handshake(t, serverConfig, anonymous.ClientConfig()); err == nil {
+		t.Errorf("client without certificate expected to be rejected")
+	}
+}
+
+func TestBrokenRotationKeepsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca := newTestCA(t)
+	ca.issue(t, "localhost", certFile, keyFile)
+	loader, err := NewLoader(Config{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("failed to load files: %s", err)
+	}
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatalf("chtimes failed: %s", err)
+	}
+	serverConfig, err := loader.ServerConfig()
+	if err != nil {
+		t.Fatalf("failed to create server config: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	if name, _, err := handshake(t, serverConfig, &tls.Config{RootCAs: pool, ServerName: "localhost"}); err != nil || name != "localhost" {
+		t.Errorf("expected the previous certificate, actual %s %v", name, err)
+	}
+}
+
+func TestServerConfigKeepsNextProtos(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	newTestCA(t).issue(t, "localhost", certFile, keyFile)
+	loader, err := NewLoader(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("failed to load files: %s", err)
+	}
+	serverConfig, err := loader.ServerConfig("h2")
+	if err != nil {
+		t.Fatalf("failed to create server config: %s", err)
+	}
+	config, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil || len(config.NextProtos) != 1 || config.NextProtos[0] != "h2" {
+		t.Errorf("expected h2, actual %v %v", config, err)
+	}
+}
+
+func TestClientFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	clientFlags := RegisterClientFlags(flags)
+	if err := flags.Parse([]string{"-tls-server-name", "localhost", "-tls-reload", "5s"}); err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if config := clientFlags.Config(); config.ServerName != "localhost" || config.ReloadInterval != 5*time.Second {
+		t.Errorf("unexpected config %v", config)
+	}
+	// TLS is not enabled without -tls or the files
+	if config, err := clientFlags.ClientConfig(); config != nil || err != nil {
+		t.Errorf("expected no TLS, actual %v %v", config, err)
+	}
+	if err := flags.Parse([]string{"-tls"}); err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if config, err := clientFlags.ClientConfig(); err != nil || config == nil || config.ServerName != "localhost" {
+		t.Errorf("expected TLS, actual %v %v", config, err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	if _, err := NewLoader(Config{CertFile: "server.pem"}); err == nil {
+		t.Errorf("certificate without key expected to be rejected")
+	}
+	if _, err := NewLoader(Config{CAFile: "does-not-exist.pem"}); err == nil {
+		t.Errorf("missing file expected to be rejected")
+	}
+}
@@ -0,0 +1,314 @@
+package attachment
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	File attachments. Content is kept in a BlobStore, the attachment metadata next to it as a JSON blob. An attachment
+	belongs to the name of its uploader, the user id changes with every session. It can be read by its uploader and by
+	the members of the rooms it was posted to. The rooms are recorded in memory, like the rooms themselves, after a
+	restart only the uploader can read the attachment.
+
+	The owner is only as good as the name. Without mutual TLS names are first come, first served: whoever connects
+	with the name after the uploader disconnected reads and posts its attachments. Deployments that need more require
+	client certificates, the name is then the one of the certificate, see auth.PeerIdentity
+*/
+
+var (
+	ErrNotFound         = errors.New("attachment not found")
+	ErrTooLarge         = errors.New("attachment too large")
+	ErrSizeMismatch     = errors.New("attachment size does not match the declared size")
+	ErrChecksumMismatch = errors.New("attachment checksum does not match the declared checksum")
+	ErrNotOwner         = errors.New("attachment belongs to another user")
+)
+
+const (
+	// Number of bytes http.DetectContentType looks at
+	sniffLength = 512
+	// The metadata blob id is the attachment id with the suffix
+	infoSuffix = ".json"
+)
+
+type Info struct {
+	Id     string `json:"id"`
+	UserId int32  `json:"uid"`
+	// Name of the uploader
+	Owner       string `json:"owner"`
+	Name        string `json:"name"`
+	ContentType string `json:"type"`
+	Size        int64  `json:"size"`
+	// Hex encoded SHA-256 of the content
+	Sha256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created"`
+}
+
+type Config struct {
+	// Largest attachment in bytes
+	MaxSize int64
+	// Downloads are sent in chunks of this size
+	ChunkSize int
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.MaxSize <= 0 {
+		validation = append(validation, "max size must be positive")
+	}
+	if config.ChunkSize <= 0 {
+		validation = append(validation, "chunk size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Service struct {
+	config Config
+	blobs  BlobStore
+
+	mtx         *sync.RWMutex
+	attachments map[string]*attachment
+}
+
+type attachment struct {
+	info Info
+	// Rooms the attachment was posted to
+	rooms map[int32]bool
+}
+
+func NewService(blobs BlobStore, config Config) (*Service, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if blobs == nil {
+		return nil, errors.New("blob store must not be nil")
+	}
+	return &Service{
+		config:      config,
+		blobs:       blobs,
+		mtx:         new(sync.RWMutex),
+		attachments: make(map[string]*attachment),
+	}, nil
+}
+
+func (s *Service) ChunkSize() int {
+	return s.config.ChunkSize
+}
+
+// Upload stores the content of the owner. Size, content type and checksum of the declared info are optional: the size
+// and the checksum are verified if set, the content type is detected if not set
+func (s *Service) Upload(ctx context.Context, userId int32, owner string, declared Info, content io.Reader) (Info, error) {
+	if declared.Size > s.config.MaxSize {
+		return Info{}, fmt.Errorf("%w: %d bytes max", ErrTooLarge, s.config.MaxSize)
+	}
+	id, err := newId()
+	if err != nil {
+		return Info{}, err
+	}
+	w, err := s.blobs.Create(ctx, id)
+	if err != nil {
+		return Info{}, err
+	}
+
+	hash := sha256.New()
+	head := &sniffer{}
+	// One byte over the limit tells the content is too large
+	size, err := io.Copy(io.MultiWriter(w, hash, head), io.LimitReader(content, s.config.MaxSize+1))
+	if err == nil && size > s.config.MaxSize {
+		err = fmt.Errorf("%w: %d bytes max", ErrTooLarge, s.config.MaxSize)
+	}
+	if err == nil && declared.Size > 0 && size != declared.Size {
+		err = fmt.Errorf("%w: %d bytes received, %d declared", ErrSizeMismatch, size, declared.Size)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err == nil && declared.Sha256 != "" && !strings.EqualFold(declared.Sha256, checksum) {
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			return Info{}, fmt.Errorf("abort failed %s, upload failed %w", abortErr, err)
+		}
+		return Info{}, err
+	}
+	if err := w.Commit(); err != nil {
+		return Info{}, err
+	}
+
+	info := Info{
+		Id:          id,
+		UserId:      userId,
+		Owner:       owner,
+		Name:        declared.Name,
+		ContentType: declared.ContentType,
+		Size:        size,
+		Sha256:      checksum,
+		CreatedAt:   time.Now(),
+	}
+	if info.ContentType == "" {
+		info.ContentType = http.DetectContentType(head.data)
+	}
+	if err := s.saveInfo(ctx, info); err != nil {
+		if deleteErr := s.blobs.Delete(ctx, id); deleteErr != nil {
+			return Info{}, fmt.Errorf("delete failed %s, upload failed %w", deleteErr, err)
+		}
+		return Info{}, err
+	}
+	s.mtx.Lock()
+	s.attachments[id] = &attachment{info: info, rooms: make(map[int32]bool)}
+	s.mtx.Unlock()
+	return info, nil
+}
+
+func (s *Service) Get(ctx context.Context, id string) (Info, error) {
+	if err := s.load(ctx, id); err != nil {
+		return Info{}, err
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.attachments[id].info, nil
+}
+
+// Authorize checks that the attachments exist and that the owner uploaded them, it must pass before they are posted
+func (s *Service) Authorize(ctx context.Context, owner string, ids []string) error {
+	for _, id := range ids {
+		if err := s.load(ctx, id); err != nil {
+			return fmt.Errorf("%w: %s", err, id)
+		}
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, id := range ids {
+		if !strings.EqualFold(s.attachments[id].info.Owner, owner) {
+			return fmt.Errorf("%w: %s", ErrNotOwner, id)
+		}
+	}
+	return nil
+}
+
+// Attach records that the attachments were posted to the room, the members of the room can read them from now on.
+// It is called once the message is stored, the attachments must have passed Authorize
+func (s *Service) Attach(roomId int32, ids []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, id := range ids {
+		if a, ok := s.attachments[id]; ok {
+			a.rooms[roomId] = true
+		}
+	}
+}
+
+// CanRead tells if the user uploaded the attachment or is a member of a room it was posted to
+func (s *Service) CanRead(ctx context.Context, id string, owner string, isMember func(roomId int32) bool) bool {
+	if err := s.load(ctx, id); err != nil {
+		return false
+	}
+	s.mtx.RLock()
+	a := s.attachments[id]
+	if strings.EqualFold(a.info.Owner, owner) {
+		s.mtx.RUnlock()
+		return true
+	}
+	rooms := make([]int32, 0, len(a.rooms))
+	for roomId := range a.rooms {
+		rooms = append(rooms, roomId)
+	}
+	s.mtx.RUnlock()
+	for _, roomId := range rooms {
+		if isMember(roomId) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open returns the attachment content, the reader must be closed
+func (s *Service) Open(ctx context.Context, id string) (Info, io.ReadCloser, error) {
+	info, err := s.Get(ctx, id)
+	if err != nil {
+		return Info{}, nil, err
+	}
+	r, err := s.blobs.Open(ctx, id)
+	if err != nil {
+		return Info{}, nil, err
+	}
+	return info, r, nil
+}
+
+func (s *Service) saveInfo(ctx context.Context, info Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	w, err := s.blobs.Create(ctx, info.Id+infoSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			return fmt.Errorf("abort failed %s, write failed %w", abortErr, err)
+		}
+		return err
+	}
+	return w.Commit()
+}
+
+// load reads the metadata of an attachment uploaded before the restart, returns ErrNotFound if there is none
+func (s *Service) load(ctx context.Context, id string) error {
+	s.mtx.RLock()
+	_, ok := s.attachments[id]
+	s.mtx.RUnlock()
+	if ok {
+		return nil
+	}
+	r, err := s.blobs.Open(ctx, id+infoSuffix)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var info Info
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		return fmt.Errorf("invalid attachment metadata %s, %w", id, err)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.attachments[id]; !ok {
+		s.attachments[id] = &attachment{info: info, rooms: make(map[int32]bool)}
+	}
+	return nil
+}
+
+func newId() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate an attachment id, %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// sniffer keeps the beginning of the content for the content type detection
+type sniffer struct {
+	data []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if missing := sniffLength - len(s.data); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		s.data = append(s.data, p[:missing]...)
+	}
+	return len(p), nil
+}
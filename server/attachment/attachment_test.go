@@ -0,0 +1,146 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newTestService(t *testing.T) (*Service, string) {
+	dir := t.TempDir()
+	blobs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+	s, err := NewService(blobs, Config{MaxSize: 64, ChunkSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create service: %s", err)
+	}
+	return s, dir
+}
+
+func TestUpload(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	content := []byte("%PDF-1.4 content")
+
+	info, err := s.Upload(ctx, 7, "John", Info{Name: "doc.pdf"}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if info.UserId != 7 || info.Owner != "John" || info.Size != int64(len(content)) || info.ContentType != "application/pdf" || len(info.Sha256) != 64 {
+		t.Errorf("unexpected info %v", info)
+	}
+	// The declared content type wins over the detected one
+	declared, err := s.Upload(ctx, 7, "John", Info{Name: "doc", ContentType: "text/x-custom"}, bytes.NewReader(content))
+	if err != nil || declared.ContentType != "text/x-custom" {
+		t.Errorf("expected declared content type, actual %v %v", declared, err)
+	}
+
+	opened, r, err := s.Open(ctx, info.Id)
+	if err != nil {
+		t.Fatalf("open failed: %s", err)
+	}
+	defer r.Close()
+	if read, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(read, content) || opened != info {
+		t.Errorf("unexpected content %s %v", read, err)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	s, dir := newTestService(t)
+	ctx := context.Background()
+	content := "content"
+
+	for _, test := range []struct {
+		declared Info
+		content  string
+		expected error
+	}{
+		{Info{Size: 65}, content, ErrTooLarge},
+		{Info{}, strings.Repeat("x", 65), ErrTooLarge},
+		{Info{Size: 8}, content, ErrSizeMismatch},
+		{Info{Sha256: strings.Repeat("0", 64)}, content, ErrChecksumMismatch},
+	} {
+		if _, err := s.Upload(ctx, 7, "John", test.declared, strings.NewReader(test.content)); !errors.Is(err, test.expected) {
+			t.Errorf("%v expected %s, actual %v", test.declared, test.expected, err)
+		}
+	}
+	// Rejected uploads leave nothing behind
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("expected empty directory, actual %d files %v", len(files), err)
+	}
+	if _, _, err := s.Open(ctx, "../secret"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	info, err := s.Upload(ctx, 7, "John", Info{Name: "a.txt"}, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	member := func(roomId int32) bool {
+		return roomId == 1
+	}
+
+	if err := s.Authorize(ctx, "Jane", []string{info.Id}); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected ErrNotOwner, actual %v", err)
+	}
+	if err := s.Authorize(ctx, "john", []string{info.Id, "unknown"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+	if !s.CanRead(ctx, info.Id, "John", member) || s.CanRead(ctx, info.Id, "Jane", member) {
+		t.Errorf("only the uploader expected to read an attachment that was not posted")
+	}
+	if err := s.Authorize(ctx, "john", []string{info.Id}); err != nil {
+		t.Fatalf("authorize failed: %s", err)
+	}
+	// Authorized but not posted yet
+	if s.CanRead(ctx, info.Id, "Jane", member) {
+		t.Errorf("room member expected not to read the attachment before it is posted")
+	}
+	s.Attach(1, []string{info.Id})
+	if !s.CanRead(ctx, info.Id, "Jane", member) {
+		t.Errorf("room member expected to read the attachment")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	s, dir := newTestService(t)
+	ctx := context.Background()
+	info, err := s.Upload(ctx, 7, "John", Info{Name: "a.txt"}, strings.NewReader("content"))
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	// The metadata is read back from the store, the uploader reconnects with another user id
+	blobs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+	restarted, err := NewService(blobs, Config{MaxSize: 64, ChunkSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create service: %s", err)
+	}
+	if loaded, err := restarted.Get(ctx, info.Id); err != nil || loaded.Owner != "John" || !loaded.CreatedAt.Equal(info.CreatedAt) {
+		t.Errorf("expected %v, actual %v %v", info, loaded, err)
+	}
+	noRooms := func(roomId int32) bool {
+		return false
+	}
+	if !restarted.CanRead(ctx, info.Id, "John", noRooms) {
+		t.Errorf("uploader expected to read the attachment")
+	}
+	if err := restarted.Authorize(ctx, "John", []string{info.Id}); err != nil {
+		t.Errorf("authorize failed: %s", err)
+	}
+	if _, err := restarted.Get(ctx, "0123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+}
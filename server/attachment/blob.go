@@ -0,0 +1,124 @@
+package attachment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore keeps the attachment content. Implementations must be safe for concurrent use
+type BlobStore interface {
+	// Create starts a new blob, the blob becomes visible once committed
+	Create(ctx context.Context, id string) (BlobWriter, error)
+
+	// Open returns ErrNotFound if the blob does not exist
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+
+	Delete(ctx context.Context, id string) error
+}
+
+type BlobWriter interface {
+	io.Writer
+	Commit() error
+	// Abort discards the written content
+	Abort() error
+}
+
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore creates a BlobStore that keeps every blob in a file of the directory
+func NewFileStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s, %w", dir, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) Create(ctx context.Context, id string) (BlobWriter, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	// Written to a temporary file first, readers never see a partial blob
+	file, err := ioutil.TempFile(s.dir, id+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a blob, %w", err)
+	}
+	return &fileWriter{file: file, path: path}, nil
+}
+
+func (s *fileStore) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a blob, %w", err)
+	}
+	return file, nil
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete a blob, %w", err)
+	}
+	return nil
+}
+
+// path rejects ids that could escape the directory, an id is hex with an optional metadata suffix
+func (s *fileStore) path(id string) (string, error) {
+	name := strings.TrimSuffix(id, infoSuffix)
+	if name == "" {
+		return "", ErrNotFound
+	}
+	for _, r := range name {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return "", ErrNotFound
+		}
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+type fileWriter struct {
+	file *os.File
+	path string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *fileWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write a blob, %w", err)
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to commit a blob, %w", err)
+	}
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	w.file.Close()
+	if err := os.Remove(w.file.Name()); err != nil {
+		return fmt.Errorf("failed to discard a blob, %w", err)
+	}
+	return nil
+}
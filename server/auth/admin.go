@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Admin credentials. An admin sends the admin token the way users send session tokens, with mutual TLS the client
+	certificate of one of the admin names is accepted as well
+*/
+
+type Admins struct {
+	token []byte
+	names map[string]bool
+}
+
+// NewAdmins accepts the token and the certificate common names, either may be empty but not both
+func NewAdmins(token string, names []string) (*Admins, error) {
+	validation := make([]string, 0)
+	if token == "" && len(names) == 0 {
+		validation = append(validation, "admin token or names required")
+	}
+	if token != "" && len(token) < 32 {
+		validation = append(validation, "admin token must be at least 32 bytes long")
+	}
+	if len(validation) > 0 {
+		return nil, fmt.Errorf("invalid configuration %v", validation)
+	}
+	result := &Admins{
+		token: []byte(token),
+		names: make(map[string]bool, len(names)),
+	}
+	for _, name := range names {
+		result.names[name] = true
+	}
+	return result, nil
+}
+
+// Verify checks the admin credentials of the request
+func (a *Admins) Verify(ctx context.Context) error {
+	if identity, ok := PeerIdentity(ctx); ok && a.names[identity] {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(Header)
+	if len(values) == 0 {
+		return status.Error(codes.Unauthenticated, "missing admin credentials")
+	}
+	token, ok := TokenFromHeader(values[0])
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing admin credentials")
+	}
+	if len(a.token) == 0 || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin credentials")
+	}
+	return nil
+}
+
+// AdminUnaryServerInterceptor verifies the admin credentials of the calls to the service, e.g.
+// "iyarkov2.chat.api.ChatAdmin". Nil admins reject every call to the service
+func AdminUnaryServerInterceptor(service string, admins *Admins) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := verifyAdmin(ctx, service, info.FullMethod, admins); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func AdminStreamServerInterceptor(service string, admins *Admins) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := verifyAdmin(ss.Context(), service, info.FullMethod, admins); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func verifyAdmin(ctx context.Context, service string, method string, admins *Admins) error {
+	if !strings.HasPrefix(method, "/"+service+"/") {
+		return nil
+	}
+	if admins == nil {
+		return status.Error(codes.PermissionDenied, "admin service is not configured")
+	}
+	return admins.Verify(ctx)
+}
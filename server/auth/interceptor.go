@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Clients send the token as "authorization: Bearer <token>"
+	Header = "authorization"
+	scheme = "bearer "
+)
+
+type userKeyType string
+
+const userKey = userKeyType("auth.user")
+
+type Config struct {
+	Signer *Signer
+	// Methods that do not require a token, e.g. Connect
+	Public map[string]bool
+	// Optional check that the session of a valid token is still alive
+	Validate func(ctx context.Context, claims Claims) error
+}
+
+func WithUser(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, userKey, claims)
+}
+
+// UserFromContext returns the authenticated user, see UnaryServerInterceptor and StreamServerInterceptor
+func UserFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(userKey).(Claims)
+	return claims, ok
+}
+
+// AppendToken adds the token to the outgoing metadata
+func AppendToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, Header, "Bearer "+token)
+}
+
+// TokenFromHeader extracts the token from the authorization header value
+func TokenFromHeader(value string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(value), scheme) {
+		return "", false
+	}
+	return value[len(scheme):], true
+}
+
+func UnaryServerInterceptor(config Config) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if config.Public[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		authenticated, err := authenticate(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return handler(authenticated, req)
+	}
+}
+
+func StreamServerInterceptor(config Config) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if config.Public[info.FullMethod] {
+			return handler(srv, ss)
+		}
+		authenticated, err := authenticate(ss.Context(), config)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: authenticated})
+	}
+}
+
+func authenticate(ctx context.Context, config Config) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	values := md.Get(Header)
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	token, ok := TokenFromHeader(values[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	claims, err := config.Signer.Verify(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if config.Validate != nil {
+		if err := config.Validate(ctx, claims); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	return WithUser(ctx, claims), nil
+}
+
+// serverStream overrides the stream context with the authenticated one
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
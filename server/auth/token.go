@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+	Session tokens. A token is the base64 encoded JSON claims followed by the HMAC-SHA256 signature of the claims
+*/
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+type Claims struct {
+	UserId    int32  `json:"uid"`
+	Name      string `json:"name"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type Signer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func NewSigner(secret []byte, ttl time.Duration) (*Signer, error) {
+	validation := make([]string, 0)
+	if len(secret) < 32 {
+		validation = append(validation, "secret must be at least 32 bytes long")
+	}
+	if ttl <= 0 {
+		validation = append(validation, "ttl must be positive")
+	}
+	if len(validation) > 0 {
+		return nil, fmt.Errorf("invalid configuration %v", validation)
+	}
+	return &Signer{secret: secret, ttl: ttl}, nil
+}
+
+// Issue creates a signed token for the user
+func (s *Signer) Issue(userId int32, name string) (string, error) {
+	payload, err := json.Marshal(Claims{
+		UserId:    userId,
+		Name:      name,
+		ExpiresAt: time.Now().Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)), nil
+}
+
+// Verify checks the token signature and expiration
+func (s *Signer) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.sign(parts[0])) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func (s *Signer) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestSigner(t *testing.T, ttl time.Duration) *Signer {
+	signer, err := NewSigner(testSecret, ttl)
+	if err != nil {
+		t.Fatalf("failed to create signer: %s", err)
+	}
+	return signer
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	signer := newTestSigner(t, time.Hour)
+	token, err := signer.Issue(7, "John")
+	if err != nil {
+		t.Fatalf("issue failed: %s", err)
+	}
+	claims, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("verify failed: %s", err)
+	}
+	if claims.UserId != 7 || claims.Name != "John" {
+		t.Errorf("unexpected claims %v", claims)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	signer := newTestSigner(t, time.Hour)
+	token, err := signer.Issue(7, "John")
+	if err != nil {
+		t.Fatalf("issue failed: %s", err)
+	}
+	other, err := NewSigner([]byte(strings.Repeat("x", 32)), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create signer: %s", err)
+	}
+	forged, err := other.Issue(1, "Admin")
+	if err != nil {
+		t.Fatalf("issue failed: %s", err)
+	}
+	// Claims of one token with the signature of another
+	mixed := strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+
+	for _, value := range []string{"", "garbage", forged, mixed} {
+		if _, err := signer.Verify(value); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("token [%s] expected to be invalid, actual %v", value, err)
+		}
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	signer := newTestSigner(t, time.Hour)
+	signer.ttl = -time.Second
+	token, err := signer.Issue(7, "John")
+	if err != nil {
+		t.Fatalf("issue failed: %s", err)
+	}
+	if _, err := signer.Verify(token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expected ErrExpiredToken, actual %v", err)
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	signer := newTestSigner(t, time.Hour)
+	token, err := signer.Issue(7, "John")
+	if err != nil {
+		t.Fatalf("issue failed: %s", err)
+	}
+	interceptor := UnaryServerInterceptor(Config{
+		Signer: signer,
+		Public: map[string]bool{"/public": true},
+	})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		claims, _ := UserFromContext(ctx)
+		return claims.UserId, nil
+	}
+	call := func(ctx context.Context, method string) (interface{}, error) {
+		return interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+	}
+	incoming := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(Header, value))
+	}
+
+	if _, err := call(context.Background(), "/public"); err != nil {
+		t.Errorf("public method expected to pass, actual %s", err)
+	}
+	if _, err := call(context.Background(), "/private"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if _, err := call(incoming("Bearer forged"), "/private"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if userId, err := call(incoming("Bearer "+token), "/private"); err != nil || userId != int32(7) {
+		t.Errorf("expected user 7, actual %v %v", userId, err)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	if _, ok := PeerIdentity(context.Background()); ok {
+		t.Errorf("no identity expected without a peer")
+	}
+	state := tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "John"}}}},
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	if name, ok := PeerIdentity(ctx); !ok || name != "John" {
+		t.Errorf("expected John, actual %s %v", name, ok)
+	}
+	// Server side TLS only, the client is not verified
+	ctx = peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	if _, ok := PeerIdentity(ctx); ok {
+		t.Errorf("no identity expected without client certificate")
+	}
+}
+
+func TestAdminUnaryServerInterceptor(t *testing.T) {
+	admins, err := NewAdmins(string(testSecret), []string{"root"})
+	if err != nil {
+		t.Fatalf("failed to create admins: %s", err)
+	}
+	if _, err := NewAdmins("short", nil); err == nil {
+		t.Errorf("short admin token expected to be rejected")
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	call := func(admins *Admins, ctx context.Context, method string) error {
+		_, err := AdminUnaryServerInterceptor("test.Admin", admins)(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	incoming := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(Header, value))
+	}
+	state := tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "root"}}}},
+	}
+	root := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+
+	if err := call(admins, context.Background(), "/test.Chat/Post"); err != nil {
+		t.Errorf("other services expected to pass, actual %s", err)
+	}
+	if err := call(admins, context.Background(), "/test.Admin/Kick"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if err := call(admins, incoming("Bearer forged"), "/test.Admin/Kick"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+	if err := call(admins, incoming("Bearer "+string(testSecret)), "/test.Admin/Kick"); err != nil {
+		t.Errorf("admin token expected to pass, actual %s", err)
+	}
+	if err := call(admins, root, "/test.Admin/Kick"); err != nil {
+		t.Errorf("admin certificate expected to pass, actual %s", err)
+	}
+	if err := call(nil, incoming("Bearer "+string(testSecret)), "/test.Admin/Kick"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied without admins, actual %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package block
+
+import (
+	"strings"
+	"sync"
+)
+
+/*
+	Block and mute lists of the users. Posts and presence of a blocked user do not reach the blocker, muted rooms do not
+	notify the user. The lists are keyed by the user names, case insensitive, the user ids change from session to
+	session. The lists are kept in memory across the sessions of their owner until the server restarts
+*/
+
+type Registry struct {
+	mtx *sync.RWMutex
+	// Blocked user names by blocker name, lower case
+	blocked map[string]map[string]bool
+	// Muted room ids by lower case user name
+	muted map[string]map[int32]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mtx:     new(sync.RWMutex),
+		blocked: make(map[string]map[string]bool),
+		muted:   make(map[string]map[int32]bool),
+	}
+}
+
+func (r *Registry) Block(userName string, blockedName string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := strings.ToLower(userName)
+	list, ok := r.blocked[key]
+	if !ok {
+		list = make(map[string]bool)
+		r.blocked[key] = list
+	}
+	list[strings.ToLower(blockedName)] = true
+}
+
+func (r *Registry) Unblock(userName string, blockedName string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := strings.ToLower(userName)
+	delete(r.blocked[key], strings.ToLower(blockedName))
+	if len(r.blocked[key]) == 0 {
+		delete(r.blocked, key)
+	}
+}
+
+// IsBlocked tells if the user blocked the author
+func (r *Registry) IsBlocked(userName string, authorName string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.blocked[strings.ToLower(userName)][strings.ToLower(authorName)]
+}
+
+// Blockers returns the lower case names of the users who blocked the author
+func (r *Registry) Blockers(authorName string) map[string]bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	author := strings.ToLower(authorName)
+	result := make(map[string]bool)
+	for userName, blocked := range r.blocked {
+		if blocked[author] {
+			result[userName] = true
+		}
+	}
+	return result
+}
+
+func (r *Registry) Mute(userName string, roomId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := strings.ToLower(userName)
+	list, ok := r.muted[key]
+	if !ok {
+		list = make(map[int32]bool)
+		r.muted[key] = list
+	}
+	list[roomId] = true
+}
+
+func (r *Registry) Unmute(userName string, roomId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	key := strings.ToLower(userName)
+	delete(r.muted[key], roomId)
+	if len(r.muted[key]) == 0 {
+		delete(r.muted, key)
+	}
+}
+
+func (r *Registry) IsMuted(userName string, roomId int32) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.muted[strings.ToLower(userName)][roomId]
+}
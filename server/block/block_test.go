@@ -0,0 +1,27 @@
+package block
+
+import (
+	"testing"
+)
+
+func TestBlockAndMute(t *testing.T) {
+	r := NewRegistry()
+	r.Block("John", "Jack")
+	r.Block("Jane", "jack")
+	r.Block("Jane", "Jill")
+	r.Unblock("jane", "JILL")
+
+	if blockers := r.Blockers("JACK"); len(blockers) != 2 || !blockers["john"] || !blockers["jane"] {
+		t.Errorf("expected blockers john and jane, actual %v", blockers)
+	}
+	if r.IsBlocked("Jane", "Jill") || !r.IsBlocked("john", "jack") || r.IsBlocked("Jack", "John") {
+		t.Errorf("unexpected blocked state")
+	}
+
+	r.Mute("John", 100)
+	r.Mute("John", 200)
+	r.Unmute("john", 200)
+	if !r.IsMuted("JOHN", 100) || r.IsMuted("John", 200) || r.IsMuted("Jane", 100) {
+		t.Errorf("unexpected muted state")
+	}
+}
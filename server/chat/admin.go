@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AdminServer implements the ChatAdmin service on top of the chat server state. The admin credentials are checked by
+// the interceptors of Server.ServerOptions
+type AdminServer struct {
+	api.UnimplementedChatAdminServer
+	chat *Server
+}
+
+// AdminServer returns the ChatAdmin service, it must be registered on the gRPC server of the chat service
+func (s *Server) AdminServer() *AdminServer {
+	return &AdminServer{chat: s}
+}
+
+func (a *AdminServer) ListSessions(ctx context.Context, request *api.ListSessionsRequest) (*api.ListSessionsResponse, error) {
+	sessions := a.chat.sessions.list()
+	result := &api.ListSessionsResponse{
+		Sessions: make([]*api.Session, 0, len(sessions)),
+	}
+	for _, existing := range sessions {
+		result.Sessions = append(result.Sessions, &api.Session{
+			UserId:      existing.userId,
+			Name:        existing.name,
+			PeerAddress: existing.peerAddress,
+			ApiVersion:  existing.apiVersion,
+			ConnectedAt: timestamppb.New(existing.connectedAt),
+		})
+	}
+	return result, nil
+}
+
+func (a *AdminServer) KickSession(ctx context.Context, request *api.KickSessionRequest) (*api.KickSessionResponse, error) {
+	if !a.chat.kick(ctx, request.UserId, request.Reason) {
+		return nil, status.Errorf(codes.NotFound, "user %d is not connected", request.UserId)
+	}
+	return &api.KickSessionResponse{}, nil
+}
+
+func (a *AdminServer) BanUser(ctx context.Context, request *api.BanUserRequest) (*api.BanUserResponse, error) {
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name required")
+	}
+	if request.DurationSeconds <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "duration must be positive")
+	}
+	until := time.Now().Add(time.Duration(request.DurationSeconds) * time.Second)
+	a.chat.bans.Ban(name, until)
+	log.Printf("User [%s] banned until %s: %s", name, until.Format(time.RFC3339), request.Reason)
+
+	result := &api.BanUserResponse{
+		ExpiresAt: timestamppb.New(until),
+	}
+	u, err := a.chat.users.FindByName(ctx, name)
+	if errors.Is(err, user.ErrNotFound) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to find user [%s]: %s", name, err)
+	}
+	reason := request.Reason
+	if reason == "" {
+		reason = "banned"
+	}
+	result.Kicked = a.chat.kick(ctx, u.Id, reason)
+	return result, nil
+}
+
+func (a *AdminServer) BroadcastSystemMessage(ctx context.Context, request *api.BroadcastSystemMessageRequest) (*api.BroadcastSystemMessageResponse, error) {
+	if strings.TrimSpace(request.Text) == "" {
+		return nil, status.Error(codes.InvalidArgument, "text required")
+	}
+	recipients := make(map[int32]bool)
+	if request.RoomId != 0 {
+		members, err := a.chat.rooms.Members(request.RoomId)
+		if err != nil {
+			return nil, roomError(err)
+		}
+		recipients = members
+	} else {
+		users, err := a.chat.users.List(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list users: %s", err)
+		}
+		for _, u := range users {
+			recipients[u.Id] = true
+		}
+	}
+	a.chat.deliver(nil, &api.PostResponse{
+		Event:  api.PostResponse_SYSTEM,
+		Text:   request.Text,
+		RoomId: request.RoomId,
+		Ts:     timestamppb.Now(),
+	}, recipients)
+	log.Printf("System message sent to %d users", len(recipients))
+	return &api.BroadcastSystemMessageResponse{
+		Recipients: int32(len(recipients)),
+	}, nil
+}
+
+// kick ends the session of the user and its streams. Returns false if the user is not connected
+func (s *Server) kick(ctx context.Context, userId int32, reason string) bool {
+	if !s.sessions.remove(userId) {
+		return false
+	}
+	s.disconnect(ctx, userId)
+	err := errKicked
+	if reason != "" {
+		err = fmt.Errorf("%w: %s", errKicked, reason)
+	}
+	streams := s.hub.Close(userId, err)
+	log.Printf("User %d kicked, %d streams ended: %s", userId, streams, reason)
+	return true
+}
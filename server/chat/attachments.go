@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *Server) UploadAttachment(stream api.ChatService_UploadAttachmentServer) error {
+	userId, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "attachment info required")
+	}
+	if err != nil {
+		return err
+	}
+	info := first.GetInfo()
+	if info == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the attachment info")
+	}
+	if strings.TrimSpace(info.Name) == "" {
+		return status.Error(codes.InvalidArgument, "attachment name required")
+	}
+	uploaded, err := s.attachments.Upload(stream.Context(), userId, s.callerName(stream.Context()), attachment.Info{
+		Name:        info.Name,
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		Sha256:      info.Sha256,
+	}, &uploadReader{stream: stream})
+	if err != nil {
+		return attachmentError(err)
+	}
+	log.Printf("User %d uploaded attachment %s, %d bytes", userId, uploaded.Id, uploaded.Size)
+	return stream.SendAndClose(&api.UploadAttachmentResponse{
+		Attachment: toApiAttachment(uploaded),
+	})
+}
+
+func (s *Server) DownloadAttachment(request *api.DownloadAttachmentRequest, stream api.ChatService_DownloadAttachmentServer) error {
+	userId, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	// Attachments of other rooms do not exist for the caller
+	if !s.attachments.CanRead(stream.Context(), request.AttachmentId, s.callerName(stream.Context()), func(roomId int32) bool {
+		return s.rooms.IsMember(roomId, userId)
+	}) {
+		return status.Errorf(codes.NotFound, "%s: %s", attachment.ErrNotFound, request.AttachmentId)
+	}
+	info, content, err := s.attachments.Open(stream.Context(), request.AttachmentId)
+	if err != nil {
+		return attachmentError(err)
+	}
+	defer content.Close()
+
+	if err := stream.Send(&api.DownloadAttachmentResponse{
+		Content: &api.DownloadAttachmentResponse_Info{Info: toApiAttachment(info)},
+	}); err != nil {
+		return err
+	}
+	chunk := make([]byte, s.attachments.ChunkSize())
+	for {
+		n, err := io.ReadFull(content, chunk)
+		if n > 0 {
+			if err := stream.Send(&api.DownloadAttachmentResponse{
+				Content: &api.DownloadAttachmentResponse_Chunk{Chunk: chunk[:n]},
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Failed to read attachment %s: %s", info.Id, err)
+			return status.Error(codes.Internal, "failed to read the attachment")
+		}
+	}
+}
+
+// uploadReader reads the chunks of the upload stream
+type uploadReader struct {
+	stream  api.ChatService_UploadAttachmentServer
+	pending []byte
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		in, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if in.GetInfo() != nil {
+			return 0, status.Error(codes.InvalidArgument, "attachment info must be sent once")
+		}
+		r.pending = in.GetChunk()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func toApiAttachment(info attachment.Info) *api.Attachment {
+	return &api.Attachment{
+		Id:          info.Id,
+		Name:        info.Name,
+		ContentType: info.ContentType,
+		Size:        info.Size,
+		Sha256:      info.Sha256,
+		UserId:      info.UserId,
+		CreatedAt:   timestamppb.New(info.CreatedAt),
+	}
+}
+
+func attachmentError(err error) error {
+	switch {
+	case errors.Is(err, attachment.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, attachment.ErrNotOwner):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, attachment.ErrTooLarge),
+		errors.Is(err, attachment.ErrSizeMismatch),
+		errors.Is(err, attachment.ErrChecksumMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case status.Code(err) != codes.Unknown:
+		// Failed upload stream
+		return err
+	default:
+		return status.Errorf(codes.Internal, "attachment failed: %s", err)
+	}
+}
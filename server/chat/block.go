@@ -0,0 +1,95 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/user"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) BlockUser(ctx context.Context, request *api.BlockUserRequest) (*api.BlockUserResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name, err := s.targetName(ctx, request.UserId, request.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(name, s.callerName(ctx)) {
+		return nil, status.Error(codes.InvalidArgument, "users can not block themselves")
+	}
+	s.blocks.Block(s.callerName(ctx), name)
+	log.Printf("User %d blocked user [%s]", userId, name)
+	return &api.BlockUserResponse{}, nil
+}
+
+func (s *Server) UnblockUser(ctx context.Context, request *api.UnblockUserRequest) (*api.UnblockUserResponse, error) {
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+	name, err := s.targetName(ctx, request.UserId, request.UserName)
+	if err != nil {
+		return nil, err
+	}
+	s.blocks.Unblock(s.callerName(ctx), name)
+	return &api.UnblockUserResponse{}, nil
+}
+
+func (s *Server) MuteRoom(ctx context.Context, request *api.MuteRoomRequest) (*api.MuteRoomResponse, error) {
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := s.rooms.Get(request.RoomId); err != nil {
+		return nil, roomError(err)
+	}
+	if request.Mute {
+		s.blocks.Mute(s.callerName(ctx), request.RoomId)
+	} else {
+		s.blocks.Unmute(s.callerName(ctx), request.RoomId)
+	}
+	return &api.MuteRoomResponse{}, nil
+}
+
+// targetName returns the name of the user to block or unblock. The id of a connected user takes precedence over the
+// name, the name also reaches the users who are not connected
+func (s *Server) targetName(ctx context.Context, userId int32, userName string) (string, error) {
+	if userId == 0 {
+		userName = strings.TrimSpace(userName)
+		if userName == "" {
+			return "", status.Error(codes.InvalidArgument, "user id or name required")
+		}
+		return userName, nil
+	}
+	u, err := s.users.Get(ctx, userId)
+	if errors.Is(err, user.ErrNotFound) {
+		return "", status.Errorf(codes.NotFound, "user %d: %s", userId, err)
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to find user %d: %s", userId, err)
+	}
+	return u.Name, nil
+}
+
+// isBlocked tells if the user blocked the author, false if the author is no longer connected
+func (s *Server) isBlocked(ctx context.Context, userName string, authorId int32) bool {
+	author, err := s.users.Get(ctx, authorId)
+	if err != nil {
+		return false
+	}
+	return s.blocks.IsBlocked(userName, author.Name)
+}
+
+// hidden returns the placeholder of a message sent to the users who blocked its author
+func hidden(event *api.PostResponse) *api.PostResponse {
+	return &api.PostResponse{
+		Event:  api.PostResponse_HIDDEN,
+		RoomId: event.RoomId,
+		Seq:    event.Seq,
+	}
+}
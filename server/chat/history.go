@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/resume"
+	"github.com/iyarkov2/chat/server/room"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *Server) GetHistory(ctx context.Context, request *api.GetHistoryRequest) (*api.GetHistoryResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !s.rooms.IsMember(request.RoomId, userId) {
+		return nil, status.Errorf(codes.PermissionDenied, "room %d: %s", request.RoomId, room.ErrNotMember)
+	}
+
+	page, err := history.Fetch(ctx, s.messages, request.RoomId, request.Cursor, int(request.Limit))
+	if errors.Is(err, history.ErrInvalidCursor) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read history: %s", err)
+	}
+
+	result := &api.GetHistoryResponse{
+		Messages:   make([]*api.PostResponse, 0, len(page.Messages)),
+		NextCursor: page.Next.Encode(),
+	}
+	if page.Prev != nil {
+		result.PrevCursor = page.Prev.Encode()
+	}
+	for _, msg := range s.readBy(ctx, s.callerName(ctx), page.Messages) {
+		result.Messages = append(result.Messages, toApiMessage(msg))
+	}
+	return result, nil
+}
+
+// Most messages sent per room when a Post stream resumes, the client sees the rest as a gap and resumes again
+const maxReplay = 1000
+
+// replay sends the messages the caller missed according to the resume positions of the stream
+func (s *Server) replay(stream api.ChatService_PostServer, userId int32) error {
+	positions, err := resume.PositionsFromContext(stream.Context())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	for roomId, seq := range positions {
+		if !s.rooms.IsMember(roomId, userId) {
+			return status.Errorf(codes.PermissionDenied, "room %d: %s", roomId, room.ErrNotMember)
+		}
+		for sent := 0; sent < maxReplay; {
+			messages, err := s.messages.Since(stream.Context(), roomId, seq, history.MaxPageSize)
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to read history: %s", err)
+			}
+			for _, msg := range s.readBy(stream.Context(), s.callerName(stream.Context()), messages) {
+				event := toApiMessage(msg)
+				if s.blocks.IsBlocked(s.callerName(stream.Context()), msg.UserName) {
+					event = hidden(event)
+				}
+				if err := stream.Send(event); err != nil {
+					return err
+				}
+				seq = msg.Seq
+			}
+			sent += len(messages)
+			if len(messages) < history.MaxPageSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// readBy starts the expiry clock of the messages that expire after read, except the messages of the reader, and returns
+// the messages with their expiration time. Failures are logged, the messages are still read
+func (s *Server) readBy(ctx context.Context, readerName string, messages []history.Message) []history.Message {
+	ids := make([]int32, 0)
+	for _, msg := range messages {
+		if msg.ReadTtl > 0 && msg.ExpiresAt.IsZero() && !strings.EqualFold(msg.UserName, readerName) {
+			ids = append(ids, msg.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return messages
+	}
+	started, err := s.messages.StartExpiry(ctx, ids, time.Now())
+	if err != nil {
+		log.Printf("Failed to start the expiry of messages %v: %s", ids, err)
+		return messages
+	}
+	expiresAt := make(map[int32]time.Time, len(started))
+	for _, msg := range started {
+		expiresAt[msg.Id] = msg.ExpiresAt
+	}
+	result := make([]history.Message, len(messages))
+	for i, msg := range messages {
+		if at, ok := expiresAt[msg.Id]; ok {
+			msg.ExpiresAt = at
+		}
+		result[i] = msg
+	}
+	return result
+}
+
+func toApiMessage(msg history.Message) *api.PostResponse {
+	result := &api.PostResponse{
+		Id:            msg.Id,
+		UserId:        msg.UserId,
+		UserName:      msg.UserName,
+		Text:          msg.Text,
+		RoomId:        msg.RoomId,
+		Seq:           msg.Seq,
+		Ts:            timestamppb.New(msg.CreatedAt),
+		Deleted:       msg.Deleted,
+		AttachmentIds: msg.AttachmentIds,
+		ParentId:      msg.ParentId,
+		ReplyCount:    msg.ReplyCount,
+	}
+	if !msg.EditedAt.IsZero() {
+		result.EditedAt = timestamppb.New(msg.EditedAt)
+	}
+	if !msg.ExpiresAt.IsZero() {
+		result.ExpiresAt = timestamppb.New(msg.ExpiresAt)
+	}
+	return result
+}
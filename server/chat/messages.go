@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/history"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) EditMessage(ctx context.Context, request *api.EditMessageRequest) (*api.EditMessageResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(request.Text) == "" {
+		return nil, status.Error(codes.InvalidArgument, "text required, use DeleteMessage to remove a message")
+	}
+	msg, err := s.authorizeChange(ctx, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	text, err := s.moderate(ctx, userId, msg.RoomId, request.Text)
+	var rejected *filter.RejectedError
+	if errors.As(err, &rejected) {
+		return nil, status.Error(codes.InvalidArgument, rejected.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	edited, err := s.messages.Edit(ctx, request.MessageId, text)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	log.Printf("User %d edited message %d", userId, edited.Id)
+	s.search.Add(edited)
+	event := toApiMessage(edited)
+	event.Event = api.PostResponse_EDITED
+	s.broadcast(event)
+	return &api.EditMessageResponse{
+		Message: event,
+	}, nil
+}
+
+func (s *Server) DeleteMessage(ctx context.Context, request *api.DeleteMessageRequest) (*api.DeleteMessageResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.authorizeChange(ctx, request.MessageId); err != nil {
+		return nil, err
+	}
+	deleted, err := s.messages.Delete(ctx, request.MessageId)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	log.Printf("User %d deleted message %d", userId, deleted.Id)
+	s.search.Remove(deleted.Id)
+	event := toApiMessage(deleted)
+	event.Event = api.PostResponse_DELETED
+	s.broadcast(event)
+	return &api.DeleteMessageResponse{
+		Message: event,
+	}, nil
+}
+
+// authorizeChange allows the message author and the room owner to change the message, returns the message. Both are
+// matched by name, the user ids change when they reconnect
+func (s *Server) authorizeChange(ctx context.Context, messageId int32) (history.Message, error) {
+	msg, err := s.messages.Get(ctx, messageId)
+	if err != nil {
+		return history.Message{}, messageError(err)
+	}
+	name := s.callerName(ctx)
+	if strings.EqualFold(msg.UserName, name) {
+		return msg, nil
+	}
+	r, err := s.rooms.Get(msg.RoomId)
+	if err != nil {
+		return history.Message{}, roomError(err)
+	}
+	if !strings.EqualFold(r.OwnerName, name) {
+		return history.Message{}, status.Errorf(codes.PermissionDenied, "message %d belongs to another user", messageId)
+	}
+	return msg, nil
+}
+
+// broadcast delivers the event to every Post stream of the room members, including the streams of the caller. Events
+// of replies go to the thread followers only
+func (s *Server) broadcast(event *api.PostResponse) {
+	members, err := s.rooms.Members(event.RoomId)
+	if err != nil {
+		log.Printf("Failed to broadcast message %d event: %s", event.Id, err)
+		return
+	}
+	if event.ParentId != 0 {
+		members = s.followers(event.ParentId, members)
+	}
+	s.deliver(nil, event, members)
+}
+
+// broadcastRemoved sends an EXPIRED tombstone of every message removed by the sweeper, until the sweeper is closed
+func (s *Server) broadcastRemoved(removed <-chan history.Message) {
+	for msg := range removed {
+		s.search.Remove(msg.Id)
+		if msg.ParentId == 0 {
+			s.threads.Forget(msg.Id)
+		}
+		event := toApiMessage(msg)
+		event.Event = api.PostResponse_EXPIRED
+		event.Text = ""
+		event.AttachmentIds = nil
+		event.Deleted = true
+		s.broadcast(event)
+	}
+}
+
+func messageError(err error) error {
+	switch {
+	case errors.Is(err, history.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, history.ErrDeleted):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "failed to update a message: %s", err)
+	}
+}
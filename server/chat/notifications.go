@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"strings"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/inbox"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultNotificationPage = 50
+	maxNotificationPage     = 500
+)
+
+func (s *Server) ListNotifications(ctx context.Context, request *api.ListNotificationsRequest) (*api.ListNotificationsResponse, error) {
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+	userName := s.callerName(ctx)
+	limit := int(request.Limit)
+	if limit <= 0 {
+		limit = defaultNotificationPage
+	}
+	if limit > maxNotificationPage {
+		limit = maxNotificationPage
+	}
+
+	// One extra notification tells if there is more to read
+	notifications := s.inbox.List(userName, request.BeforeId, request.UnreadOnly, limit+1)
+	result := &api.ListNotificationsResponse{
+		Notifications: make([]*api.Notification, 0, len(notifications)),
+		HasMore:       len(notifications) > limit,
+		UnreadCount:   int32(s.inbox.Unread(userName)),
+	}
+	if result.HasMore {
+		notifications = notifications[:limit]
+	}
+	for _, n := range notifications {
+		result.Notifications = append(result.Notifications, toApiNotification(n))
+	}
+	return result, nil
+}
+
+func (s *Server) MarkRead(ctx context.Context, request *api.MarkReadRequest) (*api.MarkReadResponse, error) {
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+	return &api.MarkReadResponse{
+		UnreadCount: int32(s.inbox.MarkRead(s.callerName(ctx), request.NotificationIds)),
+	}, nil
+}
+
+func (s *Server) WatchNotifications(request *api.WatchNotificationsRequest, stream api.ChatService_WatchNotificationsServer) error {
+	userId, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	watcher := s.inbox.Watch(s.callerName(stream.Context()))
+	defer s.inbox.Unwatch(watcher)
+	ended := s.sessions.done(userId)
+	for {
+		select {
+		case n := <-watcher.Notifications():
+			if err := stream.Send(toApiNotification(n)); err != nil {
+				return err
+			}
+		case <-watcher.Done():
+			return status.Error(codes.ResourceExhausted, "notification watcher fell behind")
+		case <-ended:
+			return status.Error(codes.Unauthenticated, errSessionClosed.Error())
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// notifyMentions adds a notification to the inbox of every room member mentioned in the message, except the author,
+// the members who muted the room and the members who blocked the author. The members are matched by name, the
+// disconnected members find the notifications in the inbox when they connect again
+func (s *Server) notifyMentions(msg history.Message) {
+	for _, name := range inbox.ParseMentions(msg.Text) {
+		if strings.EqualFold(name, msg.UserName) || !s.rooms.HasMemberNamed(msg.RoomId, name) {
+			continue
+		}
+		if s.blocks.IsMuted(name, msg.RoomId) || s.blocks.IsBlocked(name, msg.UserName) {
+			continue
+		}
+		s.inbox.Add(inbox.Notification{
+			UserName:  name,
+			Kind:      inbox.Mention,
+			RoomId:    msg.RoomId,
+			MessageId: msg.Id,
+			AuthorId:  msg.UserId,
+			Text:      msg.Text,
+		})
+	}
+}
+
+func toApiNotification(n inbox.Notification) *api.Notification {
+	return &api.Notification{
+		Id:        n.Id,
+		Kind:      api.Notification_Kind(n.Kind),
+		RoomId:    n.RoomId,
+		MessageId: n.MessageId,
+		AuthorId:  n.AuthorId,
+		Text:      n.Text,
+		CreatedAt: timestamppb.New(n.CreatedAt),
+		Read:      n.Read,
+	}
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/room"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *Server) Heartbeat(ctx context.Context, request *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := presence.Online
+	if request.State == api.PresenceState_AWAY {
+		state = presence.Away
+	}
+	typingRoomId := request.TypingRoomId
+	if typingRoomId != 0 && !s.rooms.IsMember(typingRoomId, userId) {
+		return nil, status.Errorf(codes.PermissionDenied, "room %d: %s", typingRoomId, room.ErrNotMember)
+	}
+	s.presence.Heartbeat(userId, state, typingRoomId)
+	return &api.HeartbeatResponse{
+		TimeoutMs: int32(s.presence.Timeout().Milliseconds()),
+	}, nil
+}
+
+func (s *Server) WatchPresence(request *api.WatchPresenceRequest, stream api.ChatService_WatchPresenceServer) error {
+	userId, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	userName := s.callerName(stream.Context())
+	roomId := request.RoomId
+	if !s.rooms.IsMember(roomId, userId) {
+		return status.Errorf(codes.PermissionDenied, "room %d: %s", roomId, room.ErrNotMember)
+	}
+
+	// Watch first, so no change is lost between the snapshot and the events
+	watcher := s.presence.Watch(func(memberId int32) bool {
+		return s.rooms.IsMember(roomId, memberId) && !s.isBlocked(stream.Context(), userName, memberId)
+	})
+	defer s.presence.Unwatch(watcher)
+
+	members, err := s.rooms.Members(roomId)
+	if err != nil {
+		return roomError(err)
+	}
+	for memberId := range members {
+		if s.isBlocked(stream.Context(), userName, memberId) {
+			continue
+		}
+		if err := stream.Send(toApiPresence(s.presence.Get(memberId))); err != nil {
+			return err
+		}
+	}
+
+	ended := s.sessions.done(userId)
+	for {
+		select {
+		case event := <-watcher.Events():
+			// The watcher may have left the room since the stream was opened
+			if !s.rooms.IsMember(roomId, userId) {
+				return status.Errorf(codes.PermissionDenied, "room %d: %s", roomId, room.ErrNotMember)
+			}
+			if err := stream.Send(toApiPresence(event)); err != nil {
+				return err
+			}
+		case <-watcher.Done():
+			return status.Error(codes.ResourceExhausted, "presence watcher fell behind")
+		case <-ended:
+			return status.Error(codes.Unauthenticated, errSessionClosed.Error())
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func toApiPresence(st presence.Status) *api.PresenceEvent {
+	result := &api.PresenceEvent{
+		UserId:       st.UserId,
+		TypingRoomId: st.TypingRoomId,
+	}
+	switch st.State {
+	case presence.Online:
+		result.State = api.PresenceState_ONLINE
+	case presence.Away:
+		result.State = api.PresenceState_AWAY
+	default:
+		result.State = api.PresenceState_OFFLINE
+	}
+	if !st.UpdatedAt.IsZero() {
+		result.Ts = timestamppb.New(st.UpdatedAt)
+	}
+	return result
+}
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/room"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) CreateRoom(ctx context.Context, request *api.CreateRoomRequest) (*api.CreateRoomResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	created, err := s.rooms.Create(request.Name, userId, s.callerName(ctx))
+	if errors.Is(err, room.ErrNameTaken) {
+		return &api.CreateRoomResponse{
+			Status: api.CreateRoomResponse_NAME_TAKEN,
+		}, nil
+	}
+	if err != nil {
+		return nil, roomError(err)
+	}
+	return &api.CreateRoomResponse{
+		Status: api.CreateRoomResponse_SUCCESS,
+		Room:   toApiRoom(created),
+	}, nil
+}
+
+func (s *Server) JoinRoom(ctx context.Context, request *api.JoinRoomRequest) (*api.JoinRoomResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	joined, err := s.rooms.Join(request.RoomId, userId, s.callerName(ctx))
+	if err != nil {
+		return nil, roomError(err)
+	}
+	return &api.JoinRoomResponse{
+		Room: toApiRoom(joined),
+	}, nil
+}
+
+func (s *Server) LeaveRoom(ctx context.Context, request *api.LeaveRoomRequest) (*api.LeaveRoomResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rooms.Leave(request.RoomId, userId, s.callerName(ctx)); err != nil {
+		return nil, roomError(err)
+	}
+	return &api.LeaveRoomResponse{}, nil
+}
+
+func (s *Server) SetRoomRetention(ctx context.Context, request *api.SetRoomRetentionRequest) (*api.SetRoomRetentionResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.rooms.Get(request.RoomId)
+	if err != nil {
+		return nil, roomError(err)
+	}
+	if !strings.EqualFold(r.OwnerName, s.callerName(ctx)) {
+		return nil, status.Errorf(codes.PermissionDenied, "room %d belongs to another user", request.RoomId)
+	}
+	changed, err := s.rooms.SetRetention(request.RoomId, time.Duration(request.RetentionSeconds)*time.Second)
+	if err != nil {
+		return nil, roomError(err)
+	}
+	log.Printf("User %d set the retention of room %d to %s", userId, changed.Id, changed.Retention)
+	return &api.SetRoomRetentionResponse{
+		Room: toApiRoom(changed),
+	}, nil
+}
+
+func (s *Server) ListRooms(ctx context.Context, request *api.ListRoomsRequest) (*api.ListRoomsResponse, error) {
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+	rooms := s.rooms.List()
+	result := &api.ListRoomsResponse{
+		Rooms: make([]*api.Room, 0, len(rooms)),
+	}
+	for _, r := range rooms {
+		result.Rooms = append(result.Rooms, toApiRoom(r))
+	}
+	return result, nil
+}
+
+func toApiRoom(r room.Room) *api.Room {
+	return &api.Room{
+		Id:               r.Id,
+		Name:             r.Name,
+		MemberCount:      r.MemberCount,
+		OwnerId:          r.OwnerId,
+		RetentionSeconds: int32(r.Retention / time.Second),
+	}
+}
+
+func roomError(err error) error {
+	switch {
+	case errors.Is(err, room.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, room.ErrNotMember):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, room.ErrInvalidName), errors.Is(err, room.ErrRetention):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
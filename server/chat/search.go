@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"context"
+	"errors"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) SearchMessages(ctx context.Context, request *api.SearchMessagesRequest) (*api.SearchMessagesResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rooms := s.rooms.MemberOf(userId)
+	if request.RoomId != 0 {
+		if !rooms[request.RoomId] {
+			return nil, status.Errorf(codes.PermissionDenied, "room %d: %s", request.RoomId, room.ErrNotMember)
+		}
+		rooms = map[int32]bool{request.RoomId: true}
+	}
+	query := search.Query{
+		Clauses: search.ParseQuery(request.Query),
+		RoomIds: rooms,
+		UserId:  request.UserId,
+		Cursor:  request.Cursor,
+		Limit:   int(request.Limit),
+	}
+	if request.From != nil {
+		query.From = request.From.AsTime()
+	}
+	if request.To != nil {
+		query.To = request.To.AsTime()
+	}
+
+	page, err := s.search.Search(query)
+	if errors.Is(err, search.ErrEmptyQuery) || errors.Is(err, search.ErrInvalidCursor) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "search failed: %s", err)
+	}
+
+	result := &api.SearchMessagesResponse{
+		Results:    make([]*api.SearchResult, 0, len(page.Results)),
+		NextCursor: page.Next,
+	}
+	messages := make([]history.Message, 0, len(page.Results))
+	for _, r := range page.Results {
+		messages = append(messages, r.Message)
+	}
+	messages = s.readBy(ctx, s.callerName(ctx), messages)
+	for i, r := range page.Results {
+		highlights := make([]*api.Highlight, 0, len(r.Highlights))
+		for _, h := range r.Highlights {
+			highlights = append(highlights, &api.Highlight{
+				Offset: int32(h.Offset),
+				Length: int32(h.Length),
+			})
+		}
+		result.Results = append(result.Results, &api.SearchResult{
+			Message:    toApiMessage(messages[i]),
+			Highlights: highlights,
+		})
+	}
+	return result, nil
+}
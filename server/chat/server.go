@@ -0,0 +1,604 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/block"
+	"github.com/iyarkov2/chat/server/cluster"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/inbox"
+	"github.com/iyarkov2/chat/server/metrics"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/purge"
+	"github.com/iyarkov2/chat/server/ratelimit"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"github.com/iyarkov2/chat/server/thread"
+	"github.com/iyarkov2/chat/server/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Config struct {
+	Users       *user.Registry
+	Hub         *hub.Hub
+	Rooms       *room.Registry
+	Messages    history.MessageStore
+	Signer      *auth.Signer
+	Presence    *presence.Tracker
+	Limiter     *ratelimit.Limiter
+	Filters     *filter.Chain
+	Search      *search.Index
+	Attachments *attachment.Service
+	Metrics     *metrics.Metrics
+	Threads     *thread.Registry
+	Inbox       *inbox.Inbox
+	Sweeper     *purge.Sweeper
+	Blocks      *block.Registry
+	Bans        *user.Bans
+	// Optional, the events are delivered to the local streams only if not set
+	Cluster *cluster.Node
+	// Optional, the ChatAdmin calls are rejected if not set
+	Admins *auth.Admins
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.Users == nil {
+		validation = append(validation, "user registry required")
+	}
+	if config.Hub == nil {
+		validation = append(validation, "hub required")
+	}
+	if config.Rooms == nil {
+		validation = append(validation, "room registry required")
+	}
+	if config.Messages == nil {
+		validation = append(validation, "message store required")
+	}
+	if config.Signer == nil {
+		validation = append(validation, "token signer required")
+	}
+	if config.Presence == nil {
+		validation = append(validation, "presence tracker required")
+	}
+	if config.Limiter == nil {
+		validation = append(validation, "rate limiter required")
+	}
+	if config.Filters == nil {
+		validation = append(validation, "filter chain required")
+	}
+	if config.Search == nil {
+		validation = append(validation, "search index required")
+	}
+	if config.Attachments == nil {
+		validation = append(validation, "attachment service required")
+	}
+	if config.Metrics == nil {
+		validation = append(validation, "metrics required")
+	}
+	if config.Threads == nil {
+		validation = append(validation, "thread registry required")
+	}
+	if config.Inbox == nil {
+		validation = append(validation, "inbox required")
+	}
+	if config.Sweeper == nil {
+		validation = append(validation, "sweeper required")
+	}
+	if config.Blocks == nil {
+		validation = append(validation, "block registry required")
+	}
+	if config.Bans == nil {
+		validation = append(validation, "bans required")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+var (
+	errSessionClosed = errors.New("session closed, call Connect again")
+	// The session was ended with ChatAdmin.KickSession or BanUser
+	errKicked = errors.New("session ended by an operator")
+)
+
+type Server struct {
+	api.UnimplementedChatServiceServer
+
+	users       *user.Registry
+	hub         *hub.Hub
+	rooms       *room.Registry
+	messages    history.MessageStore
+	signer      *auth.Signer
+	presence    *presence.Tracker
+	limiter     *ratelimit.Limiter
+	filters     *filter.Chain
+	search      *search.Index
+	attachments *attachment.Service
+	cluster     *cluster.Node
+	metrics     *metrics.Metrics
+	threads     *thread.Registry
+	inbox       *inbox.Inbox
+	blocks      *block.Registry
+	bans        *user.Bans
+	admins      *auth.Admins
+	sessions    *sessions
+}
+
+func NewServer(config Config) (*Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		users:       config.Users,
+		hub:         config.Hub,
+		rooms:       config.Rooms,
+		messages:    config.Messages,
+		signer:      config.Signer,
+		presence:    config.Presence,
+		limiter:     config.Limiter,
+		filters:     config.Filters,
+		search:      config.Search,
+		attachments: config.Attachments,
+		cluster:     config.Cluster,
+		metrics:     config.Metrics,
+		threads:     config.Threads,
+		inbox:       config.Inbox,
+		blocks:      config.Blocks,
+		bans:        config.Bans,
+		admins:      config.Admins,
+	}
+	s.sessions = newSessions(s.disconnect)
+	if err := s.metrics.RegisterQueue("hub", s.hub.Queued, s.hub.Dropped); err != nil {
+		return nil, err
+	}
+	go s.broadcastRemoved(config.Sweeper.Removed())
+	if s.cluster != nil {
+		if err := s.metrics.RegisterQueue("cluster", s.cluster.Queued, s.cluster.Dropped); err != nil {
+			return nil, err
+		}
+		if err := s.cluster.Start(s.deliverLocal); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ServerOptions returns the options the gRPC server must be created with
+func (s *Server) ServerOptions() []grpc.ServerOption {
+	authConfig := auth.Config{
+		Signer: s.signer,
+		Public: map[string]bool{
+			"/iyarkov2.chat.api.ChatService/Connect": true,
+		},
+		Validate: s.validateSession,
+	}
+	// Admin calls carry the admin credentials instead of a session token
+	adminService := api.ChatAdmin_ServiceDesc.ServiceName
+	for _, method := range api.ChatAdmin_ServiceDesc.Methods {
+		authConfig.Public["/"+adminService+"/"+method.MethodName] = true
+	}
+	for _, stream := range api.ChatAdmin_ServiceDesc.Streams {
+		authConfig.Public["/"+adminService+"/"+stream.StreamName] = true
+	}
+	return []grpc.ServerOption{
+		grpc.StatsHandler(statsHandler{sessions: s.sessions}),
+		grpc.ChainUnaryInterceptor(
+			auth.AdminUnaryServerInterceptor(adminService, s.admins),
+			auth.UnaryServerInterceptor(authConfig)),
+		grpc.ChainStreamInterceptor(
+			auth.AdminStreamServerInterceptor(adminService, s.admins),
+			auth.StreamServerInterceptor(authConfig)),
+	}
+}
+
+// validateSession rejects tokens of the users that are no longer connected
+func (s *Server) validateSession(ctx context.Context, claims auth.Claims) error {
+	u, err := s.users.Get(ctx, claims.UserId)
+	if err != nil || u.Name != claims.Name {
+		return errSessionClosed
+	}
+	return nil
+}
+
+// caller returns the authenticated user id
+func (s *Server) caller(ctx context.Context) (int32, error) {
+	claims, ok := auth.UserFromContext(ctx)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "not authenticated")
+	}
+	return claims.UserId, nil
+}
+
+// callerName returns the name of the authenticated user, unlike the user id it stays the same when the user reconnects
+func (s *Server) callerName(ctx context.Context) string {
+	claims, _ := auth.UserFromContext(ctx)
+	return claims.Name
+}
+
+func (s *Server) Connect(ctx context.Context, request *api.ConnectRequest) (*api.ConnectResponse, error) {
+	log.Printf("Received request [%v]\n", request)
+	name := request.Name
+	// With mutual TLS the user is the one named in the client certificate
+	if identity, ok := auth.PeerIdentity(ctx); ok {
+		if name == "" {
+			name = identity
+		}
+		if name != identity {
+			return nil, status.Errorf(codes.PermissionDenied, "name does not match the client certificate %s", identity)
+		}
+	}
+	if until, ok := s.bans.Until(name, time.Now()); ok {
+		return nil, status.Errorf(codes.PermissionDenied, "banned until %s", until.Format(time.RFC3339))
+	}
+	u, err := s.users.Connect(ctx, name)
+	if errors.Is(err, user.ErrNameTaken) {
+		return &api.ConnectResponse{
+			Status: api.ConnectResponse_NAME_TAKEN,
+		}, nil
+	}
+	if errors.Is(err, user.ErrInvalidName) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "connect failed: %s", err)
+	}
+	s.metrics.UserConnected()
+
+	token, err := s.signer.Issue(u.Id, u.Name)
+	if err != nil {
+		s.disconnect(ctx, u.Id)
+		return nil, status.Errorf(codes.Internal, "failed to issue a token: %s", err)
+	}
+	if !s.sessions.add(ctx, u) {
+		// Should never happen, the stats handler is not installed
+		s.disconnect(ctx, u.Id)
+		return nil, status.Error(codes.Internal, "connection is not tracked")
+	}
+	s.presence.Connected(u.Id)
+	log.Printf("User %d [%s] connected", u.Id, u.Name)
+	return &api.ConnectResponse{
+		Status: api.ConnectResponse_SUCCESS,
+		UserId: u.Id,
+		Token:  token,
+	}, nil
+}
+
+func (s *Server) disconnect(ctx context.Context, userId int32) {
+	// The room watchers are filtered on membership, they see the user offline before it leaves the rooms
+	s.presence.Disconnected(userId)
+	s.rooms.LeaveAll(userId)
+	err := s.users.Disconnect(ctx, userId)
+	if err != nil && !errors.Is(err, user.ErrNotFound) {
+		log.Printf("Failed to disconnect user %d: %s", userId, err)
+		return
+	}
+	if err == nil {
+		s.metrics.UserDisconnected()
+	}
+	log.Printf("User %d disconnected", userId)
+}
+
+func (s *Server) Post(stream api.ChatService_PostServer) error {
+	userId, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	subscriber := s.hub.Subscribe(userId)
+	defer s.hub.Unsubscribe(subscriber)
+	s.presence.StreamOpened(userId)
+	defer s.presence.StreamClosed(userId)
+	s.metrics.StreamOpened()
+	defer s.metrics.StreamClosed()
+
+	// The subscription buffers live messages while the missed ones are sent
+	if err := s.replay(stream, userId); err != nil {
+		return err
+	}
+
+	// Stream.Send must not be called concurrently, receiving is done in a separate goroutine
+	received := make(chan *api.PostRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case received <- in:
+			case <-subscriber.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case in := <-received:
+			// A post to a foreign room is rejected alone, the other posts of the stream may be in flight
+			members, err := s.rooms.Members(in.RoomId)
+			if err == nil && !members[userId] {
+				err = room.ErrNotMember
+			}
+			if err != nil {
+				if err := s.reject(stream, userId, in, fmt.Errorf("room %d: %w", in.RoomId, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			if ok, wait := s.limiter.Allow(s.callerName(stream.Context()), in.RoomId); !ok {
+				if s.limiter.Policy() == ratelimit.Reject {
+					log.Printf("User %d disconnected over the rate limit", userId)
+					return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %s", wait)
+				}
+				if err := stream.Send(&api.PostResponse{
+					Event:        api.PostResponse_THROTTLED,
+					UserId:       userId,
+					RoomId:       in.RoomId,
+					ClientId:     in.ClientId,
+					RetryAfterMs: int32(wait / time.Millisecond),
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			if in.TtlSeconds < 0 || (in.ExpireAfterRead && in.TtlSeconds == 0) {
+				if err := s.reject(stream, userId, in, errors.New("ttl must not be negative, expire after read requires ttl")); err != nil {
+					return err
+				}
+				continue
+			}
+			var root history.Message
+			if in.ParentId != 0 {
+				if root, err = s.threadRoot(stream.Context(), in.RoomId, in.ParentId); err != nil {
+					if err := s.reject(stream, userId, in, err); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			text, err := s.moderate(stream.Context(), userId, in.RoomId, in.Text)
+			var rejected *filter.RejectedError
+			if errors.As(err, &rejected) {
+				if err := s.reject(stream, userId, in, rejected); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := s.attachments.Authorize(stream.Context(), s.callerName(stream.Context()), in.AttachmentIds); err != nil {
+				if err := s.reject(stream, userId, in, err); err != nil {
+					return err
+				}
+				continue
+			}
+			msg, duplicate, err := s.store(stream.Context(), userId, in, root.Id, text)
+			if err != nil {
+				log.Printf("Failed to store a message: %s", err)
+				return status.Error(codes.Internal, "failed to store a message")
+			}
+			// The other members read the message as it is delivered
+			if !duplicate && msg.ReadTtl > 0 && s.hasReaders(msg, root, members) {
+				msg = s.readBy(stream.Context(), "", []history.Message{msg})[0]
+			}
+			ack := toApiMessage(msg)
+			ack.ClientId = in.ClientId
+			if err := stream.Send(ack); err != nil {
+				return err
+			}
+			if duplicate {
+				log.Printf("Duplicate post %d from user %d, message %d", in.ClientId, userId, msg.Id)
+				continue
+			}
+			s.attachments.Attach(in.RoomId, msg.AttachmentIds)
+			s.presence.Posted(userId, in.RoomId)
+			s.metrics.Posted(in.RoomId)
+			s.search.Add(msg)
+			s.notifyMentions(msg)
+			if msg.ParentId != 0 {
+				s.deliverReply(stream.Context(), subscriber, msg, root, members)
+				continue
+			}
+			s.deliver(subscriber, toApiMessage(msg), members)
+		case msg := <-subscriber.Messages():
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-subscriber.Done():
+			if errors.Is(subscriber.Err(), hub.ErrSlowConsumer) {
+				log.Printf("User %d disconnected as a slow consumer", userId)
+				return status.Error(codes.ResourceExhausted, subscriber.Err().Error())
+			}
+			if errors.Is(subscriber.Err(), errKicked) {
+				return status.Error(codes.Unauthenticated, subscriber.Err().Error())
+			}
+			return nil
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// deliver publishes the event to the Post streams of the recipients except the sender stream, on this node and on
+// the other nodes of the cluster. Sender may be nil
+func (s *Server) deliver(sender *hub.Subscriber, event *api.PostResponse, recipients map[int32]bool) {
+	s.screen(event, recipients, func(event *api.PostResponse, recipients map[int32]bool) {
+		s.hub.Publish(sender, event, func(recipient *hub.Subscriber) bool {
+			return recipients[recipient.UserId]
+		})
+		if s.cluster != nil {
+			s.cluster.Publish(event, s.clusterRecipients(event.RoomId, recipients))
+		}
+	})
+}
+
+// clusterRecipients names the room and the recipients of an event for the other nodes, the ids are local
+func (s *Server) clusterRecipients(roomId int32, recipients map[int32]bool) cluster.Recipients {
+	ctx := context.Background()
+	result := cluster.Recipients{
+		Users: make(map[string]bool, len(recipients)),
+	}
+	if roomId != 0 {
+		if r, err := s.rooms.Get(roomId); err == nil {
+			result.Room = r.Name
+		}
+	}
+	for userId, ok := range recipients {
+		if !ok {
+			continue
+		}
+		if u, err := s.users.Get(ctx, userId); err == nil {
+			result.Users[strings.ToLower(u.Name)] = true
+		}
+	}
+	return result
+}
+
+// deliverLocal publishes the event of another node to the Post streams of this node. The recipients are the local
+// users with the given names, of the local room with the given name for the events of a room. The room and the author
+// ids of the event are replaced with the local ones, the sequence number of the other node is dropped
+func (s *Server) deliverLocal(event *api.PostResponse, named cluster.Recipients) {
+	ctx := context.Background()
+	event.Seq = 0
+	event.UserId = 0
+	if event.UserName != "" {
+		if author, err := s.users.FindByName(ctx, event.UserName); err == nil {
+			event.UserId = author.Id
+		}
+	}
+	var candidates []user.User
+	if event.RoomId != 0 {
+		r, err := s.rooms.FindByName(named.Room)
+		if err != nil {
+			return
+		}
+		event.RoomId = r.Id
+		members, err := s.rooms.Members(r.Id)
+		if err != nil {
+			return
+		}
+		for memberId := range members {
+			if u, err := s.users.Get(ctx, memberId); err == nil {
+				candidates = append(candidates, u)
+			}
+		}
+	} else {
+		users, err := s.users.List(ctx)
+		if err != nil {
+			log.Printf("Failed to list users: %s", err)
+			return
+		}
+		candidates = users
+	}
+	recipients := make(map[int32]bool)
+	for _, u := range candidates {
+		if named.Users[strings.ToLower(u.Name)] {
+			recipients[u.Id] = true
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	s.screen(event, recipients, func(event *api.PostResponse, recipients map[int32]bool) {
+		s.hub.Publish(nil, event, func(recipient *hub.Subscriber) bool {
+			return recipients[recipient.UserId]
+		})
+	})
+}
+
+// screen passes the event to the recipients who did not block its author. The ones who did receive a HIDDEN
+// placeholder of a posted root message and nothing else
+func (s *Server) screen(event *api.PostResponse, recipients map[int32]bool, publish func(event *api.PostResponse, recipients map[int32]bool)) {
+	blockers := s.blocks.Blockers(event.UserName)
+	if len(blockers) == 0 {
+		publish(event, recipients)
+		return
+	}
+	visible := make(map[int32]bool, len(recipients))
+	hiddenFrom := make(map[int32]bool)
+	for userId := range recipients {
+		if u, err := s.users.Get(context.Background(), userId); err == nil && blockers[strings.ToLower(u.Name)] {
+			hiddenFrom[userId] = true
+		} else {
+			visible[userId] = true
+		}
+	}
+	if len(hiddenFrom) > 0 && event.Event == api.PostResponse_POSTED && event.Seq != 0 {
+		publish(hidden(event), hiddenFrom)
+	}
+	publish(event, visible)
+}
+
+// moderate runs the filter chain, returns the text to post or filter.RejectedError
+func (s *Server) moderate(ctx context.Context, userId int32, roomId int32, text string) (string, error) {
+	r, err := s.rooms.Get(roomId)
+	if err != nil {
+		return "", roomError(err)
+	}
+	return s.filters.Apply(ctx, filter.Post{
+		UserId:   userId,
+		RoomId:   roomId,
+		RoomName: r.Name,
+		Text:     text,
+	})
+}
+
+// reject answers the post with a REJECTED notice
+func (s *Server) reject(stream api.ChatService_PostServer, userId int32, in *api.PostRequest, reason error) error {
+	log.Printf("Post %d from user %d not delivered: %s", in.ClientId, userId, reason)
+	return stream.Send(&api.PostResponse{
+		Event:    api.PostResponse_REJECTED,
+		UserId:   userId,
+		RoomId:   in.RoomId,
+		ClientId: in.ClientId,
+		Reason:   reason.Error(),
+	})
+}
+
+// store saves the posted message with the moderated text, parentId is the thread root of a reply. Requests with
+// client id are deduplicated on (user name, client id), the user id changes when the client reconnects. A duplicate
+// keeps the expiration time of the original
+func (s *Server) store(ctx context.Context, userId int32, in *api.PostRequest, parentId int32, text string) (history.Message, bool, error) {
+	msg := history.Message{
+		RoomId:        in.RoomId,
+		UserId:        userId,
+		UserName:      s.callerName(ctx),
+		Text:          text,
+		AttachmentIds: in.AttachmentIds,
+		ParentId:      parentId,
+	}
+	ttl := time.Duration(in.TtlSeconds) * time.Second
+	switch {
+	case ttl > 0 && in.ExpireAfterRead:
+		msg.ReadTtl = ttl
+	case ttl > 0:
+		msg.ExpiresAt = time.Now().Add(ttl)
+	}
+	if in.ClientId == 0 {
+		stored, err := s.messages.Insert(ctx, msg)
+		return stored, false, err
+	}
+	requestId := fmt.Sprintf("post:%s:%d", strings.ToLower(s.callerName(ctx)), in.ClientId)
+	return s.messages.InsertOnce(ctx, requestId, msg)
+}
@@ -0,0 +1,1462 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/block"
+	"github.com/iyarkov2/chat/server/cluster"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/inbox"
+	"github.com/iyarkov2/chat/server/metrics"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/purge"
+	"github.com/iyarkov2/chat/server/ratelimit"
+	"github.com/iyarkov2/chat/server/resume"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"github.com/iyarkov2/chat/server/thread"
+	"github.com/iyarkov2/chat/server/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testEnv struct {
+	server   *Server
+	listener *bufconn.Listener
+	grpc     *grpc.Server
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return newCustomTestEnv(t, func(config *Config) {})
+}
+
+// newCustomTestEnv lets the test change the default configuration
+func newCustomTestEnv(t *testing.T, customize func(config *Config)) *testEnv {
+	users, err := user.NewRegistry(user.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	h, err := hub.New(hub.Config{BufferSize: 16, Policy: hub.Drop})
+	if err != nil {
+		t.Fatalf("failed to create hub: %s", err)
+	}
+	signer, err := auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create signer: %s", err)
+	}
+	tracker, err := presence.NewTracker(presence.Config{
+		Timeout:       time.Minute,
+		TypingTimeout: time.Minute,
+		SweepInterval: time.Second,
+		BufferSize:    16,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracker: %s", err)
+	}
+	t.Cleanup(tracker.Close)
+	limiter, err := ratelimit.New(ratelimit.Config{})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %s", err)
+	}
+	blobs, err := attachment.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create blob store: %s", err)
+	}
+	attachments, err := attachment.NewService(blobs, attachment.Config{MaxSize: 1024, ChunkSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create attachment service: %s", err)
+	}
+	notifications, err := inbox.NewInbox(inbox.Config{MaxPerUser: 100, BufferSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create inbox: %s", err)
+	}
+	rooms := room.NewRegistry()
+	messages := history.NewMemoryStore()
+	sweeper, err := purge.NewSweeper(messages, rooms, purge.Config{
+		Interval:  10 * time.Millisecond,
+		BatchSize: 100,
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sweeper: %s", err)
+	}
+	t.Cleanup(sweeper.Close)
+	config := Config{
+		Users:       users,
+		Hub:         h,
+		Rooms:       rooms,
+		Messages:    messages,
+		Signer:      signer,
+		Presence:    tracker,
+		Limiter:     limiter,
+		Filters:     filter.NewChain(),
+		Search:      search.NewIndex(),
+		Attachments: attachments,
+		Metrics:     metrics.New(),
+		Threads:     thread.NewRegistry(),
+		Inbox:       notifications,
+		Sweeper:     sweeper,
+		Blocks:      block.NewRegistry(),
+		Bans:        user.NewBans(),
+	}
+	customize(&config)
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	env := &testEnv{
+		server:   s,
+		listener: bufconn.Listen(1024 * 1024),
+		grpc:     grpc.NewServer(s.ServerOptions()...),
+	}
+	api.RegisterChatServiceServer(env.grpc, s)
+	api.RegisterChatAdminServer(env.grpc, s.AdminServer())
+	go env.grpc.Serve(env.listener)
+	t.Cleanup(env.grpc.Stop)
+	return env
+}
+
+func (env *testEnv) dial(t *testing.T) *grpc.ClientConn {
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return env.listener.Dial()
+		}),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	return conn
+}
+
+func connect(t *testing.T, conn *grpc.ClientConn, name string) *api.ConnectResponse {
+	response, err := api.NewChatServiceClient(conn).Connect(context.Background(), &api.ConnectRequest{Name: name})
+	if err != nil {
+		t.Fatalf("connect failed: %s", err)
+	}
+	return response
+}
+
+func TestConnectNameTaken(t *testing.T) {
+	env := newTestEnv(t)
+	conn := env.dial(t)
+	defer conn.Close()
+
+	first := connect(t, conn, "John")
+	if first.Status != api.ConnectResponse_SUCCESS || first.UserId == 0 {
+		t.Fatalf("expected success, actual %v", first)
+	}
+	second := connect(t, conn, "John")
+	if second.Status != api.ConnectResponse_NAME_TAKEN {
+		t.Errorf("expected NAME_TAKEN, actual %v", second)
+	}
+}
+
+func TestNameReleasedOnConnectionClose(t *testing.T) {
+	env := newTestEnv(t)
+	conn := env.dial(t)
+	if response := connect(t, conn, "John"); response.Status != api.ConnectResponse_SUCCESS {
+		t.Fatalf("expected success, actual %v", response)
+	}
+	conn.Close()
+
+	other := env.dial(t)
+	defer other.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if connect(t, other, "John").Status == api.ConnectResponse_SUCCESS {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("name was not released")
+}
+
+type testUser struct {
+	id     int32
+	ctx    context.Context
+	client api.ChatServiceClient
+	stream api.ChatService_PostClient
+}
+
+// newTestUsers connects the users, every user has its own connection and Post stream
+func (env *testEnv) newTestUsers(t *testing.T, names ...string) []testUser {
+	result := make([]testUser, 0, len(names))
+	for _, name := range names {
+		conn := env.dial(t)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		response := connect(t, conn, name)
+		u := testUser{
+			id:     response.UserId,
+			ctx:    auth.AppendToken(context.Background(), response.Token),
+			client: api.NewChatServiceClient(conn),
+		}
+		stream, err := u.client.Post(u.ctx)
+		if err != nil {
+			t.Fatalf("post failed: %s", err)
+		}
+		u.stream = stream
+		result = append(result, u)
+	}
+	env.waitSubscribers(t, len(names))
+	return result
+}
+
+func createRoom(t *testing.T, owner testUser, name string, members ...testUser) int32 {
+	response, err := owner.client.CreateRoom(owner.ctx, &api.CreateRoomRequest{Name: name})
+	if err != nil || response.Status != api.CreateRoomResponse_SUCCESS {
+		t.Fatalf("create room failed: %v %s", response, err)
+	}
+	for _, member := range members {
+		if _, err := member.client.JoinRoom(member.ctx, &api.JoinRoomRequest{RoomId: response.Room.Id}); err != nil {
+			t.Fatalf("join room failed: %s", err)
+		}
+	}
+	return response.Room.Id
+}
+
+func TestPostFanOut(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	roomId := createRoom(t, users[0], "general", users[1:]...)
+
+	if err := users[0].stream.Send(&api.PostRequest{Text: "hello", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	for _, u := range users[1:] {
+		msg, err := u.stream.Recv()
+		if err != nil {
+			t.Fatalf("recv failed: %s", err)
+		}
+		if msg.Text != "hello" || msg.UserId != users[0].id || msg.Id == 0 || msg.RoomId != roomId {
+			t.Errorf("unexpected message %v", msg)
+		}
+	}
+}
+
+func TestPostRoutedToRoomMembers(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	first := createRoom(t, users[0], "first", users[1])
+	second := createRoom(t, users[0], "second", users[2])
+
+	if err := users[0].stream.Send(&api.PostRequest{Text: "to first", RoomId: first}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if err := users[0].stream.Send(&api.PostRequest{Text: "to second", RoomId: second}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := users[1].stream.Recv(); err != nil || msg.Text != "to first" {
+		t.Errorf("expected [to first], actual %v %v", msg, err)
+	}
+	if msg, err := users[2].stream.Recv(); err != nil || msg.Text != "to second" {
+		t.Errorf("expected [to second], actual %v %v", msg, err)
+	}
+}
+
+func TestPostAcknowledgedAndDeduplicated(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "general", users[1])
+
+	// The retry reuses the client id
+	for i := 0; i < 2; i++ {
+		if err := users[0].stream.Send(&api.PostRequest{ClientId: 7, Text: "hello", RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+	first, err := users[0].stream.Recv()
+	if err != nil || first.ClientId != 7 || first.Id == 0 {
+		t.Fatalf("unexpected acknowledgement %v %v", first, err)
+	}
+	second, err := users[0].stream.Recv()
+	if err != nil || second.ClientId != 7 || second.Id != first.Id {
+		t.Fatalf("retry expected to be acknowledged with id %d, actual %v %v", first.Id, second, err)
+	}
+
+	if err := users[0].stream.Send(&api.PostRequest{ClientId: 8, Text: "bye", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	for _, expected := range []string{"hello", "bye"} {
+		if msg, err := users[1].stream.Recv(); err != nil || msg.Text != expected {
+			t.Errorf("expected [%s], actual %v %v", expected, msg, err)
+		}
+	}
+}
+
+func TestPostDeduplicatedAfterReconnect(t *testing.T) {
+	env := newTestEnv(t)
+	jane := env.newTestUsers(t, "Jane")[0]
+	roomId := createRoom(t, jane, "general")
+
+	// post opens a new session of John and posts the message with the client id, returns the context of the session
+	post := func(conn *grpc.ClientConn, clientId int32, text string) (*api.PostResponse, context.Context) {
+		response := connect(t, conn, "John")
+		if response.Status != api.ConnectResponse_SUCCESS {
+			t.Fatalf("expected success, actual %v", response)
+		}
+		client := api.NewChatServiceClient(conn)
+		ctx := auth.AppendToken(context.Background(), response.Token)
+		if _, err := client.JoinRoom(ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+			t.Fatalf("join room failed: %s", err)
+		}
+		stream, err := client.Post(ctx)
+		if err != nil {
+			t.Fatalf("post failed: %s", err)
+		}
+		if err := stream.Send(&api.PostRequest{ClientId: clientId, Text: text, RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		ack, err := stream.Recv()
+		if err != nil || ack.ClientId != clientId || ack.Id == 0 {
+			t.Fatalf("unexpected acknowledgement %v %v", ack, err)
+		}
+		return ack, ctx
+	}
+
+	conn := env.dial(t)
+	first, _ := post(conn, 7, "hello")
+	conn.Close()
+
+	// The retry comes from a new session after the name is released
+	other := env.dial(t)
+	defer other.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := env.server.users.FindByName(context.Background(), "John"); errors.Is(err, user.ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("name was not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	retry, ctx := post(other, 7, "hello")
+	if retry.Id != first.Id {
+		t.Errorf("retry expected to be acknowledged with id %d, actual %v", first.Id, retry)
+	}
+	// The author of the earlier session
+	edit := &api.EditMessageRequest{MessageId: first.Id, Text: "hello again"}
+	if _, err := api.NewChatServiceClient(other).EditMessage(ctx, edit); err != nil {
+		t.Errorf("edit failed: %s", err)
+	}
+}
+
+func TestPostResumed(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "general", users[1])
+
+	for i, text := range []string{"first", "second", "third"} {
+		if err := users[0].stream.Send(&api.PostRequest{Text: text, RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if ack, err := users[0].stream.Recv(); err != nil || ack.Seq != int32(i+1) {
+			t.Fatalf("expected seq %d, actual %v %v", i+1, ack, err)
+		}
+	}
+	if msg, err := users[1].stream.Recv(); err != nil || msg.Seq != 1 {
+		t.Fatalf("expected seq 1, actual %v %v", msg, err)
+	}
+
+	// Jane saw the first message only
+	stream, err := users[1].client.Post(resume.AppendPositions(users[1].ctx, resume.Positions{roomId: 1}))
+	if err != nil {
+		t.Fatalf("post failed: %s", err)
+	}
+	for _, expected := range []string{"second", "third"} {
+		if msg, err := stream.Recv(); err != nil || msg.Text != expected {
+			t.Fatalf("expected [%s], actual %v %v", expected, msg, err)
+		}
+	}
+	if err := users[0].stream.Send(&api.PostRequest{Text: "fourth", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := stream.Recv(); err != nil || msg.Text != "fourth" || msg.Seq != 4 {
+		t.Errorf("expected live [fourth], actual %v %v", msg, err)
+	}
+
+	for value, code := range map[string]codes.Code{
+		"garbage": codes.InvalidArgument,
+		"12345:0": codes.PermissionDenied,
+	} {
+		ctx := metadata.AppendToOutgoingContext(users[1].ctx, resume.Header, value)
+		stream, err := users[1].client.Post(ctx)
+		if err != nil {
+			t.Fatalf("post failed: %s", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != code {
+			t.Errorf("[%s] expected %s, actual %v", value, code, err)
+		}
+	}
+}
+
+func TestPostToForeignRoom(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "private")
+
+	for i, id := range []int32{roomId, 12345} {
+		if err := users[1].stream.Send(&api.PostRequest{Text: "hello", RoomId: id, ClientId: int32(i + 1)}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if msg, err := users[1].stream.Recv(); err != nil || msg.Event != api.PostResponse_REJECTED || msg.ClientId != int32(i+1) {
+			t.Errorf("expected REJECTED, actual %v %v", msg, err)
+		}
+	}
+
+	// The stream stays open
+	own := createRoom(t, users[1], "own")
+	if err := users[1].stream.Send(&api.PostRequest{Text: "hello", RoomId: own, ClientId: 3}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := users[1].stream.Recv(); err != nil || msg.Event != api.PostResponse_POSTED || msg.ClientId != 3 {
+		t.Errorf("expected the ack, actual %v %v", msg, err)
+	}
+}
+
+func TestCreateRoomNameTaken(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John")
+	createRoom(t, users[0], "general")
+	response, err := users[0].client.CreateRoom(users[0].ctx, &api.CreateRoomRequest{Name: "General"})
+	if err != nil || response.Status != api.CreateRoomResponse_NAME_TAKEN {
+		t.Errorf("expected NAME_TAKEN, actual %v %v", response, err)
+	}
+	list, err := users[0].client.ListRooms(users[0].ctx, &api.ListRoomsRequest{})
+	if err != nil || len(list.Rooms) != 1 || list.Rooms[0].MemberCount != 1 {
+		t.Errorf("expected a single room, actual %v %v", list, err)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "general")
+	for _, text := range []string{"one", "two", "three"} {
+		if err := users[0].stream.Send(&api.PostRequest{Text: text, RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+
+	// Not a member yet
+	request := &api.GetHistoryRequest{RoomId: roomId, Limit: 2}
+	if _, err := users[1].client.GetHistory(users[1].ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+
+	// A new member sees the earlier conversation
+	if _, err := users[1].client.JoinRoom(users[1].ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("join room failed: %s", err)
+	}
+	var latest *api.GetHistoryResponse
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		response, err := users[1].client.GetHistory(users[1].ctx, request)
+		if err != nil {
+			t.Fatalf("get history failed: %s", err)
+		}
+		if len(response.Messages) == 2 && response.Messages[1].Text == "three" {
+			latest = response
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if latest == nil || latest.Messages[0].Text != "two" || latest.PrevCursor == "" {
+		t.Fatalf("unexpected latest page %v", latest)
+	}
+
+	older, err := users[1].client.GetHistory(users[1].ctx, &api.GetHistoryRequest{
+		RoomId: roomId,
+		Cursor: latest.PrevCursor,
+		Limit:  2,
+	})
+	if err != nil {
+		t.Fatalf("get history failed: %s", err)
+	}
+	if len(older.Messages) != 1 || older.Messages[0].Text != "one" || older.PrevCursor != "" {
+		t.Errorf("unexpected older page %v", older)
+	}
+}
+
+func TestEditAndDeleteMessage(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	roomId := createRoom(t, users[0], "general", users[1:]...)
+
+	if err := users[1].stream.Send(&api.PostRequest{ClientId: 1, Text: "helo", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	ack, err := users[1].stream.Recv()
+	if err != nil {
+		t.Fatalf("recv failed: %s", err)
+	}
+	if msg, err := users[0].stream.Recv(); err != nil || msg.Event != api.PostResponse_POSTED {
+		t.Fatalf("expected the posted message, actual %v %v", msg, err)
+	}
+
+	// Neither the author nor the room owner
+	edit := &api.EditMessageRequest{MessageId: ack.Id, Text: "hello"}
+	if _, err := users[2].client.EditMessage(users[2].ctx, edit); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+	if _, err := users[1].client.EditMessage(users[1].ctx, edit); err != nil {
+		t.Fatalf("edit failed: %s", err)
+	}
+	for _, u := range users[:2] {
+		msg, err := u.stream.Recv()
+		if err != nil || msg.Event != api.PostResponse_EDITED || msg.Text != "hello" || msg.EditedAt == nil {
+			t.Errorf("expected EDITED event, actual %v %v", msg, err)
+		}
+	}
+
+	// The room owner moderates
+	if _, err := users[0].client.DeleteMessage(users[0].ctx, &api.DeleteMessageRequest{MessageId: ack.Id}); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+	msg, err := users[1].stream.Recv()
+	if err != nil || msg.Event != api.PostResponse_DELETED || !msg.Deleted || msg.Text != "" {
+		t.Errorf("expected DELETED event, actual %v %v", msg, err)
+	}
+	if _, err := users[1].client.EditMessage(users[1].ctx, edit); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, actual %v", err)
+	}
+
+	response, err := users[2].client.GetHistory(users[2].ctx, &api.GetHistoryRequest{RoomId: roomId})
+	if err != nil || len(response.Messages) != 1 || !response.Messages[0].Deleted {
+		t.Errorf("expected a tombstone, actual %v %v", response, err)
+	}
+}
+
+func newTestLimiter(t *testing.T, policy ratelimit.Policy) *ratelimit.Limiter {
+	limiter, err := ratelimit.New(ratelimit.Config{
+		User:   ratelimit.Limit{Rate: 0.001, Burst: 1},
+		Policy: policy,
+	})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %s", err)
+	}
+	return limiter
+}
+
+func TestPostThrottled(t *testing.T) {
+	env := newCustomTestEnv(t, func(config *Config) {
+		config.Limiter = newTestLimiter(t, ratelimit.Throttle)
+	})
+	users := env.newTestUsers(t, "John")
+	roomId := createRoom(t, users[0], "general")
+
+	for clientId := int32(1); clientId <= 2; clientId++ {
+		if err := users[0].stream.Send(&api.PostRequest{ClientId: clientId, Text: "hello", RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+	if ack, err := users[0].stream.Recv(); err != nil || ack.ClientId != 1 || ack.Event != api.PostResponse_POSTED {
+		t.Errorf("expected acknowledgement, actual %v %v", ack, err)
+	}
+	notice, err := users[0].stream.Recv()
+	if err != nil || notice.ClientId != 2 || notice.Event != api.PostResponse_THROTTLED || notice.RetryAfterMs <= 0 {
+		t.Errorf("expected throttle notice, actual %v %v", notice, err)
+	}
+}
+
+func TestPostRejectedOverLimit(t *testing.T) {
+	env := newCustomTestEnv(t, func(config *Config) {
+		config.Limiter = newTestLimiter(t, ratelimit.Reject)
+	})
+	users := env.newTestUsers(t, "John")
+	roomId := createRoom(t, users[0], "general")
+
+	for i := 0; i < 2; i++ {
+		if err := users[0].stream.Send(&api.PostRequest{Text: "hello", RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+	if _, err := users[0].stream.Recv(); err != nil {
+		t.Errorf("expected acknowledgement, actual %v", err)
+	}
+	if _, err := users[0].stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted, actual %v", err)
+	}
+}
+
+func TestPostModerated(t *testing.T) {
+	env := newCustomTestEnv(t, func(config *Config) {
+		config.Filters = filter.NewChain(filter.LinkBlocker(), filter.ProfanityMask([]string{"darn"}))
+	})
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "general", users[1])
+
+	if err := users[0].stream.Send(&api.PostRequest{ClientId: 1, Text: "see www.example.com", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	notice, err := users[0].stream.Recv()
+	if err != nil || notice.ClientId != 1 || notice.Event != api.PostResponse_REJECTED || notice.Reason == "" {
+		t.Errorf("expected rejection, actual %v %v", notice, err)
+	}
+
+	if err := users[0].stream.Send(&api.PostRequest{ClientId: 2, Text: "darn", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if ack, err := users[0].stream.Recv(); err != nil || ack.ClientId != 2 || ack.Text != "****" {
+		t.Errorf("expected masked acknowledgement, actual %v %v", ack, err)
+	}
+	// The rejected post was not delivered
+	if msg, err := users[1].stream.Recv(); err != nil || msg.Text != "****" {
+		t.Errorf("expected masked message, actual %v %v", msg, err)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	john, jane, jack := users[0], users[1], users[2]
+	roomId := createRoom(t, john, "general", jane, jack)
+	other := createRoom(t, jane, "other")
+
+	if err := john.stream.Send(&api.PostRequest{Text: "root", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	root, err := john.stream.Recv()
+	if err != nil {
+		t.Fatalf("recv failed: %s", err)
+	}
+	for _, u := range []testUser{jane, jack} {
+		if msg, err := u.stream.Recv(); err != nil || msg.Id != root.Id {
+			t.Fatalf("expected the root message, actual %v %v", msg, err)
+		}
+	}
+
+	// reply posts the reply and expects the acknowledgement followed by the new reply count
+	reply := func(u testUser, parentId int32, text string, replies int32) {
+		if err := u.stream.Send(&api.PostRequest{Text: text, RoomId: roomId, ParentId: parentId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if ack, err := u.stream.Recv(); err != nil || ack.ParentId != root.Id || ack.Seq != 0 {
+			t.Fatalf("expected the acknowledgement, actual %v %v", ack, err)
+		}
+		if update, err := u.stream.Recv(); err != nil || update.Event != api.PostResponse_THREAD_UPDATED || update.ReplyCount != replies {
+			t.Fatalf("expected %d replies, actual %v %v", replies, update, err)
+		}
+	}
+	// expect reads the reply if the user follows the thread and the new reply count
+	expect := func(u testUser, text string, replies int32) {
+		if text != "" {
+			if msg, err := u.stream.Recv(); err != nil || msg.Text != text || msg.ParentId != root.Id {
+				t.Errorf("expected reply [%s], actual %v %v", text, msg, err)
+			}
+		}
+		if update, err := u.stream.Recv(); err != nil || update.Event != api.PostResponse_THREAD_UPDATED || update.ReplyCount != replies {
+			t.Errorf("expected %d replies, actual %v %v", replies, update, err)
+		}
+	}
+
+	// John follows his message, Jack does not
+	reply(jane, root.Id, "first reply", 1)
+	expect(john, "first reply", 1)
+	expect(jack, "", 1)
+
+	if _, err := jack.client.FollowThread(jack.ctx, &api.FollowThreadRequest{MessageId: root.Id, Follow: true}); err != nil {
+		t.Fatalf("follow failed: %s", err)
+	}
+	if _, err := john.client.FollowThread(john.ctx, &api.FollowThreadRequest{MessageId: root.Id}); err != nil {
+		t.Fatalf("unfollow failed: %s", err)
+	}
+	thread, err := jane.client.GetThread(jane.ctx, &api.GetThreadRequest{MessageId: root.Id})
+	if err != nil || len(thread.Replies) != 1 {
+		t.Fatalf("expected a single reply, actual %v %v", thread, err)
+	}
+	// A reply to the reply joins the thread
+	reply(jane, thread.Replies[0].Id, "second reply", 2)
+	expect(jack, "second reply", 2)
+	expect(john, "", 2)
+
+	thread, err = jack.client.GetThread(jack.ctx, &api.GetThreadRequest{MessageId: root.Id, Limit: 1})
+	if err != nil || thread.Root.ReplyCount != 2 || len(thread.Replies) != 1 || !thread.HasMore {
+		t.Fatalf("unexpected first page %v %v", thread, err)
+	}
+	thread, err = jack.client.GetThread(jack.ctx, &api.GetThreadRequest{MessageId: root.Id, AfterId: thread.Replies[0].Id})
+	if err != nil || len(thread.Replies) != 1 || thread.Replies[0].Text != "second reply" || thread.HasMore {
+		t.Errorf("unexpected second page %v %v", thread, err)
+	}
+
+	// Replies stay out of the room history
+	history, err := jack.client.GetHistory(jack.ctx, &api.GetHistoryRequest{RoomId: roomId})
+	if err != nil || len(history.Messages) != 1 || history.Messages[0].ReplyCount != 2 {
+		t.Errorf("expected the root message only, actual %v %v", history, err)
+	}
+
+	if err := jane.stream.Send(&api.PostRequest{ClientId: 5, Text: "wrong room", RoomId: other, ParentId: root.Id}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := jane.stream.Recv(); err != nil || msg.Event != api.PostResponse_REJECTED || msg.ClientId != 5 {
+		t.Errorf("expected REJECTED, actual %v %v", msg, err)
+	}
+	jill := env.newTestUsers(t, "Jill")[0]
+	if _, err := jill.client.GetThread(jill.ctx, &api.GetThreadRequest{MessageId: root.Id}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jill")
+	john, jane, jill := users[0], users[1], users[2]
+	roomId := createRoom(t, john, "general", jane)
+
+	ctx, cancel := context.WithCancel(jane.ctx)
+	defer cancel()
+	watch, err := jane.client.WatchNotifications(ctx, &api.WatchNotificationsRequest{})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for env.server.inbox.Watchers() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Jill is not a member of the room and John is the author, only Jane is notified
+	for _, text := range []string{"hi @jane, @Jill and @John", "@Jane again", "mail jane@example.com"} {
+		if err := john.stream.Send(&api.PostRequest{Text: text, RoomId: roomId}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if _, err := john.stream.Recv(); err != nil {
+			t.Fatalf("recv failed: %s", err)
+		}
+		if _, err := jane.stream.Recv(); err != nil {
+			t.Fatalf("recv failed: %s", err)
+		}
+	}
+	for _, text := range []string{"hi @jane, @Jill and @John", "@Jane again"} {
+		n, err := watch.Recv()
+		if err != nil || n.Kind != api.Notification_MENTION || n.Text != text || n.AuthorId != john.id || n.RoomId != roomId {
+			t.Fatalf("expected mention [%s], actual %v %v", text, n, err)
+		}
+	}
+
+	list, err := jane.client.ListNotifications(jane.ctx, &api.ListNotificationsRequest{Limit: 1})
+	if err != nil || len(list.Notifications) != 1 || list.Notifications[0].Text != "@Jane again" || !list.HasMore || list.UnreadCount != 2 {
+		t.Fatalf("unexpected first page %v %v", list, err)
+	}
+	read, err := jane.client.MarkRead(jane.ctx, &api.MarkReadRequest{NotificationIds: []int32{list.Notifications[0].Id}})
+	if err != nil || read.UnreadCount != 1 {
+		t.Errorf("expected a single unread notification, actual %v %v", read, err)
+	}
+	list, err = jane.client.ListNotifications(jane.ctx, &api.ListNotificationsRequest{UnreadOnly: true})
+	if err != nil || len(list.Notifications) != 1 || list.Notifications[0].Read || list.HasMore {
+		t.Errorf("unexpected unread notifications %v %v", list, err)
+	}
+	if read, err := jane.client.MarkRead(jane.ctx, &api.MarkReadRequest{}); err != nil || read.UnreadCount != 0 {
+		t.Errorf("expected all notifications read, actual %v %v", read, err)
+	}
+	if list, err := jill.client.ListNotifications(jill.ctx, &api.ListNotificationsRequest{}); err != nil || len(list.Notifications) != 0 {
+		t.Errorf("expected no notifications for a non member, actual %v %v", list, err)
+	}
+}
+
+func TestExpireAfterRead(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	john, jane := users[0], users[1]
+	roomId := createRoom(t, john, "general")
+
+	if err := john.stream.Send(&api.PostRequest{Text: "no ttl", RoomId: roomId, ExpireAfterRead: true}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := john.stream.Recv(); err != nil || msg.Event != api.PostResponse_REJECTED {
+		t.Fatalf("expected REJECTED, actual %v %v", msg, err)
+	}
+	// Nobody else is in the room, the clock does not start
+	if err := john.stream.Send(&api.PostRequest{Text: "unread", RoomId: roomId, TtlSeconds: 60, ExpireAfterRead: true}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := john.stream.Recv(); err != nil || msg.ExpiresAt != nil {
+		t.Fatalf("expected no expiration time, actual %v %v", msg, err)
+	}
+	if history, err := john.client.GetHistory(john.ctx, &api.GetHistoryRequest{RoomId: roomId}); err != nil || history.Messages[0].ExpiresAt != nil {
+		t.Fatalf("expected the author not to start the clock, actual %v %v", history, err)
+	}
+
+	if _, err := jane.client.JoinRoom(jane.ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("join room failed: %s", err)
+	}
+	history, err := jane.client.GetHistory(jane.ctx, &api.GetHistoryRequest{RoomId: roomId})
+	if err != nil || history.Messages[0].ExpiresAt == nil {
+		t.Fatalf("expected the clock started by the first read, actual %v %v", history, err)
+	}
+	expiresAt := history.Messages[0].ExpiresAt.AsTime()
+	if time.Until(expiresAt) > time.Minute || time.Until(expiresAt) < 50*time.Second {
+		t.Errorf("unexpected expiration time %s", expiresAt)
+	}
+
+	// Delivered live to Jane
+	if err := john.stream.Send(&api.PostRequest{Text: "live", RoomId: roomId, TtlSeconds: 60, ExpireAfterRead: true}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := john.stream.Recv(); err != nil || msg.ExpiresAt == nil {
+		t.Errorf("expected the expiration time in the ack, actual %v %v", msg, err)
+	}
+	if msg, err := jane.stream.Recv(); err != nil || msg.Text != "live" || msg.ExpiresAt == nil {
+		t.Errorf("expected the expiration time, actual %v %v", msg, err)
+	}
+}
+
+func TestMentionsKeptAcrossSessions(t *testing.T) {
+	env := newTestEnv(t)
+	john := env.newTestUsers(t, "John")[0]
+	roomId := createRoom(t, john, "general")
+	conn := env.dial(t)
+	response := connect(t, conn, "Jane")
+	ctx := auth.AppendToken(context.Background(), response.Token)
+	if _, err := api.NewChatServiceClient(conn).JoinRoom(ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("join room failed: %s", err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := env.server.users.FindByName(context.Background(), "Jane"); err != nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Jane is away but did not leave the room
+	if err := john.stream.Send(&api.PostRequest{Text: "@jane are you there?", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if _, err := john.stream.Recv(); err != nil {
+		t.Fatalf("recv failed: %s", err)
+	}
+
+	jane := env.newTestUsers(t, "Jane")[0]
+	for time.Now().Before(deadline) {
+		list, err := jane.client.ListNotifications(jane.ctx, &api.ListNotificationsRequest{})
+		if err != nil {
+			t.Fatalf("list failed: %s", err)
+		}
+		if len(list.Notifications) == 1 && list.Notifications[0].Text == "@jane are you there?" && list.UnreadCount == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("expected the mention kept for the next session of Jane")
+}
+
+func TestExpiredMessages(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	john, jane := users[0], users[1]
+	roomId := createRoom(t, john, "general", jane)
+
+	if err := john.stream.Send(&api.PostRequest{ClientId: 1, Text: "ephemeral", RoomId: roomId, TtlSeconds: -1}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := john.stream.Recv(); err != nil || msg.Event != api.PostResponse_REJECTED {
+		t.Fatalf("expected REJECTED, actual %v %v", msg, err)
+	}
+	posts := []*api.PostRequest{
+		{Text: "old", RoomId: roomId},
+		{Text: "ephemeral", RoomId: roomId, TtlSeconds: 1},
+	}
+	for _, post := range posts {
+		if err := john.stream.Send(post); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if _, err := john.stream.Recv(); err != nil {
+			t.Fatalf("recv failed: %s", err)
+		}
+		msg, err := jane.stream.Recv()
+		if err != nil || msg.Text != post.Text || (msg.ExpiresAt != nil) != (post.TtlSeconds > 0) {
+			t.Fatalf("unexpected message %v %v", msg, err)
+		}
+	}
+
+	request := &api.SetRoomRetentionRequest{RoomId: roomId, RetentionSeconds: 1}
+	if _, err := jane.client.SetRoomRetention(jane.ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+	invalid := &api.SetRoomRetentionRequest{RoomId: roomId, RetentionSeconds: -1}
+	if _, err := john.client.SetRoomRetention(john.ctx, invalid); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, actual %v", err)
+	}
+	response, err := john.client.SetRoomRetention(john.ctx, request)
+	if err != nil || response.Room.RetentionSeconds != 1 {
+		t.Fatalf("unexpected response %v %v", response, err)
+	}
+
+	// The ephemeral message expires, the old one falls out of the retention
+	removed := make(map[int32]bool)
+	for i := 0; i < len(posts); i++ {
+		msg, err := jane.stream.Recv()
+		if err != nil || msg.Event != api.PostResponse_EXPIRED || !msg.Deleted || msg.Text != "" {
+			t.Fatalf("expected EXPIRED, actual %v %v", msg, err)
+		}
+		removed[msg.Id] = true
+	}
+	if len(removed) != len(posts) {
+		t.Errorf("expected %d removed messages, actual %v", len(posts), removed)
+	}
+	history, err := jane.client.GetHistory(jane.ctx, &api.GetHistoryRequest{RoomId: roomId})
+	if err != nil || len(history.Messages) != 0 {
+		t.Errorf("expected empty history, actual %v %v", history, err)
+	}
+}
+
+func TestBlockAndMute(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	john, jane, jack := users[0], users[1], users[2]
+	roomId := createRoom(t, john, "general", jane, jack)
+
+	if _, err := jane.client.BlockUser(jane.ctx, &api.BlockUserRequest{UserId: jane.id}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, actual %v", err)
+	}
+	if _, err := jane.client.BlockUser(jane.ctx, &api.BlockUserRequest{UserId: 12345}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, actual %v", err)
+	}
+	if _, err := jane.client.BlockUser(jane.ctx, &api.BlockUserRequest{UserId: jack.id}); err != nil {
+		t.Fatalf("block failed: %s", err)
+	}
+	if _, err := john.client.MuteRoom(john.ctx, &api.MuteRoomRequest{RoomId: roomId, Mute: true}); err != nil {
+		t.Fatalf("mute failed: %s", err)
+	}
+
+	// Jane sees a placeholder, John sees the message. Neither is notified
+	if err := jack.stream.Send(&api.PostRequest{Text: "hi @Jane and @John", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	ack, err := jack.stream.Recv()
+	if err != nil {
+		t.Fatalf("recv failed: %s", err)
+	}
+	if msg, err := john.stream.Recv(); err != nil || msg.Event != api.PostResponse_POSTED || msg.Id != ack.Id {
+		t.Errorf("expected the message, actual %v %v", msg, err)
+	}
+	msg, err := jane.stream.Recv()
+	if err != nil || msg.Event != api.PostResponse_HIDDEN || msg.Seq != ack.Seq || msg.RoomId != roomId || msg.Id != 0 || msg.Text != "" || msg.UserId != 0 {
+		t.Errorf("expected HIDDEN placeholder, actual %v %v", msg, err)
+	}
+	for _, u := range []testUser{john, jane} {
+		if list, err := u.client.ListNotifications(u.ctx, &api.ListNotificationsRequest{}); err != nil || len(list.Notifications) != 0 {
+			t.Errorf("expected no notifications, actual %v %v", list, err)
+		}
+	}
+
+	// Presence of Jack does not reach Jane
+	ctx, cancel := context.WithCancel(jane.ctx)
+	defer cancel()
+	watch, err := jane.client.WatchPresence(ctx, &api.WatchPresenceRequest{RoomId: roomId})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if event, err := watch.Recv(); err != nil || event.UserId == jack.id {
+			t.Fatalf("expected John and Jane, actual %v %v", event, err)
+		}
+	}
+	for _, u := range []testUser{jack, john} {
+		if _, err := u.client.Heartbeat(u.ctx, &api.HeartbeatRequest{State: api.PresenceState_AWAY}); err != nil {
+			t.Fatalf("heartbeat failed: %s", err)
+		}
+	}
+	if event, err := watch.Recv(); err != nil || event.UserId != john.id {
+		t.Errorf("expected John away, actual %v %v", event, err)
+	}
+
+	if _, err := jane.client.UnblockUser(jane.ctx, &api.UnblockUserRequest{UserId: jack.id}); err != nil {
+		t.Fatalf("unblock failed: %s", err)
+	}
+	if err := jack.stream.Send(&api.PostRequest{Text: "again @Jane", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := jane.stream.Recv(); err != nil || msg.Event != api.PostResponse_POSTED || msg.Text != "again @Jane" {
+		t.Errorf("expected the message, actual %v %v", msg, err)
+	}
+	if list, err := jane.client.ListNotifications(jane.ctx, &api.ListNotificationsRequest{}); err != nil || len(list.Notifications) != 1 {
+		t.Errorf("expected a notification, actual %v %v", list, err)
+	}
+
+	// Blocked by name before connecting, the block holds for the next session of Jill
+	if _, err := jane.client.BlockUser(jane.ctx, &api.BlockUserRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, actual %v", err)
+	}
+	if _, err := jane.client.BlockUser(jane.ctx, &api.BlockUserRequest{UserName: "jill"}); err != nil {
+		t.Fatalf("block failed: %s", err)
+	}
+	jill := env.newTestUsers(t, "Jill")[0]
+	if _, err := jill.client.JoinRoom(jill.ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("join room failed: %s", err)
+	}
+	if err := jill.stream.Send(&api.PostRequest{Text: "hello", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := jane.stream.Recv(); err != nil || msg.Event != api.PostResponse_HIDDEN {
+		t.Errorf("expected HIDDEN placeholder, actual %v %v", msg, err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	const token = "fedcba9876543210fedcba9876543210"
+	admins, err := auth.NewAdmins(token, nil)
+	if err != nil {
+		t.Fatalf("failed to create admins: %s", err)
+	}
+	env := newCustomTestEnv(t, func(config *Config) {
+		config.Admins = admins
+	})
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	john, jane, jack := users[0], users[1], users[2]
+	conn := env.dial(t)
+	defer conn.Close()
+	admin := api.NewChatAdminClient(conn)
+	ctx := auth.AppendToken(context.Background(), token)
+
+	if _, err := admin.ListSessions(context.Background(), &api.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if _, err := admin.ListSessions(john.ctx, &api.ListSessionsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+	list, err := admin.ListSessions(ctx, &api.ListSessionsRequest{})
+	if err != nil || len(list.Sessions) != 3 {
+		t.Fatalf("expected 3 sessions, actual %v %v", list, err)
+	}
+	for i, name := range []string{"John", "Jane", "Jack"} {
+		if session := list.Sessions[i]; session.Name != name || session.UserId != users[i].id || session.PeerAddress == "" || session.ConnectedAt == nil {
+			t.Errorf("unexpected session of %s: %v", name, session)
+		}
+	}
+
+	response, err := admin.BroadcastSystemMessage(ctx, &api.BroadcastSystemMessageRequest{Text: "maintenance at noon"})
+	if err != nil || response.Recipients != 3 {
+		t.Fatalf("expected 3 recipients, actual %v %v", response, err)
+	}
+	for _, u := range users {
+		if msg, err := u.stream.Recv(); err != nil || msg.Event != api.PostResponse_SYSTEM || msg.Text != "maintenance at noon" {
+			t.Errorf("expected the system message, actual %v %v", msg, err)
+		}
+	}
+
+	if _, err := admin.KickSession(ctx, &api.KickSessionRequest{UserId: 12345}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, actual %v", err)
+	}
+	roomId := createRoom(t, jane, "general")
+	presence, err := jane.client.WatchPresence(jane.ctx, &api.WatchPresenceRequest{RoomId: roomId})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	if _, err := presence.Recv(); err != nil {
+		t.Fatalf("expected snapshot, actual %s", err)
+	}
+	notifications, err := jane.client.WatchNotifications(jane.ctx, &api.WatchNotificationsRequest{})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	if _, err := admin.KickSession(ctx, &api.KickSessionRequest{UserId: jane.id, Reason: "spam"}); err != nil {
+		t.Fatalf("kick failed: %s", err)
+	}
+	if _, err := jane.stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if _, err := presence.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the presence stream ended, actual %v", err)
+	}
+	if _, err := notifications.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the notification stream ended, actual %v", err)
+	}
+	if _, err := jane.client.ListRooms(jane.ctx, &api.ListRoomsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the token rejected, actual %v", err)
+	}
+
+	if _, err := admin.BanUser(ctx, &api.BanUserRequest{Name: "Jack"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, actual %v", err)
+	}
+	ban, err := admin.BanUser(ctx, &api.BanUserRequest{Name: "Jack", DurationSeconds: 3600})
+	if err != nil || !ban.Kicked || ban.ExpiresAt == nil {
+		t.Fatalf("expected Jack kicked, actual %v %v", ban, err)
+	}
+	if _, err := jack.stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, actual %v", err)
+	}
+	if _, err := api.NewChatServiceClient(conn).Connect(context.Background(), &api.ConnectRequest{Name: "jack"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+	if list, err := admin.ListSessions(ctx, &api.ListSessionsRequest{}); err != nil || len(list.Sessions) != 1 || list.Sessions[0].UserId != john.id {
+		t.Errorf("expected John only, actual %v %v", list, err)
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	general := createRoom(t, users[0], "general", users[1])
+	private := createRoom(t, users[0], "private")
+
+	for _, post := range []*api.PostRequest{
+		{Text: "the brown fox", RoomId: private},
+		{Text: "Hello, brown fox", RoomId: general},
+	} {
+		if err := users[0].stream.Send(post); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+	}
+	// Delivered messages are indexed
+	if msg, err := users[1].stream.Recv(); err != nil || msg.RoomId != general {
+		t.Fatalf("unexpected message %v %v", msg, err)
+	}
+
+	response, err := users[1].client.SearchMessages(users[1].ctx, &api.SearchMessagesRequest{Query: `"brown fox"`})
+	if err != nil {
+		t.Fatalf("search failed: %s", err)
+	}
+	if len(response.Results) != 1 || response.Results[0].Message.RoomId != general {
+		t.Fatalf("expected the message of the general room, actual %v", response)
+	}
+	if h := response.Results[0].Highlights; len(h) != 1 || h[0].Offset != 7 || h[0].Length != 9 {
+		t.Errorf("unexpected highlights %v", h)
+	}
+
+	request := &api.SearchMessagesRequest{Query: "fox", RoomId: private}
+	if _, err := users[1].client.SearchMessages(users[1].ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v", err)
+	}
+}
+
+func TestPostAcrossNodes(t *testing.T) {
+	broker := cluster.NewMemoryBroker(16)
+	users, err := user.NewRegistry(user.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	rooms := room.NewRegistry()
+	messages := history.NewMemoryStore()
+	threads := thread.NewRegistry()
+	newNode := func(id string) *testEnv {
+		node, err := cluster.NewNode(cluster.Config{NodeId: id, Transport: broker.Transport(), BufferSize: 16, DedupSize: 16})
+		if err != nil {
+			t.Fatalf("failed to create node: %s", err)
+		}
+		t.Cleanup(node.Close)
+		// The nodes share the users, the rooms, the history and the thread followers
+		return newCustomTestEnv(t, func(config *Config) {
+			config.Users = users
+			config.Rooms = rooms
+			config.Messages = messages
+			config.Threads = threads
+			config.Cluster = node
+		})
+	}
+	first := newNode("first").newTestUsers(t, "John", "Jack")
+	second := newNode("second").newTestUsers(t, "Jane")
+	roomId := createRoom(t, first[0], "general", first[1], second[0])
+
+	if err := first[0].stream.Send(&api.PostRequest{Text: "hello", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	for _, u := range []testUser{first[0], first[1], second[0]} {
+		if msg, err := u.stream.Recv(); err != nil || msg.Text != "hello" {
+			t.Errorf("expected [hello], actual %v %v", msg, err)
+		}
+	}
+	if _, err := first[0].client.DeleteMessage(first[0].ctx, &api.DeleteMessageRequest{MessageId: 1}); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+	// Delivered once, the node of the author does not deliver its own events again
+	for _, u := range []testUser{first[0], first[1], second[0]} {
+		if msg, err := u.stream.Recv(); err != nil || msg.Event != api.PostResponse_DELETED {
+			t.Errorf("expected DELETED, actual %v %v", msg, err)
+		}
+	}
+}
+
+func TestPostAcrossNodesWithOwnRegistries(t *testing.T) {
+	broker := cluster.NewMemoryBroker(16)
+	newNode := func(id string) *testEnv {
+		node, err := cluster.NewNode(cluster.Config{NodeId: id, Transport: broker.Transport(), BufferSize: 16, DedupSize: 16})
+		if err != nil {
+			t.Fatalf("failed to create node: %s", err)
+		}
+		t.Cleanup(node.Close)
+		return newCustomTestEnv(t, func(config *Config) {
+			config.Cluster = node
+		})
+	}
+	// The user ids of the nodes overlap, the room ids do not: the room of the second node takes the id of the first
+	first := newNode("first").newTestUsers(t, "John", "Jack")
+	second := newNode("second").newTestUsers(t, "Joe", "Jack", "Jane")
+	roomId := createRoom(t, first[0], "secret", first[1])
+	generalId := createRoom(t, second[2], "general", second[0])
+	otherId := createRoom(t, second[1], "secret")
+	if generalId != roomId {
+		t.Fatalf("expected room %d, actual %d", roomId, generalId)
+	}
+
+	if err := first[0].stream.Send(&api.PostRequest{Text: "hello", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	// Jack is a member of the room with the same name on both nodes, Joe has the id of the first Jack
+	if msg, err := first[1].stream.Recv(); err != nil || msg.Text != "hello" {
+		t.Errorf("expected [hello], actual %v %v", msg, err)
+	}
+	// The room and the author are the ones of the second node, John is not connected there
+	if msg, err := second[1].stream.Recv(); err != nil || msg.Text != "hello" || msg.RoomId != otherId || msg.UserId != 0 || msg.UserName != "John" || msg.Seq != 0 {
+		t.Errorf("expected [hello] in room %d, actual %v %v", otherId, msg, err)
+	}
+	if err := first[1].stream.Send(&api.PostRequest{Text: "hey", RoomId: roomId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := second[1].stream.Recv(); err != nil || msg.Text != "hey" || msg.UserId != second[1].id {
+		t.Errorf("expected [hey] of the local Jack, actual %v %v", msg, err)
+	}
+	if err := second[2].stream.Send(&api.PostRequest{Text: "hi", RoomId: generalId}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if msg, err := second[0].stream.Recv(); err != nil || msg.Text != "hi" {
+		t.Errorf("expected [hi], actual %v %v", msg, err)
+	}
+}
+
+// upload sends the content in chunks of 10 bytes, returns the attachment
+func upload(t *testing.T, u testUser, info *api.Attachment, content []byte) (*api.Attachment, error) {
+	stream, err := u.client.UploadAttachment(u.ctx)
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if err := stream.Send(&api.UploadAttachmentRequest{Content: &api.UploadAttachmentRequest_Info{Info: info}}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	for len(content) > 0 {
+		n := 10
+		if n > len(content) {
+			n = len(content)
+		}
+		if err := stream.Send(&api.UploadAttachmentRequest{Content: &api.UploadAttachmentRequest_Chunk{Chunk: content[:n]}}); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		content = content[n:]
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	return response.Attachment, nil
+}
+
+// download returns the attachment info and content
+func download(u testUser, id string) (*api.Attachment, []byte, error) {
+	stream, err := u.client.DownloadAttachment(u.ctx, &api.DownloadAttachmentRequest{AttachmentId: id})
+	if err != nil {
+		return nil, nil, err
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return nil, nil, err
+	}
+	content := make([]byte, 0)
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return first.GetInfo(), content, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		content = append(content, in.GetChunk()...)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane", "Jack")
+	roomId := createRoom(t, users[0], "general", users[1])
+	content := []byte("<html><body>Hello, attachments</body></html>")
+	checksum := sha256.Sum256(content)
+
+	if _, err := upload(t, users[0], &api.Attachment{Name: "page.html", Sha256: "00"}, content); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument on checksum mismatch, actual %v", err)
+	}
+	if _, err := upload(t, users[0], &api.Attachment{Name: "big"}, make([]byte, 1025)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument over the size limit, actual %v", err)
+	}
+	uploaded, err := upload(t, users[0], &api.Attachment{
+		Name:   "page.html",
+		Size:   int64(len(content)),
+		Sha256: hex.EncodeToString(checksum[:]),
+	}, content)
+	if err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	if uploaded.Id == "" || uploaded.ContentType != "text/html; charset=utf-8" || uploaded.Size != int64(len(content)) {
+		t.Errorf("unexpected attachment %v", uploaded)
+	}
+
+	// Posted by another user
+	if err := users[1].stream.Send(&api.PostRequest{ClientId: 1, RoomId: roomId, AttachmentIds: []string{uploaded.Id}}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if notice, err := users[1].stream.Recv(); err != nil || notice.Event != api.PostResponse_REJECTED {
+		t.Errorf("expected rejection, actual %v %v", notice, err)
+	}
+	if _, _, err := download(users[1], uploaded.Id); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound before the attachment is posted, actual %v", err)
+	}
+
+	if err := users[0].stream.Send(&api.PostRequest{Text: "see", RoomId: roomId, AttachmentIds: []string{uploaded.Id}}); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	msg, err := users[1].stream.Recv()
+	if err != nil || len(msg.AttachmentIds) != 1 || msg.AttachmentIds[0] != uploaded.Id {
+		t.Fatalf("expected message with the attachment, actual %v %v", msg, err)
+	}
+	info, downloaded, err := download(users[1], uploaded.Id)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if !bytes.Equal(downloaded, content) || info.Sha256 != uploaded.Sha256 {
+		t.Errorf("unexpected download %v %s", info, downloaded)
+	}
+	if _, _, err := download(users[2], uploaded.Id); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a non-member, actual %v", err)
+	}
+}
+
+func TestWatchPresence(t *testing.T) {
+	env := newTestEnv(t)
+	users := env.newTestUsers(t, "John", "Jane")
+	roomId := createRoom(t, users[0], "general", users[1])
+
+	ctx, cancel := context.WithCancel(users[0].ctx)
+	defer cancel()
+	watch, err := users[0].client.WatchPresence(ctx, &api.WatchPresenceRequest{RoomId: roomId})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	// Snapshot of both members
+	for i := 0; i < 2; i++ {
+		event, err := watch.Recv()
+		if err != nil || event.State != api.PresenceState_ONLINE {
+			t.Fatalf("expected online member, actual %v %v", event, err)
+		}
+	}
+
+	if _, err := users[1].client.Heartbeat(users[1].ctx, &api.HeartbeatRequest{
+		State:        api.PresenceState_AWAY,
+		TypingRoomId: roomId,
+	}); err != nil {
+		t.Fatalf("heartbeat failed: %s", err)
+	}
+	event, err := watch.Recv()
+	if err != nil || event.UserId != users[1].id || event.State != api.PresenceState_AWAY || event.TypingRoomId != roomId {
+		t.Errorf("expected typing away user, actual %v %v", event, err)
+	}
+
+	// The stream ends on the first event after the watcher left the room
+	if _, err := users[0].client.LeaveRoom(users[0].ctx, &api.LeaveRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("leave room failed: %s", err)
+	}
+	if _, err := users[1].client.Heartbeat(users[1].ctx, &api.HeartbeatRequest{State: api.PresenceState_ONLINE}); err != nil {
+		t.Fatalf("heartbeat failed: %s", err)
+	}
+	if event, err := watch.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, actual %v %v", event, err)
+	}
+}
+
+func TestWatchPresenceOfflineOnDisconnect(t *testing.T) {
+	env := newTestEnv(t)
+	john := env.newTestUsers(t, "John")[0]
+	roomId := createRoom(t, john, "general")
+	conn := env.dial(t)
+	defer conn.Close()
+	response := connect(t, conn, "Jane")
+	ctx := auth.AppendToken(context.Background(), response.Token)
+	if _, err := api.NewChatServiceClient(conn).JoinRoom(ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		t.Fatalf("join room failed: %s", err)
+	}
+
+	watchCtx, cancel := context.WithTimeout(john.ctx, 5*time.Second)
+	defer cancel()
+	watch, err := john.client.WatchPresence(watchCtx, &api.WatchPresenceRequest{RoomId: roomId})
+	if err != nil {
+		t.Fatalf("watch failed: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := watch.Recv(); err != nil {
+			t.Fatalf("expected snapshot, actual %s", err)
+		}
+	}
+
+	conn.Close()
+	event, err := watch.Recv()
+	if err != nil || event.UserId != response.UserId || event.State != api.PresenceState_OFFLINE {
+		t.Errorf("expected Jane offline, actual %v %v", event, err)
+	}
+}
+
+func TestPostRequiresToken(t *testing.T) {
+	env := newTestEnv(t)
+	conn := env.dial(t)
+	defer conn.Close()
+	connect(t, conn, "John")
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		auth.AppendToken(context.Background(), "forged"),
+	} {
+		stream, err := api.NewChatServiceClient(conn).Post(ctx)
+		if err != nil {
+			t.Fatalf("post failed: %s", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, actual %v", err)
+		}
+	}
+}
+
+func TestTokenRejectedAfterDisconnect(t *testing.T) {
+	env := newTestEnv(t)
+	conn := env.dial(t)
+	response := connect(t, conn, "John")
+	conn.Close()
+
+	other := env.dial(t)
+	defer other.Close()
+	ctx := auth.AppendToken(context.Background(), response.Token)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := api.NewChatServiceClient(other).ListRooms(ctx, &api.ListRoomsRequest{})
+		if status.Code(err) == codes.Unauthenticated {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("token of a closed session expected to be rejected")
+}
+
+func (env *testEnv) waitSubscribers(t *testing.T, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if env.server.hub.Size() >= count {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers", count)
+}
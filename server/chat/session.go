@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iyarkov2/chat/server/user"
+	"github.com/iyarkov2/chat/server/version"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+)
+
+/*
+	A session lasts as long as the client's transport connection. Every connection gets an id in TagConn, users
+	connected through it are released when the connection ends
+*/
+
+type connKeyType string
+
+const connKey = connKeyType("chat.conn")
+
+type session struct {
+	connId      uint64
+	userId      int32
+	name        string
+	peerAddress string
+	// Sent by the client in the version.Header metadata of Connect
+	apiVersion  string
+	connectedAt time.Time
+	// Closed when the session ends, see sessions.done
+	ended chan struct{}
+}
+
+type sessions struct {
+	mtx     *sync.Mutex
+	lastId  uint64
+	byConn  map[uint64]map[int32]bool
+	byUser  map[int32]session
+	onClose func(ctx context.Context, userId int32)
+}
+
+func newSessions(onClose func(ctx context.Context, userId int32)) *sessions {
+	return &sessions{
+		mtx:     new(sync.Mutex),
+		byConn:  make(map[uint64]map[int32]bool),
+		byUser:  make(map[int32]session),
+		onClose: onClose,
+	}
+}
+
+// add binds the user to the connection the Connect request came from. Returns false if the connection is unknown
+func (s *sessions) add(ctx context.Context, u user.User) bool {
+	connId, ok := connIdFromContext(ctx)
+	if !ok {
+		return false
+	}
+	added := session{
+		connId:      connId,
+		userId:      u.Id,
+		name:        u.Name,
+		connectedAt: u.ConnectedAt,
+		ended:       make(chan struct{}),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		added.peerAddress = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(version.Header); len(values) > 0 {
+			added.apiVersion = values[0]
+		}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	users, ok := s.byConn[connId]
+	if !ok {
+		users = make(map[int32]bool)
+		s.byConn[connId] = users
+	}
+	users[u.Id] = true
+	s.byUser[u.Id] = added
+	return true
+}
+
+// remove unbinds the user from its connection, e.g. when an operator ends the session. Returns false if the user is
+// not connected
+func (s *sessions) remove(userId int32) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	existing, ok := s.byUser[userId]
+	if !ok {
+		return false
+	}
+	delete(s.byUser, userId)
+	delete(s.byConn[existing.connId], userId)
+	close(existing.ended)
+	return true
+}
+
+// done returns a channel that is closed when the session of the user ends. The streams other than Post, which ends
+// with its hub.Subscriber, watch it. The channel is closed already if the user is not connected
+func (s *sessions) done(userId int32) <-chan struct{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if existing, ok := s.byUser[userId]; ok {
+		return existing.ended
+	}
+	ended := make(chan struct{})
+	close(ended)
+	return ended
+}
+
+// list returns the sessions ordered by user id
+func (s *sessions) list() []session {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]session, 0, len(s.byUser))
+	for _, existing := range s.byUser {
+		result = append(result, existing)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].userId < result[j].userId
+	})
+	return result
+}
+
+// close releases all the users bound to the connection
+func (s *sessions) close(ctx context.Context, connId uint64) {
+	s.mtx.Lock()
+	users := s.byConn[connId]
+	delete(s.byConn, connId)
+	for userId := range users {
+		close(s.byUser[userId].ended)
+		delete(s.byUser, userId)
+	}
+	s.mtx.Unlock()
+
+	for userId := range users {
+		s.onClose(ctx, userId)
+	}
+}
+
+func connIdFromContext(ctx context.Context) (uint64, bool) {
+	connId, ok := ctx.Value(connKey).(uint64)
+	return connId, ok
+}
+
+// statsHandler tracks transport connections, see grpc.StatsHandler
+type statsHandler struct {
+	sessions *sessions
+}
+
+func (h statsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	connId := atomic.AddUint64(&h.sessions.lastId, 1)
+	return context.WithValue(ctx, connKey, connId)
+}
+
+func (h statsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnEnd); !ok {
+		return
+	}
+	if connId, ok := connIdFromContext(ctx); ok {
+		log.Printf("Connection %d closed", connId)
+		h.sessions.close(ctx, connId)
+	}
+}
+
+func (h statsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h statsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+}
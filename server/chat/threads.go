@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/room"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) GetThread(ctx context.Context, request *api.GetThreadRequest) (*api.GetThreadResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.memberRoot(ctx, userId, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	limit := int(request.Limit)
+	if limit <= 0 {
+		limit = history.DefaultPageSize
+	}
+	if limit > history.MaxPageSize {
+		limit = history.MaxPageSize
+	}
+
+	// One extra reply tells if there is more to read
+	replies, err := s.messages.Replies(ctx, root.Id, request.AfterId, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read thread: %s", err)
+	}
+	read := s.readBy(ctx, s.callerName(ctx), append([]history.Message{root}, replies...))
+	root, replies = read[0], read[1:]
+	result := &api.GetThreadResponse{
+		Root:    toApiMessage(root),
+		Replies: make([]*api.PostResponse, 0, len(replies)),
+		HasMore: len(replies) > limit,
+	}
+	if result.HasMore {
+		replies = replies[:limit]
+	}
+	for _, reply := range replies {
+		result.Replies = append(result.Replies, toApiMessage(reply))
+	}
+	return result, nil
+}
+
+func (s *Server) FollowThread(ctx context.Context, request *api.FollowThreadRequest) (*api.FollowThreadResponse, error) {
+	userId, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.memberRoot(ctx, userId, request.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	if request.Follow {
+		s.threads.Follow(root.Id, userId)
+	} else {
+		s.threads.Unfollow(root.Id, userId)
+	}
+	log.Printf("User %d follows thread %d: %v", userId, root.Id, request.Follow)
+	return &api.FollowThreadResponse{}, nil
+}
+
+// memberRoot returns the root message of the thread the message belongs to, the caller must be a room member
+func (s *Server) memberRoot(ctx context.Context, userId int32, messageId int32) (history.Message, error) {
+	msg, err := s.messages.Get(ctx, messageId)
+	if err != nil {
+		return history.Message{}, messageError(err)
+	}
+	if !s.rooms.IsMember(msg.RoomId, userId) {
+		return history.Message{}, status.Errorf(codes.PermissionDenied, "room %d: %s", msg.RoomId, room.ErrNotMember)
+	}
+	if msg.ParentId == 0 {
+		return msg, nil
+	}
+	root, err := s.messages.Get(ctx, msg.ParentId)
+	if err != nil {
+		return history.Message{}, messageError(err)
+	}
+	return root, nil
+}
+
+// threadRoot returns the root message a post to the room replies to, a reply to a reply joins the same thread
+func (s *Server) threadRoot(ctx context.Context, roomId int32, parentId int32) (history.Message, error) {
+	parent, err := s.messages.Get(ctx, parentId)
+	if err != nil {
+		return history.Message{}, fmt.Errorf("reply to message %d: %w", parentId, err)
+	}
+	if parent.RoomId != roomId {
+		return history.Message{}, fmt.Errorf("reply to message %d of another room", parentId)
+	}
+	root := parent
+	if parent.ParentId != 0 {
+		if root, err = s.messages.Get(ctx, parent.ParentId); err != nil {
+			return history.Message{}, fmt.Errorf("reply to message %d: %w", parentId, err)
+		}
+	}
+	if root.Deleted {
+		return history.Message{}, fmt.Errorf("reply to message %d: %w", root.Id, history.ErrDeleted)
+	}
+	return root, nil
+}
+
+// deliverReply sends the reply to the thread followers and the new reply count of the root message to the room
+// members. The root author and the reply author follow the thread unless they unfollowed it
+func (s *Server) deliverReply(ctx context.Context, sender *hub.Subscriber, reply history.Message, root history.Message, members map[int32]bool) {
+	s.threads.Participate(root.Id, root.UserId)
+	s.threads.Participate(root.Id, reply.UserId)
+	s.deliver(sender, toApiMessage(reply), s.followers(root.Id, members))
+
+	updated, err := s.messages.Get(ctx, root.Id)
+	if errors.Is(err, history.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read thread %d: %s", root.Id, err)
+		return
+	}
+	event := toApiMessage(updated)
+	event.Event = api.PostResponse_THREAD_UPDATED
+	s.deliver(nil, event, members)
+}
+
+// hasReaders tells if the new message is delivered live to a member other than the author, the message posted to
+// a thread reaches the thread followers only
+func (s *Server) hasReaders(msg history.Message, root history.Message, members map[int32]bool) bool {
+	recipients := members
+	if msg.ParentId != 0 {
+		recipients = s.followers(root.Id, members)
+		recipients[root.UserId] = members[root.UserId]
+	}
+	for userId, ok := range recipients {
+		if ok && userId != msg.UserId {
+			return true
+		}
+	}
+	return false
+}
+
+// followers returns the followers of the thread who are still room members
+func (s *Server) followers(rootId int32, members map[int32]bool) map[int32]bool {
+	result := make(map[int32]bool)
+	for userId := range s.threads.Followers(rootId) {
+		if members[userId] {
+			result[userId] = true
+		}
+	}
+	return result
+}
@@ -2,13 +2,35 @@ package main
 
 import (
 	"context"
+	"flag"
+	"github.com/iyarkov2/chat/core/tlsconfig"
 	"github.com/iyarkov2/chat/server/api"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
 )
 
+var (
+	address  = flag.String("addr", "localhost:8888", "Chat server address")
+	name     = flag.String("name", "John Smith", "Chat name. With mutual TLS it must match the certificate, empty uses the certificate name")
+	tlsFlags = tlsconfig.RegisterClientFlags(flag.CommandLine)
+)
+
+// transportCredentials returns the credentials of the TLS options, see tlsconfig.RegisterClientFlags
+func transportCredentials() grpc.DialOption {
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalln("Failed to load certificates:", err)
+	}
+	if config == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
 func main() {
-	conn, err := grpc.Dial("localhost:8888", grpc.WithInsecure(), api.WithClientVersion())
+	flag.Parse()
+	conn, err := grpc.Dial(*address, append(api.WithClientVersion(), transportCredentials())...)
 	if err != nil {
 		log.Fatalln("Connection error:", err)
 	}
@@ -17,7 +39,7 @@ func main() {
 	client := api.NewChatServiceClient(conn)
 
 	request := api.ConnectRequest{
-		Name: "John Smith",
+		Name: *name,
 	}
 
 	response, err := client.Connect(context.Background(), &request)
@@ -27,6 +49,3 @@ func main() {
 
 	log.Println("Response: ", response)
 }
-
-
-
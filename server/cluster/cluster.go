@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iyarkov2/chat/server/api"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Fan-out of the Post stream events between the nodes of a cluster. Every node publishes the events it delivered
+	locally and delivers the events published by the other nodes to its local streams. Events are deduplicated by
+	publishing node and message id, transports may deliver an event more than once.
+
+	User and room ids are assigned by every node on its own, they never leave the node. The recipients of an event
+	travel as user names and the room name, the receiving node delivers the event to its own members of the room with
+	those names and rewrites the room and the author ids to its own. Every node keeps its own history: the message,
+	thread and sequence numbers of the event are the ones of the publishing node, the message is delivered live but it
+	is not in the history of the receiving node
+*/
+
+// Transport carries the events between the nodes. Implementations must be safe for concurrent use
+type Transport interface {
+	// Publish delivers the value to every node, including this one. Values with the same key are delivered in order
+	Publish(ctx context.Context, key string, value []byte) error
+
+	// Messages returns the values published by all nodes, the channel is closed when the transport is closed
+	Messages() <-chan []byte
+
+	Close() error
+}
+
+type Config struct {
+	// Unique id of the node
+	NodeId    string
+	Transport Transport
+	// Number of events waiting to be published
+	BufferSize int
+	// Number of recently delivered events remembered to drop the duplicates
+	DedupSize int
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.NodeId == "" {
+		validation = append(validation, "node id required")
+	}
+	if config.Transport == nil {
+		validation = append(validation, "transport required")
+	}
+	if config.BufferSize <= 0 {
+		validation = append(validation, "buffer size must be positive")
+	}
+	if config.DedupSize <= 0 {
+		validation = append(validation, "dedup size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+// Recipients of an event in the terms every node resolves on its own
+type Recipients struct {
+	// Name of the event room, empty for the events outside a room
+	Room string
+	// Lower case user names
+	Users map[string]bool
+}
+
+// Deliver delivers an event published by another node to the local streams of the recipients
+type Deliver func(event *api.PostResponse, recipients Recipients)
+
+type Node struct {
+	// Events dropped because the transport was behind, updated atomically. First to be 64-bit aligned
+	dropped  uint64
+	config   Config
+	outgoing chan outgoing
+
+	mtx *sync.Mutex
+	// Keys of the recently delivered events, see eventKey. Oldest are evicted first
+	seen     map[string]bool
+	order    []string
+	next     int
+	started  bool
+	stop     chan struct{}
+	routines *sync.WaitGroup
+}
+
+type outgoing struct {
+	key   string
+	value []byte
+}
+
+// envelope is the transport value
+type envelope struct {
+	Node       string   `json:"node"`
+	Room       string   `json:"room"`
+	Recipients []string `json:"recipients"`
+	// Binary encoded api.PostResponse
+	Event []byte `json:"event"`
+}
+
+// NewNode creates a node and starts publishing, the node must be released with Close
+func NewNode(config Config) (*Node, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:   config,
+		outgoing: make(chan outgoing, config.BufferSize),
+		mtx:      new(sync.Mutex),
+		seen:     make(map[string]bool, config.DedupSize),
+		order:    make([]string, config.DedupSize),
+		stop:     make(chan struct{}),
+		routines: new(sync.WaitGroup),
+	}
+	n.routines.Add(1)
+	go n.publish()
+	return n, nil
+}
+
+// Start delivers the events published by the other nodes, can be called once
+func (n *Node) Start(deliver Deliver) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.started {
+		return errors.New("node already started")
+	}
+	n.started = true
+	n.routines.Add(1)
+	go n.consume(deliver)
+	return nil
+}
+
+// Close stops the node, the events that were not published yet are lost
+func (n *Node) Close() {
+	close(n.stop)
+	if err := n.config.Transport.Close(); err != nil {
+		log.Printf("Failed to close the cluster transport: %s", err)
+	}
+	n.routines.Wait()
+}
+
+// Publish sends the event delivered locally to the other nodes. Never blocks, the event is dropped if the node falls
+// behind
+func (n *Node) Publish(event *api.PostResponse, recipients Recipients) {
+	encoded, err := proto.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode message %d event: %s", event.Id, err)
+		return
+	}
+	e := envelope{
+		Node:       n.config.NodeId,
+		Room:       recipients.Room,
+		Recipients: make([]string, 0, len(recipients.Users)),
+		Event:      encoded,
+	}
+	for name, ok := range recipients.Users {
+		if ok {
+			e.Recipients = append(e.Recipients, name)
+		}
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode message %d event: %s", event.Id, err)
+		return
+	}
+	// Delivered locally already, the copy coming back from the transport is a duplicate
+	n.firstSeen(eventKey(n.config.NodeId, event))
+	select {
+	case n.outgoing <- outgoing{key: strconv.Itoa(int(event.RoomId)), value: value}:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+		log.Printf("Message %d event dropped, the cluster transport is behind", event.Id)
+	}
+}
+
+// Queued returns the number of events waiting to be published
+func (n *Node) Queued() int {
+	return len(n.outgoing)
+}
+
+// Dropped returns the number of events that were not published
+func (n *Node) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+func (n *Node) publish() {
+	defer n.routines.Done()
+	ctx := context.Background()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case out := <-n.outgoing:
+			if err := n.config.Transport.Publish(ctx, out.key, out.value); err != nil {
+				atomic.AddUint64(&n.dropped, 1)
+				log.Printf("Failed to publish an event to the cluster: %s", err)
+			}
+		}
+	}
+}
+
+func (n *Node) consume(deliver Deliver) {
+	defer n.routines.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case value, ok := <-n.config.Transport.Messages():
+			if !ok {
+				return
+			}
+			var e envelope
+			if err := json.Unmarshal(value, &e); err != nil {
+				log.Printf("Invalid cluster event: %s", err)
+				continue
+			}
+			event := new(api.PostResponse)
+			if err := proto.Unmarshal(e.Event, event); err != nil {
+				log.Printf("Invalid cluster event from node %s: %s", e.Node, err)
+				continue
+			}
+			if !n.firstSeen(eventKey(e.Node, event)) {
+				continue
+			}
+			recipients := Recipients{
+				Room:  e.Room,
+				Users: make(map[string]bool, len(e.Recipients)),
+			}
+			for _, name := range e.Recipients {
+				recipients.Users[name] = true
+			}
+			deliver(event, recipients)
+		}
+	}
+}
+
+// firstSeen remembers the key, returns false if it was already remembered
+func (n *Node) firstSeen(key string) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.seen[key] {
+		return false
+	}
+	if evicted := n.order[n.next]; evicted != "" {
+		delete(n.seen, evicted)
+	}
+	n.order[n.next] = key
+	n.next = (n.next + 1) % len(n.order)
+	n.seen[key] = true
+	return true
+}
+
+// eventKey identifies the event of the message, every edit is a separate event. Message ids are assigned by every
+// node on its own, the key includes the publishing node
+func eventKey(node string, event *api.PostResponse) string {
+	var editedAt int64
+	if event.EditedAt != nil {
+		editedAt = event.EditedAt.AsTime().UnixNano()
+	}
+	return fmt.Sprintf("%s:%d:%d:%d", node, event.Id, event.Event, editedAt)
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+)
+
+type delivery struct {
+	event      *api.PostResponse
+	recipients Recipients
+}
+
+func newTestNode(t *testing.T, broker *MemoryBroker, id string) (*Node, chan delivery) {
+	node, err := NewNode(Config{NodeId: id, Transport: broker.Transport(), BufferSize: 16, DedupSize: 2})
+	if err != nil {
+		t.Fatalf("failed to create node: %s", err)
+	}
+	t.Cleanup(node.Close)
+	delivered := make(chan delivery, 16)
+	if err := node.Start(func(event *api.PostResponse, recipients Recipients) {
+		delivered <- delivery{event: event, recipients: recipients}
+	}); err != nil {
+		t.Fatalf("failed to start node: %s", err)
+	}
+	return node, delivered
+}
+
+func expectNothing(t *testing.T, delivered chan delivery) {
+	select {
+	case d := <-delivered:
+		t.Errorf("unexpected delivery %v", d.event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	broker := NewMemoryBroker(16)
+	a, fromA := newTestNode(t, broker, "a")
+	_, fromB := newTestNode(t, broker, "b")
+
+	a.Publish(&api.PostResponse{Id: 1, Text: "hello", RoomId: 3}, Recipients{Room: "general", Users: map[string]bool{"john": true}})
+	select {
+	case d := <-fromB:
+		if d.event.Id != 1 || d.event.Text != "hello" || d.recipients.Room != "general" || len(d.recipients.Users) != 1 || !d.recipients.Users["john"] {
+			t.Errorf("unexpected delivery %v %v", d.event, d.recipients)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event was not delivered")
+	}
+	// The publisher delivered the event locally
+	expectNothing(t, fromA)
+}
+
+func TestDuplicatesDropped(t *testing.T) {
+	broker := NewMemoryBroker(16)
+	a, _ := newTestNode(t, broker, "a")
+	_, fromB := newTestNode(t, broker, "b")
+
+	event := &api.PostResponse{Id: 1, Text: "hello", RoomId: 3}
+	a.Publish(event, Recipients{})
+	// Redelivered by the transport
+	a.Publish(event, Recipients{})
+	// Another event of the same message
+	a.Publish(&api.PostResponse{Id: 1, Event: api.PostResponse_DELETED, RoomId: 3}, Recipients{})
+
+	for _, expected := range []api.PostResponse_Event{api.PostResponse_POSTED, api.PostResponse_DELETED} {
+		select {
+		case d := <-fromB:
+			if d.event.Event != expected {
+				t.Errorf("expected %s, actual %v", expected, d.event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event was not delivered")
+		}
+	}
+	expectNothing(t, fromB)
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	transport := broker.Transport()
+	other := broker.Transport()
+	if err := other.Close(); err != nil {
+		t.Fatalf("close failed: %s", err)
+	}
+	if _, ok := <-other.Messages(); ok {
+		t.Errorf("expected closed channel")
+	}
+	ctx := context.Background()
+	if err := transport.Publish(ctx, "1", []byte("a")); err != nil {
+		t.Errorf("publish failed: %s", err)
+	}
+	if err := transport.Publish(ctx, "1", []byte("b")); err != ErrBrokerFull {
+		t.Errorf("expected ErrBrokerFull, actual %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/iyarkov2/chat/core/outbox"
+	outboxkafka "github.com/iyarkov2/chat/core/outbox/kafka"
+	"github.com/iyarkov2/chat/server/cluster"
+)
+
+/*
+	Kafka cluster.Transport. Values are published with the outbox Kafka worker, every node reads the topic with its
+	own consumer group and starts from the latest offset, the history covers what was posted before
+*/
+
+type Config struct {
+	BootstrapServers string
+	Topic            string
+	// Must be unique per node, every node receives every value
+	GroupId string
+	// Number of consumed values waiting to be delivered
+	BufferSize int
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.BootstrapServers == "" {
+		validation = append(validation, "bootstrap servers required")
+	}
+	if config.Topic == "" {
+		validation = append(validation, "topic required")
+	}
+	if config.GroupId == "" {
+		validation = append(validation, "group id required")
+	}
+	if config.BufferSize <= 0 {
+		validation = append(validation, "buffer size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+// How long the consumer waits for a message before checking if the transport is closed
+const pollTimeout = 100 * time.Millisecond
+
+// How long Close waits for the outstanding messages to be published
+const flushTimeoutMs = 5000
+
+type transport struct {
+	topic    string
+	worker   outboxkafka.Worker
+	consumer *kafka.Consumer
+	messages chan []byte
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func New(config Config) (cluster.Transport, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	worker, err := outboxkafka.NewProducer(outboxkafka.Config{BootstrapServers: config.BootstrapServers})
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": config.BootstrapServers,
+		"group.id":          config.GroupId,
+		"auto.offset.reset": "latest",
+	})
+	if err != nil {
+		worker.Close(0)
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	if err := consumer.SubscribeTopics([]string{config.Topic}, nil); err != nil {
+		worker.Close(0)
+		consumer.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", config.Topic, err)
+	}
+	t := &transport{
+		topic:     config.Topic,
+		worker:    worker,
+		consumer:  consumer,
+		messages:  make(chan []byte, config.BufferSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	go t.consume()
+	return t, nil
+}
+
+// Publish waits for the delivery report
+func (t *transport) Publish(ctx context.Context, key string, value []byte) error {
+	return t.worker.Do(ctx, outbox.Task{
+		Type: outboxkafka.TaskType,
+		Metadata: &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &t.topic, Partition: kafka.PartitionAny},
+			Key:            []byte(key),
+			Value:          value,
+		},
+	})
+}
+
+func (t *transport) Messages() <-chan []byte {
+	return t.messages
+}
+
+func (t *transport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+		t.worker.Close(flushTimeoutMs)
+		err = t.consumer.Close()
+	})
+	return err
+}
+
+func (t *transport) consume() {
+	defer close(t.done)
+	defer close(t.messages)
+	for {
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		msg, err := t.consumer.ReadMessage(pollTimeout)
+		var kafkaErr kafka.Error
+		if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to consume a cluster event: %s", err)
+			continue
+		}
+		select {
+		case t.messages <- msg.Value:
+		case <-t.stop:
+			return
+		}
+	}
+}
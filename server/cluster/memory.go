@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrBrokerFull = errors.New("transport buffer full")
+
+// MemoryBroker connects the transports of the nodes running in one process, e.g. in tests
+type MemoryBroker struct {
+	bufferSize int
+
+	mtx        *sync.Mutex
+	transports map[*memoryTransport]bool
+}
+
+type memoryTransport struct {
+	broker   *MemoryBroker
+	messages chan []byte
+	closed   bool
+}
+
+// NewMemoryBroker creates a broker, every transport buffers up to bufferSize values
+func NewMemoryBroker(bufferSize int) *MemoryBroker {
+	return &MemoryBroker{
+		bufferSize: bufferSize,
+		mtx:        new(sync.Mutex),
+		transports: make(map[*memoryTransport]bool),
+	}
+}
+
+// Transport connects a new node to the broker
+func (b *MemoryBroker) Transport() Transport {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	t := &memoryTransport{
+		broker:   b,
+		messages: make(chan []byte, b.bufferSize),
+	}
+	b.transports[t] = true
+	return t
+}
+
+// Publish fails with ErrBrokerFull if any of the transports is full, the others receive the value
+func (t *memoryTransport) Publish(ctx context.Context, key string, value []byte) error {
+	t.broker.mtx.Lock()
+	defer t.broker.mtx.Unlock()
+	var err error
+	for recipient := range t.broker.transports {
+		select {
+		case recipient.messages <- value:
+		default:
+			err = ErrBrokerFull
+		}
+	}
+	return err
+}
+
+func (t *memoryTransport) Messages() <-chan []byte {
+	return t.messages
+}
+
+func (t *memoryTransport) Close() error {
+	t.broker.mtx.Lock()
+	defer t.broker.mtx.Unlock()
+	if !t.closed {
+		t.closed = true
+		delete(t.broker.transports, t)
+		close(t.messages)
+	}
+	return nil
+}
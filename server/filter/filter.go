@@ -0,0 +1,85 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+	Moderation of posted messages. The filters of a Chain run in order before a message is stored and broadcast, a
+	filter may let the message through, rewrite its text or reject it
+*/
+
+type Action int8
+
+const (
+	Allow Action = iota
+	// Replace the text with Result.Text
+	Modify
+	// Reject the message, Result.Reason is sent back to the author
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Modify:
+		return "modify"
+	case Reject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+type Post struct {
+	UserId   int32
+	RoomId   int32
+	RoomName string
+	Text     string
+}
+
+type Result struct {
+	Action Action
+	Text   string
+	Reason string
+}
+
+type MessageFilter interface {
+	// Name identifies the filter in rejections and logs
+	Name() string
+	Filter(ctx context.Context, post Post) Result
+}
+
+// RejectedError tells the author why the message was rejected
+type RejectedError struct {
+	Filter string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected by %s: %s", e.Filter, e.Reason)
+}
+
+type Chain struct {
+	filters []MessageFilter
+}
+
+func NewChain(filters ...MessageFilter) *Chain {
+	return &Chain{filters: filters}
+}
+
+// Apply runs the filters in order and returns the text to post. A rejection stops the chain with RejectedError
+func (c *Chain) Apply(ctx context.Context, post Post) (string, error) {
+	for _, f := range c.filters {
+		result := f.Filter(ctx, post)
+		switch result.Action {
+		case Modify:
+			post.Text = result.Text
+		case Reject:
+			return "", &RejectedError{Filter: f.Name(), Reason: result.Reason}
+		}
+	}
+	return post.Text, nil
+}
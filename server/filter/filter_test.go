@@ -0,0 +1,43 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	banned := NewBannedWords()
+	banned.Set("General", []string{"spoiler"})
+	chain := NewChain(MaxLength(24), LinkBlocker(), banned, ProfanityMask([]string{"darn", "heck"}))
+
+	for text, expected := range map[string]string{
+		"hello":             "hello",
+		"darn it":           "**** it",
+		"oh HECK, darnit":   "oh ****, darnit",
+		"spoiler elsewhere": "spoiler elsewhere",
+	} {
+		actual, err := chain.Apply(context.Background(), Post{RoomName: "random", Text: text})
+		if err != nil || actual != expected {
+			t.Errorf("[%s] expected [%s], actual [%s] %v", text, expected, actual, err)
+		}
+	}
+
+	for text, filterName := range map[string]string{
+		"this message is much too long": "max-length",
+		"see https://example.com":       "link-blocker",
+		"visit www.example.com":         "link-blocker",
+		"big Spoiler ahead":             "banned-words",
+	} {
+		_, err := chain.Apply(context.Background(), Post{RoomName: "general", Text: text})
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Filter != filterName {
+			t.Errorf("[%s] expected rejection by %s, actual %v", text, filterName, err)
+		}
+	}
+
+	banned.Set("general", nil)
+	if _, err := chain.Apply(context.Background(), Post{RoomName: "general", Text: "spoiler"}); err != nil {
+		t.Errorf("ban expected to be removed, actual %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type maxLength struct {
+	limit int
+}
+
+// MaxLength rejects messages longer than the limit, in characters
+func MaxLength(limit int) MessageFilter {
+	return &maxLength{limit: limit}
+}
+
+func (f *maxLength) Name() string {
+	return "max-length"
+}
+
+func (f *maxLength) Filter(ctx context.Context, post Post) Result {
+	if utf8.RuneCountInString(post.Text) > f.limit {
+		return Result{Action: Reject, Reason: fmt.Sprintf("message is longer than %d characters", f.limit)}
+	}
+	return Result{Action: Allow}
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+type linkBlocker struct{}
+
+// LinkBlocker rejects messages with links
+func LinkBlocker() MessageFilter {
+	return linkBlocker{}
+}
+
+func (f linkBlocker) Name() string {
+	return "link-blocker"
+}
+
+func (f linkBlocker) Filter(ctx context.Context, post Post) Result {
+	if linkPattern.MatchString(post.Text) {
+		return Result{Action: Reject, Reason: "links are not allowed"}
+	}
+	return Result{Action: Allow}
+}
+
+type profanityMask struct {
+	pattern *regexp.Regexp
+}
+
+// ProfanityMask replaces the words, case insensitive, with asterisks
+func ProfanityMask(words []string) MessageFilter {
+	return &profanityMask{pattern: wordsPattern(words)}
+}
+
+func (f *profanityMask) Name() string {
+	return "profanity-mask"
+}
+
+func (f *profanityMask) Filter(ctx context.Context, post Post) Result {
+	if f.pattern == nil || !f.pattern.MatchString(post.Text) {
+		return Result{Action: Allow}
+	}
+	masked := f.pattern.ReplaceAllStringFunc(post.Text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return Result{Action: Modify, Text: masked}
+}
+
+// BannedWords rejects messages with words banned in the room. Rooms are identified by name, the lists can be
+// changed at runtime
+type BannedWords struct {
+	mtx      *sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+func NewBannedWords() *BannedWords {
+	return &BannedWords{
+		mtx:      new(sync.RWMutex),
+		patterns: make(map[string]*regexp.Regexp),
+	}
+}
+
+// Set replaces the banned words of the room, an empty list removes the ban
+func (f *BannedWords) Set(roomName string, words []string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	key := strings.ToLower(roomName)
+	if pattern := wordsPattern(words); pattern != nil {
+		f.patterns[key] = pattern
+	} else {
+		delete(f.patterns, key)
+	}
+}
+
+func (f *BannedWords) Name() string {
+	return "banned-words"
+}
+
+func (f *BannedWords) Filter(ctx context.Context, post Post) Result {
+	f.mtx.RLock()
+	pattern, ok := f.patterns[strings.ToLower(post.RoomName)]
+	f.mtx.RUnlock()
+	if !ok {
+		return Result{Action: Allow}
+	}
+	if word := pattern.FindString(post.Text); word != "" {
+		return Result{Action: Reject, Reason: fmt.Sprintf("[%s] is not allowed in this room", word)}
+	}
+	return Result{Action: Allow}
+}
+
+// wordsPattern matches any of the words as a whole word, case insensitive. Nil if there are no words
+func wordsPattern(words []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
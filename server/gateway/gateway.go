@@ -0,0 +1,381 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/resume"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+/*
+	HTTP gateway for browser clients. Unary ChatService methods are exposed as POST /api/<Method> with protojson
+	bodies, the Post stream is bridged to a WebSocket at /api/Post, one protojson message per text frame. The resume
+	query parameter of the WebSocket is passed to the stream as the resume.Header metadata. A failed call answers, and
+	a failed stream ends, with a google.rpc.Status in protojson.
+
+	The gateway is a gRPC client of the chat server. Every Connect opens its own connection, so a gateway session is
+	tracked exactly like a native client session. The connection is closed, and the user disconnected, once the
+	session has no open WebSocket and no calls for Config.IdleTimeout
+*/
+
+const (
+	servicePrefix = "/iyarkov2.chat.api.ChatService/"
+	apiPrefix     = "/api/"
+	postMethod    = "Post"
+	connectMethod = "Connect"
+)
+
+type Config struct {
+	// Opens a new connection to the chat server
+	Dial func(ctx context.Context) (*grpc.ClientConn, error)
+	// How long a session without WebSocket connections is kept
+	IdleTimeout time.Duration
+	// Largest request body and WebSocket frame in bytes, larger requests are answered with 413
+	MaxBodySize int64
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.Dial == nil {
+		validation = append(validation, "dial function required")
+	}
+	if config.IdleTimeout <= 0 {
+		validation = append(validation, "idle timeout must be positive")
+	}
+	if config.MaxBodySize <= 0 {
+		validation = append(validation, "max body size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Gateway struct {
+	config  Config
+	service protoreflect.ServiceDescriptor
+
+	mtx      *sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	conn    *grpc.ClientConn
+	streams int
+	expires time.Time
+	timer   *time.Timer
+}
+
+func New(config Config) (*Gateway, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Gateway{
+		config:   config,
+		service:  api.File_chat_proto.Services().ByName("ChatService"),
+		mtx:      new(sync.Mutex),
+		sessions: make(map[string]*session),
+	}, nil
+}
+
+// Handler serves the gateway API under /api/
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(apiPrefix+postMethod, websocket.Server{Handler: g.post})
+	mux.HandleFunc(apiPrefix, g.unary)
+	return mux
+}
+
+// Close disconnects every session
+func (g *Gateway) Close() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for token, s := range g.sessions {
+		s.timer.Stop()
+		s.conn.Close()
+		delete(g.sessions, token)
+	}
+}
+
+func (g *Gateway) unary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, status.Error(codes.Unimplemented, "POST required"))
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	method := g.service.Methods().ByName(protoreflect.Name(name))
+	if method == nil || method.IsStreamingClient() || method.IsStreamingServer() {
+		writeError(w, status.Errorf(codes.Unimplemented, "unknown method %s", name))
+		return
+	}
+	request, err := newMessage(method.Input())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, g.config.MaxBodySize))
+	if err != nil && int64(len(body)) >= g.config.MaxBodySize {
+		// The reader stops at the limit
+		writeMessage(w, http.StatusRequestEntityTooLarge, status.Newf(codes.InvalidArgument,
+			"request body exceeds %d bytes", g.config.MaxBodySize).Proto())
+		return
+	}
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "failed to read the request: %s", err))
+		return
+	}
+	if len(body) > 0 {
+		if err := protojson.Unmarshal(body, request); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid request: %s", err))
+			return
+		}
+	}
+	response, err := newMessage(method.Output())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if name == connectMethod {
+		err = g.connect(r.Context(), request.(*api.ConnectRequest), response.(*api.ConnectResponse))
+	} else {
+		err = g.invoke(r.Context(), tokenFromRequest(r), name, request, response)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeMessage(w, http.StatusOK, response)
+}
+
+// connect opens a new session connection, the connection is kept if the user connected
+func (g *Gateway) connect(ctx context.Context, request *api.ConnectRequest, response *api.ConnectResponse) error {
+	conn, err := g.config.Dial(ctx)
+	if err != nil {
+		log.Printf("Gateway failed to dial the chat server: %s", err)
+		return status.Error(codes.Unavailable, "chat server unavailable")
+	}
+	if err := conn.Invoke(ctx, servicePrefix+connectMethod, request, response); err != nil {
+		conn.Close()
+		return err
+	}
+	if response.Status != api.ConnectResponse_SUCCESS {
+		conn.Close()
+		return nil
+	}
+	s := &session{conn: conn}
+	g.mtx.Lock()
+	g.sessions[response.Token] = s
+	s.timer = time.AfterFunc(g.config.IdleTimeout, func() {
+		g.expire(response.Token)
+	})
+	g.touch(s)
+	g.mtx.Unlock()
+	return nil
+}
+
+func (g *Gateway) invoke(ctx context.Context, token string, method string, request proto.Message, response proto.Message) error {
+	s, err := g.acquire(token)
+	if err != nil {
+		return err
+	}
+	defer g.release(s)
+	return s.conn.Invoke(auth.AppendToken(ctx, token), servicePrefix+method, request, response)
+}
+
+// post bridges the WebSocket to the Post stream
+func (g *Gateway) post(ws *websocket.Conn) {
+	ws.MaxPayloadBytes = int(g.config.MaxBodySize)
+	token := tokenFromRequest(ws.Request())
+	s, err := g.acquire(token)
+	if err != nil {
+		sendError(ws, err)
+		return
+	}
+	defer g.release(s)
+
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	ctx = auth.AppendToken(ctx, token)
+	if positions := ws.Request().URL.Query().Get("resume"); positions != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, resume.Header, positions)
+	}
+	stream, err := api.NewChatServiceClient(s.conn).Post(ctx)
+	if err != nil {
+		sendError(ws, err)
+		return
+	}
+
+	// WebSocket frames are read in a separate goroutine, only this one sends
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var frame string
+			if err := websocket.Message.Receive(ws, &frame); err != nil {
+				// The browser went away
+				stream.CloseSend()
+				return
+			}
+			request := &api.PostRequest{}
+			if err := protojson.Unmarshal([]byte(frame), request); err != nil {
+				readErr <- status.Errorf(codes.InvalidArgument, "invalid request: %s", err)
+				cancel()
+				return
+			}
+			if err := stream.Send(request); err != nil {
+				// The reason is returned by stream.Recv
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			select {
+			case err = <-readErr:
+			default:
+			}
+			if err != io.EOF {
+				sendError(ws, err)
+			}
+			return
+		}
+		frame, err := protojson.Marshal(msg)
+		if err != nil {
+			log.Printf("Failed to marshal message %d: %s", msg.Id, err)
+			continue
+		}
+		if err := websocket.Message.Send(ws, string(frame)); err != nil {
+			return
+		}
+	}
+}
+
+// acquire returns the session of the token, the session does not expire until released
+func (g *Gateway) acquire(token string) (*session, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	s, ok := g.sessions[token]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unknown session, call Connect")
+	}
+	s.streams++
+	return s, nil
+}
+
+func (g *Gateway) release(s *session) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	s.streams--
+	g.touch(s)
+}
+
+// touch restarts the idle timer, must be called under the lock
+func (g *Gateway) touch(s *session) {
+	s.expires = time.Now().Add(g.config.IdleTimeout)
+	s.timer.Reset(g.config.IdleTimeout)
+}
+
+func (g *Gateway) expire(token string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	s, ok := g.sessions[token]
+	if !ok || s.streams > 0 || time.Now().Before(s.expires) {
+		return
+	}
+	delete(g.sessions, token)
+	s.conn.Close()
+}
+
+func newMessage(descriptor protoreflect.MessageDescriptor) (proto.Message, error) {
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(descriptor.FullName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unknown message %s", descriptor.FullName())
+	}
+	return messageType.New().Interface(), nil
+}
+
+// tokenFromRequest reads the authorization header. Browsers can not set WebSocket headers, the token query
+// parameter is accepted too
+func tokenFromRequest(r *http.Request) string {
+	if token, ok := auth.TokenFromHeader(r.Header.Get(auth.Header)); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+func writeMessage(w http.ResponseWriter, code int, msg proto.Message) {
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	writeMessage(w, httpStatus(s.Code()), s.Proto())
+}
+
+func sendError(ws *websocket.Conn, err error) {
+	frame, marshalErr := protojson.Marshal(status.Convert(err).Proto())
+	if marshalErr != nil {
+		log.Printf("Failed to marshal status: %s", marshalErr)
+		return
+	}
+	if err := websocket.Message.Send(ws, string(frame)); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Failed to send status: %s", err)
+	}
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Canceled:
+		return 499
+	default:
+		return http.StatusInternalServerError
+	}
+}
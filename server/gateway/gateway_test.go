@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/block"
+	"github.com/iyarkov2/chat/server/chat"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/inbox"
+	"github.com/iyarkov2/chat/server/metrics"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/purge"
+	"github.com/iyarkov2/chat/server/ratelimit"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"github.com/iyarkov2/chat/server/thread"
+	"github.com/iyarkov2/chat/server/user"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestGateway(t *testing.T) *httptest.Server {
+	users, err := user.NewRegistry(user.NewMemoryStore())
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	h, err := hub.New(hub.Config{BufferSize: 16, Policy: hub.Drop})
+	if err != nil {
+		t.Fatalf("failed to create hub: %s", err)
+	}
+	signer, err := auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create signer: %s", err)
+	}
+	tracker, err := presence.NewTracker(presence.Config{
+		Timeout:       time.Minute,
+		TypingTimeout: time.Minute,
+		SweepInterval: time.Second,
+		BufferSize:    16,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracker: %s", err)
+	}
+	t.Cleanup(tracker.Close)
+	limiter, err := ratelimit.New(ratelimit.Config{})
+	if err != nil {
+		t.Fatalf("failed to create limiter: %s", err)
+	}
+	blobs, err := attachment.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create blob store: %s", err)
+	}
+	attachments, err := attachment.NewService(blobs, attachment.Config{MaxSize: 1024, ChunkSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create attachment service: %s", err)
+	}
+	notifications, err := inbox.NewInbox(inbox.Config{MaxPerUser: 100, BufferSize: 16})
+	if err != nil {
+		t.Fatalf("failed to create inbox: %s", err)
+	}
+	rooms := room.NewRegistry()
+	messages := history.NewMemoryStore()
+	sweeper, err := purge.NewSweeper(messages, rooms, purge.Config{
+		Interval:  time.Second,
+		BatchSize: 100,
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sweeper: %s", err)
+	}
+	t.Cleanup(sweeper.Close)
+	s, err := chat.NewServer(chat.Config{
+		Users:       users,
+		Hub:         h,
+		Rooms:       rooms,
+		Messages:    messages,
+		Signer:      signer,
+		Presence:    tracker,
+		Limiter:     limiter,
+		Filters:     filter.NewChain(),
+		Search:      search.NewIndex(),
+		Attachments: attachments,
+		Metrics:     metrics.New(),
+		Threads:     thread.NewRegistry(),
+		Inbox:       notifications,
+		Sweeper:     sweeper,
+		Blocks:      block.NewRegistry(),
+		Bans:        user.NewBans(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(s.ServerOptions()...)
+	api.RegisterChatServiceServer(grpcServer, s)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	gw, err := New(Config{
+		Dial: func(ctx context.Context) (*grpc.ClientConn, error) {
+			return grpc.DialContext(ctx, "bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+					return listener.Dial()
+				}),
+				grpc.WithInsecure())
+		},
+		IdleTimeout: time.Minute,
+		MaxBodySize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to create gateway: %s", err)
+	}
+	t.Cleanup(gw.Close)
+	server := httptest.NewServer(gw.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call posts the request and decodes the response, returns the HTTP status
+func call(t *testing.T, server *httptest.Server, token string, method string, request proto.Message, response proto.Message) int {
+	body, err := protojson.Marshal(request)
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	r, err := http.NewRequest(http.MethodPost, server.URL+"/api/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	if token != "" {
+		r.Header.Set(auth.Header, "Bearer "+token)
+	}
+	result, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("%s failed: %s", method, err)
+	}
+	defer result.Body.Close()
+	payload, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if result.StatusCode == http.StatusOK {
+		if err := protojson.Unmarshal(payload, response); err != nil {
+			t.Fatalf("invalid response %s: %s", payload, err)
+		}
+	}
+	return result.StatusCode
+}
+
+func connect(t *testing.T, server *httptest.Server, name string) *api.ConnectResponse {
+	response := &api.ConnectResponse{}
+	if code := call(t, server, "", "Connect", &api.ConnectRequest{Name: name}, response); code != http.StatusOK {
+		t.Fatalf("connect failed with %d", code)
+	}
+	return response
+}
+
+func openPost(t *testing.T, server *httptest.Server, token string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/Post?token=" + token
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %s", err)
+	}
+	t.Cleanup(func() {
+		ws.Close()
+	})
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) *api.PostResponse {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame string
+	if err := websocket.Message.Receive(ws, &frame); err != nil {
+		t.Fatalf("receive failed: %s", err)
+	}
+	msg := &api.PostResponse{}
+	if err := protojson.Unmarshal([]byte(frame), msg); err != nil {
+		t.Fatalf("invalid frame %s: %s", frame, err)
+	}
+	return msg
+}
+
+func TestPostOverWebSocket(t *testing.T) {
+	server := newTestGateway(t)
+	john := connect(t, server, "John")
+	jane := connect(t, server, "Jane")
+	if john.Status != api.ConnectResponse_SUCCESS || connect(t, server, "John").Status != api.ConnectResponse_NAME_TAKEN {
+		t.Fatalf("unexpected connect results %v", john)
+	}
+
+	created := &api.CreateRoomResponse{}
+	if code := call(t, server, john.Token, "CreateRoom", &api.CreateRoomRequest{Name: "general"}, created); code != http.StatusOK {
+		t.Fatalf("create room failed with %d", code)
+	}
+	if code := call(t, server, jane.Token, "JoinRoom", &api.JoinRoomRequest{RoomId: created.Room.Id}, &api.JoinRoomResponse{}); code != http.StatusOK {
+		t.Fatalf("join room failed with %d", code)
+	}
+
+	johnWs := openPost(t, server, john.Token)
+	janeWs := openPost(t, server, jane.Token)
+	// Posting to a private room proves the stream is subscribed
+	for _, u := range []struct {
+		name  string
+		token string
+		ws    *websocket.Conn
+	}{{"John", john.Token, johnWs}, {"Jane", jane.Token, janeWs}} {
+		private := &api.CreateRoomResponse{}
+		if code := call(t, server, u.token, "CreateRoom", &api.CreateRoomRequest{Name: u.name}, private); code != http.StatusOK {
+			t.Fatalf("create room failed with %d", code)
+		}
+		// Browsers send plain JSON
+		if err := websocket.Message.Send(u.ws, fmt.Sprintf(`{"clientId": 1, "text": "ping", "roomId": %d}`, private.Room.Id)); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		if ack := receive(t, u.ws); ack.ClientId != 1 {
+			t.Fatalf("expected acknowledgement, actual %v", ack)
+		}
+	}
+
+	frame, err := protojson.Marshal(&api.PostRequest{ClientId: 2, Text: "hello", RoomId: created.Room.Id})
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	if err := websocket.Message.Send(johnWs, string(frame)); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if ack := receive(t, johnWs); ack.ClientId != 2 || ack.Text != "hello" {
+		t.Errorf("expected acknowledgement, actual %v", ack)
+	}
+	if msg := receive(t, janeWs); msg.Text != "hello" || msg.UserId != john.UserId {
+		t.Errorf("expected John's message, actual %v", msg)
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	server := newTestGateway(t)
+	code := call(t, server, "forged", "ListRooms", &api.ListRoomsRequest{}, &api.ListRoomsResponse{})
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected 401, actual %d", code)
+	}
+	code = call(t, server, "", "Heartbeats", &api.HeartbeatRequest{}, &api.HeartbeatResponse{})
+	if code != http.StatusNotImplemented {
+		t.Errorf("expected 501, actual %d", code)
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	server := newTestGateway(t)
+	john := connect(t, server, "John")
+	request := &api.CreateRoomRequest{Name: strings.Repeat("x", 2048)}
+	if code := call(t, server, john.Token, "CreateRoom", request, &api.CreateRoomResponse{}); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, actual %d", code)
+	}
+}
@@ -3,18 +3,34 @@ module github.com/iyarkov2/chat/server
 go 1.17
 
 require (
+	github.com/confluentinc/confluent-kafka-go v1.7.0
 	github.com/iyarkov2/chat/api v0.0.0
-	github.com/rs/zerolog v1.24.0
+	github.com/iyarkov2/chat/core v0.0.0
+	github.com/iyarkov2/chat/idempotency v0.0.0
+	github.com/lib/pq v1.10.3
+	github.com/prometheus/client_golang v1.10.0
+	github.com/rs/zerolog v1.25.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	google.golang.org/grpc v1.40.0
 	google.golang.org/protobuf v1.27.1
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/golang/protobuf v1.5.0 // indirect
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.18.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
 	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
 	golang.org/x/text v0.3.3 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
 
 replace github.com/iyarkov2/chat/api v0.0.0 => ../api
+
+replace github.com/iyarkov2/chat/core v0.0.0 => ../core
+
+replace github.com/iyarkov2/chat/idempotency v0.0.0 => ../idempotency
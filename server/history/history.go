@@ -0,0 +1,214 @@
+package history
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Persistent message history. Messages are paged by id with opaque cursors, see Cursor. Every room numbers its
+	messages with a sequence, clients use it to detect missed messages and to resume, see MessageStore.Since. Replies
+	form threads under their root message, they are not numbered and not paged with the room, see MessageStore.Replies.
+	Expired messages and the messages out of the room retention are removed for good, see MessageStore.Expire and
+	MessageStore.Purge. A message may expire a while after it is first read instead of after it is posted, see
+	MessageStore.StartExpiry
+*/
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrNotFound      = errors.New("message not found")
+	ErrDeleted       = errors.New("message deleted")
+)
+
+type Message struct {
+	Id     int32
+	RoomId int32
+	// Position of the message in the room, starts at 1 and grows by 1 with every message of the room
+	Seq    int32
+	UserId int32
+	// Name of the author, unlike the user id it stays the same when the author reconnects
+	UserName  string
+	Text      string
+	CreatedAt time.Time
+	// Zero if the message was never edited
+	EditedAt time.Time
+	// Deleted messages stay in the history as tombstones with empty text and no attachments
+	Deleted bool
+	// Ids of the attachment.Service attachments
+	AttachmentIds []string
+	// Root message of the thread, zero for a root message. Replies have no sequence number
+	ParentId int32
+	// Replies of a root message, deleted ones included
+	ReplyCount int32
+	// Zero if the message does not expire
+	ExpiresAt time.Time
+	// Non zero if the message expires this long after it is first read, ExpiresAt is zero until then
+	ReadTtl time.Duration
+}
+
+type Direction int8
+
+const (
+	// Backward pages through messages older than the anchor
+	Backward Direction = iota
+	// Forward pages through messages newer than the anchor
+	Forward
+)
+
+// MessageStore persists posted messages. Implementations must be safe for concurrent use
+type MessageStore interface {
+	// Insert stores the message, assigns its id, sequence number and creation time. A reply increases the reply count
+	// of its root message, the caller makes sure the root message exists
+	Insert(ctx context.Context, msg Message) (Message, error)
+
+	// InsertOnce stores the message unless a message with the same request id was already stored. Returns the stored
+	// message, for a duplicate request it is the original message and the flag is true
+	InsertOnce(ctx context.Context, requestId string, msg Message) (Message, bool, error)
+
+	// Get returns ErrNotFound if the message does not exist
+	Get(ctx context.Context, id int32) (Message, error)
+
+	// Edit replaces the message text and sets the edit time. Returns ErrNotFound or ErrDeleted
+	Edit(ctx context.Context, id int32, text string) (Message, error)
+
+	// Delete turns the message into a tombstone. Returns ErrNotFound or ErrDeleted
+	Delete(ctx context.Context, id int32) (Message, error)
+
+	// Page returns up to limit root messages of the room, ordered by id, that are older (Backward) or newer (Forward)
+	// than the anchor message id. Anchor 0 with Backward direction returns the latest messages
+	Page(ctx context.Context, roomId int32, anchorId int32, direction Direction, limit int) ([]Message, error)
+
+	// Since returns up to limit root messages of the room with a sequence number greater than afterSeq, ordered by the
+	// sequence number
+	Since(ctx context.Context, roomId int32, afterSeq int32, limit int) ([]Message, error)
+
+	// Replies returns up to limit replies to the root message with an id greater than afterId, ordered by id
+	Replies(ctx context.Context, rootId int32, afterId int32, limit int) ([]Message, error)
+
+	// Expire removes up to limit messages that expired before now, with the replies of the removed root messages.
+	// Returns the removed messages, the replies may exceed the limit. Removing a reply decreases the reply count of its
+	// root message
+	Expire(ctx context.Context, now time.Time, limit int) ([]Message, error)
+
+	// StartExpiry sets the expiration time of the listed messages that expire after read and were not read yet to now
+	// plus their ReadTtl. Returns the changed messages ordered by id, unknown ids are ignored
+	StartExpiry(ctx context.Context, ids []int32, now time.Time) ([]Message, error)
+
+	// Purge removes up to limit root messages of the room created before the given time, with their replies. Returns
+	// the removed messages like Expire
+	Purge(ctx context.Context, roomId int32, before time.Time, limit int) ([]Message, error)
+
+	// LastRoomId returns the greatest room id that ever had a message, zero if there is none. Rooms outlive the
+	// process only in the history, new rooms must get greater ids not to take over the history of an earlier room
+	LastRoomId(ctx context.Context) (int32, error)
+}
+
+// Cursor is a position in the room history. Clients see it as an opaque string
+type Cursor struct {
+	RoomId    int32
+	AnchorId  int32
+	Direction Direction
+}
+
+func (c Cursor) Encode() string {
+	raw := fmt.Sprintf("%d:%d:%d", c.RoomId, c.AnchorId, c.Direction)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(value string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	values := make([]int64, len(parts))
+	for i, part := range parts {
+		if values[i], err = strconv.ParseInt(part, 10, 32); err != nil {
+			return Cursor{}, ErrInvalidCursor
+		}
+	}
+	direction := Direction(values[2])
+	if direction != Backward && direction != Forward {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{
+		RoomId:    int32(values[0]),
+		AnchorId:  int32(values[1]),
+		Direction: direction,
+	}, nil
+}
+
+type Page struct {
+	Messages []Message
+	// Cursor of the older messages, nil if there are none
+	Prev *Cursor
+	// Cursor of the newer messages. Always set, new messages may arrive later
+	Next Cursor
+}
+
+// Fetch reads a page of the room history. The empty cursor fetches the latest messages
+func Fetch(ctx context.Context, store MessageStore, roomId int32, cursor string, limit int) (Page, error) {
+	position := Cursor{RoomId: roomId, Direction: Backward}
+	if cursor != "" {
+		var err error
+		if position, err = DecodeCursor(cursor); err != nil {
+			return Page{}, err
+		}
+		if position.RoomId != roomId {
+			return Page{}, fmt.Errorf("%w: cursor belongs to another room", ErrInvalidCursor)
+		}
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	// One extra message tells if there is more to read
+	messages, err := store.Page(ctx, roomId, position.AnchorId, position.Direction, limit+1)
+	if err != nil {
+		return Page{}, err
+	}
+	more := len(messages) > limit
+	if more {
+		if position.Direction == Backward {
+			messages = messages[1:]
+		} else {
+			messages = messages[:limit]
+		}
+	}
+
+	result := Page{
+		Messages: messages,
+		Next:     position,
+	}
+	if len(messages) == 0 {
+		if position.Direction == Backward && position.AnchorId > 0 {
+			// Newer messages start with the anchor
+			result.Next = Cursor{RoomId: roomId, AnchorId: position.AnchorId - 1, Direction: Forward}
+		} else if position.Direction == Backward {
+			// The room is empty, everything posted later is newer
+			result.Next = Cursor{RoomId: roomId, Direction: Forward}
+		}
+		return result, nil
+	}
+	result.Next = Cursor{RoomId: roomId, AnchorId: messages[len(messages)-1].Id, Direction: Forward}
+	if position.Direction == Forward || more {
+		result.Prev = &Cursor{RoomId: roomId, AnchorId: messages[0].Id, Direction: Backward}
+	}
+	return result, nil
+}
@@ -0,0 +1,311 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, roomId int32, count int) MessageStore {
+	store := NewMemoryStore()
+	for i := 1; i <= count; i++ {
+		// Messages of another room are interleaved to make sure they are not picked up
+		if _, err := store.Insert(context.Background(), Message{RoomId: roomId + 1, Text: "other"}); err != nil {
+			t.Fatalf("insert failed: %s", err)
+		}
+		if _, err := store.Insert(context.Background(), Message{RoomId: roomId, Text: fmt.Sprintf("message %d", i)}); err != nil {
+			t.Fatalf("insert failed: %s", err)
+		}
+	}
+	return store
+}
+
+func texts(messages []Message) []string {
+	result := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, msg.Text)
+	}
+	return result
+}
+
+func TestFetchBackward(t *testing.T) {
+	store := newTestStore(t, 1, 5)
+
+	latest, err := Fetch(context.Background(), store, 1, "", 2)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if fmt.Sprint(texts(latest.Messages)) != "[message 4 message 5]" {
+		t.Errorf("unexpected latest page %v", texts(latest.Messages))
+	}
+	if latest.Prev == nil {
+		t.Fatalf("prev cursor expected")
+	}
+
+	middle, err := Fetch(context.Background(), store, 1, latest.Prev.Encode(), 2)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if fmt.Sprint(texts(middle.Messages)) != "[message 2 message 3]" {
+		t.Errorf("unexpected middle page %v", texts(middle.Messages))
+	}
+
+	first, err := Fetch(context.Background(), store, 1, middle.Prev.Encode(), 2)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if fmt.Sprint(texts(first.Messages)) != "[message 1]" || first.Prev != nil {
+		t.Errorf("unexpected first page %v, prev %v", texts(first.Messages), first.Prev)
+	}
+}
+
+func TestFetchForward(t *testing.T) {
+	store := newTestStore(t, 1, 3)
+
+	latest, err := Fetch(context.Background(), store, 1, "", 10)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	empty, err := Fetch(context.Background(), store, 1, latest.Next.Encode(), 10)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if len(empty.Messages) != 0 {
+		t.Errorf("no new messages expected, actual %v", texts(empty.Messages))
+	}
+
+	if _, err := store.Insert(context.Background(), Message{RoomId: 1, Text: "new"}); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	fresh, err := Fetch(context.Background(), store, 1, empty.Next.Encode(), 10)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if fmt.Sprint(texts(fresh.Messages)) != "[new]" {
+		t.Errorf("unexpected page %v", texts(fresh.Messages))
+	}
+}
+
+func TestFetchEmptyRoom(t *testing.T) {
+	store := NewMemoryStore()
+	page, err := Fetch(context.Background(), store, 1, "", 10)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if _, err := store.Insert(context.Background(), Message{RoomId: 1, Text: "first"}); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	next, err := Fetch(context.Background(), store, 1, page.Next.Encode(), 10)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	if fmt.Sprint(texts(next.Messages)) != "[first]" {
+		t.Errorf("unexpected page %v", texts(next.Messages))
+	}
+}
+
+func TestFetchInvalidCursor(t *testing.T) {
+	store := newTestStore(t, 1, 1)
+	if _, err := Fetch(context.Background(), store, 1, "garbage", 10); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, actual %v", err)
+	}
+	foreign := Cursor{RoomId: 2, Direction: Backward}.Encode()
+	if _, err := Fetch(context.Background(), store, 1, foreign, 10); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, actual %v", err)
+	}
+}
+
+func TestInsertOnce(t *testing.T) {
+	store := NewMemoryStore()
+	first, duplicate, err := store.InsertOnce(context.Background(), "request", Message{RoomId: 1, Text: "first"})
+	if err != nil || duplicate {
+		t.Fatalf("unexpected result %v %v", duplicate, err)
+	}
+	second, duplicate, err := store.InsertOnce(context.Background(), "request", Message{RoomId: 1, Text: "second"})
+	if err != nil || !duplicate || second.Id != first.Id || second.Text != "first" {
+		t.Errorf("expected the original message, actual %v %v %v", second, duplicate, err)
+	}
+	page, err := store.Page(context.Background(), 1, 0, Backward, 10)
+	if err != nil || len(page) != 1 {
+		t.Errorf("expected a single message, actual %v %v", page, err)
+	}
+}
+
+func TestEditAndDelete(t *testing.T) {
+	store := newTestStore(t, 1, 1)
+	page, err := store.Page(context.Background(), 1, 0, Backward, 1)
+	if err != nil || len(page) != 1 {
+		t.Fatalf("expected a single message, actual %v %v", page, err)
+	}
+	id := page[0].Id
+
+	edited, err := store.Edit(context.Background(), id, "edited")
+	if err != nil || edited.Text != "edited" || edited.EditedAt.IsZero() {
+		t.Errorf("unexpected edited message %v %v", edited, err)
+	}
+	deleted, err := store.Delete(context.Background(), id)
+	if err != nil || !deleted.Deleted || deleted.Text != "" {
+		t.Errorf("unexpected tombstone %v %v", deleted, err)
+	}
+	if _, err := store.Edit(context.Background(), id, "again"); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected ErrDeleted, actual %v", err)
+	}
+	if _, err := store.Delete(context.Background(), 100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+
+	// The tombstone stays in the history
+	if page, err := store.Page(context.Background(), 1, 0, Backward, 1); err != nil || len(page) != 1 || !page[0].Deleted {
+		t.Errorf("expected the tombstone, actual %v %v", page, err)
+	}
+}
+
+func TestSince(t *testing.T) {
+	store := newTestStore(t, 1, 5)
+	messages, err := store.Since(context.Background(), 1, 2, 2)
+	if err != nil {
+		t.Fatalf("since failed: %s", err)
+	}
+	if fmt.Sprint(texts(messages)) != "[message 3 message 4]" || messages[0].Seq != 3 || messages[1].Seq != 4 {
+		t.Errorf("unexpected messages %v", messages)
+	}
+	if messages, err := store.Since(context.Background(), 1, 5, 10); err != nil || len(messages) != 0 {
+		t.Errorf("expected no messages, actual %v %v", messages, err)
+	}
+	// Every room has its own sequence
+	if messages, err := store.Since(context.Background(), 2, 0, 10); err != nil || len(messages) != 5 || messages[4].Seq != 5 {
+		t.Errorf("expected 5 messages of the other room, actual %v %v", messages, err)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	roots, err := store.Page(context.Background(), 1, 0, Backward, 10)
+	if err != nil || len(roots) != 2 {
+		t.Fatalf("expected 2 messages, actual %v %v", roots, err)
+	}
+	rootId := roots[0].Id
+	for _, text := range []string{"reply 1", "reply 2", "reply 3"} {
+		reply, err := store.Insert(context.Background(), Message{RoomId: 1, ParentId: rootId, Text: text})
+		if err != nil || reply.Seq != 0 {
+			t.Fatalf("unexpected reply %v %v", reply, err)
+		}
+	}
+	root, err := store.Get(context.Background(), rootId)
+	if err != nil || root.ReplyCount != 3 {
+		t.Errorf("expected 3 replies, actual %v %v", root, err)
+	}
+
+	replies, err := store.Replies(context.Background(), rootId, 0, 2)
+	if err != nil || fmt.Sprint(texts(replies)) != "[reply 1 reply 2]" {
+		t.Fatalf("unexpected replies %v %v", replies, err)
+	}
+	if rest, err := store.Replies(context.Background(), rootId, replies[1].Id, 10); err != nil || fmt.Sprint(texts(rest)) != "[reply 3]" {
+		t.Errorf("unexpected replies %v %v", rest, err)
+	}
+	if _, err := store.Edit(context.Background(), replies[0].Id, "edited"); err != nil {
+		t.Errorf("edit failed: %s", err)
+	}
+
+	// Replies stay out of the room pages and sequence
+	if page, err := store.Page(context.Background(), 1, 0, Backward, 10); err != nil || len(page) != 2 {
+		t.Errorf("expected root messages only, actual %v %v", page, err)
+	}
+	next, err := store.Insert(context.Background(), Message{RoomId: 1, Text: "next"})
+	if err != nil || next.Seq != 3 {
+		t.Errorf("expected seq 3, actual %v %v", next, err)
+	}
+}
+
+func TestExpireAndPurge(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, 1, 3)
+	roots, err := store.Page(ctx, 1, 0, Backward, 10)
+	if err != nil || len(roots) != 3 {
+		t.Fatalf("expected 3 messages, actual %v %v", roots, err)
+	}
+	now := time.Now()
+	ephemeral, err := store.Insert(ctx, Message{RoomId: 1, ParentId: roots[2].Id, Text: "ephemeral", ExpiresAt: now.Add(-time.Second)})
+	if err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	if _, err := store.Insert(ctx, Message{RoomId: 1, ParentId: roots[0].Id, Text: "reply"}); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	if _, err := store.Insert(ctx, Message{RoomId: 1, Text: "later", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+
+	expired, err := store.Expire(ctx, now, 10)
+	if err != nil || len(expired) != 1 || expired[0].Id != ephemeral.Id {
+		t.Fatalf("expected the ephemeral reply, actual %v %v", expired, err)
+	}
+	if root, err := store.Get(ctx, roots[2].Id); err != nil || root.ReplyCount != 0 {
+		t.Errorf("expected no replies, actual %v %v", root, err)
+	}
+	if _, err := store.Get(ctx, ephemeral.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+
+	// The first root message goes with its reply, the other room is not touched
+	purged, err := store.Purge(ctx, 1, roots[1].CreatedAt.Add(time.Nanosecond), 1)
+	if err != nil || fmt.Sprint(texts(purged)) != "[message 1 reply]" {
+		t.Fatalf("unexpected purged messages %v %v", texts(purged), err)
+	}
+	page, err := store.Page(ctx, 1, 0, Backward, 10)
+	if err != nil || fmt.Sprint(texts(page)) != "[message 2 message 3 later]" {
+		t.Errorf("unexpected history %v %v", texts(page), err)
+	}
+	if other, err := store.Page(ctx, 2, 0, Backward, 10); err != nil || len(other) != 3 {
+		t.Errorf("expected 3 messages of the other room, actual %v %v", other, err)
+	}
+	if expired, err := store.Expire(ctx, now, 10); err != nil || len(expired) != 0 {
+		t.Errorf("expected nothing to expire, actual %v %v", expired, err)
+	}
+}
+
+func TestStartExpiry(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	unread, err := store.Insert(ctx, Message{RoomId: 1, Text: "unread", ReadTtl: time.Minute})
+	if err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	plain, err := store.Insert(ctx, Message{RoomId: 1, Text: "plain"})
+	if err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	now := time.Now()
+	if expired, err := store.Expire(ctx, now.Add(time.Hour), 10); err != nil || len(expired) != 0 {
+		t.Errorf("expected nothing to expire before read, actual %v %v", expired, err)
+	}
+	started, err := store.StartExpiry(ctx, []int32{unread.Id, plain.Id, 100}, now)
+	if err != nil || len(started) != 1 || !started[0].ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected the unread message to expire in a minute, actual %v %v", started, err)
+	}
+	// The clock starts once
+	if started, err := store.StartExpiry(ctx, []int32{unread.Id}, now.Add(time.Hour)); err != nil || len(started) != 0 {
+		t.Errorf("expected the clock already started, actual %v %v", started, err)
+	}
+	expired, err := store.Expire(ctx, now.Add(2*time.Minute), 10)
+	if err != nil || len(expired) != 1 || expired[0].Id != unread.Id {
+		t.Errorf("expected the read message expired, actual %v %v", expired, err)
+	}
+}
+
+func TestLastRoomId(t *testing.T) {
+	store := NewMemoryStore()
+	if last, err := store.LastRoomId(context.Background()); err != nil || last != 0 {
+		t.Errorf("expected no rooms, actual %d %v", last, err)
+	}
+	store = newTestStore(t, 3, 1)
+	// The room is remembered after its history is purged
+	if _, err := store.Purge(context.Background(), 4, time.Now().Add(time.Second), 10); err != nil {
+		t.Fatalf("purge failed: %s", err)
+	}
+	if last, err := store.LastRoomId(context.Background()); err != nil || last != 4 {
+		t.Errorf("expected room 4, actual %d %v", last, err)
+	}
+}
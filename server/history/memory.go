@@ -0,0 +1,321 @@
+package history
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mtx    *sync.RWMutex
+	lastId int32
+	// Root messages of every room ordered by id
+	rooms map[int32][]Message
+	// Replies by root message id ordered by id
+	threads map[int32][]Message
+	// Room ids by message id
+	index map[int32]int32
+	// Root message ids by reply id
+	parents map[int32]int32
+	// Last sequence number of every room
+	seqs map[int32]int32
+	// Message ids by request id, see InsertOnce
+	requests map[string]int32
+}
+
+// NewMemoryStore creates a MessageStore that keeps messages in the process memory
+func NewMemoryStore() MessageStore {
+	return &memoryStore{
+		mtx:      new(sync.RWMutex),
+		rooms:    make(map[int32][]Message),
+		threads:  make(map[int32][]Message),
+		index:    make(map[int32]int32),
+		parents:  make(map[int32]int32),
+		seqs:     make(map[int32]int32),
+		requests: make(map[string]int32),
+	}
+}
+
+func (s *memoryStore) Insert(ctx context.Context, msg Message) (Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.insert(msg), nil
+}
+
+func (s *memoryStore) InsertOnce(ctx context.Context, requestId string, msg Message) (Message, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if id, ok := s.requests[requestId]; ok {
+		original, err := s.get(id)
+		return original, true, err
+	}
+	result := s.insert(msg)
+	s.requests[requestId] = result.Id
+	return result, false, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id int32) (Message, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.get(id)
+}
+
+func (s *memoryStore) Edit(ctx context.Context, id int32, text string) (Message, error) {
+	return s.update(id, func(msg *Message) {
+		msg.Text = text
+		msg.EditedAt = time.Now()
+	})
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id int32) (Message, error) {
+	return s.update(id, func(msg *Message) {
+		msg.Text = ""
+		msg.AttachmentIds = nil
+		msg.Deleted = true
+	})
+}
+
+func (s *memoryStore) update(id int32, change func(msg *Message)) (Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	msg, err := s.find(id)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.Deleted {
+		return Message{}, ErrDeleted
+	}
+	change(msg)
+	return *msg, nil
+}
+
+func (s *memoryStore) get(id int32) (Message, error) {
+	msg, err := s.find(id)
+	if err != nil {
+		return Message{}, err
+	}
+	return *msg, nil
+}
+
+// find returns the stored message, must be called under the lock
+func (s *memoryStore) find(id int32) (*Message, error) {
+	roomId, ok := s.index[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	messages := s.rooms[roomId]
+	if rootId, ok := s.parents[id]; ok {
+		messages = s.threads[rootId]
+	}
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].Id >= id
+	})
+	return &messages[i], nil
+}
+
+func (s *memoryStore) insert(msg Message) Message {
+	s.lastId++
+	msg.Id = s.lastId
+	msg.CreatedAt = time.Now()
+	s.index[msg.Id] = msg.RoomId
+	if msg.ParentId != 0 {
+		if root, err := s.find(msg.ParentId); err == nil {
+			root.ReplyCount++
+		}
+		s.threads[msg.ParentId] = append(s.threads[msg.ParentId], msg)
+		s.parents[msg.Id] = msg.ParentId
+		return msg
+	}
+	s.seqs[msg.RoomId]++
+	msg.Seq = s.seqs[msg.RoomId]
+	s.rooms[msg.RoomId] = append(s.rooms[msg.RoomId], msg)
+	return msg
+}
+
+func (s *memoryStore) Page(ctx context.Context, roomId int32, anchorId int32, direction Direction, limit int) ([]Message, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	messages := s.rooms[roomId]
+
+	var from, to int
+	if direction == Forward {
+		from = sort.Search(len(messages), func(i int) bool {
+			return messages[i].Id > anchorId
+		})
+		to = from + limit
+		if to > len(messages) {
+			to = len(messages)
+		}
+	} else {
+		to = len(messages)
+		if anchorId > 0 {
+			to = sort.Search(len(messages), func(i int) bool {
+				return messages[i].Id >= anchorId
+			})
+		}
+		from = to - limit
+		if from < 0 {
+			from = 0
+		}
+	}
+	result := make([]Message, to-from)
+	copy(result, messages[from:to])
+	return result, nil
+}
+
+func (s *memoryStore) Since(ctx context.Context, roomId int32, afterSeq int32, limit int) ([]Message, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	// Ordered by id is also ordered by sequence number
+	messages := s.rooms[roomId]
+	from := sort.Search(len(messages), func(i int) bool {
+		return messages[i].Seq > afterSeq
+	})
+	to := from + limit
+	if to > len(messages) {
+		to = len(messages)
+	}
+	result := make([]Message, to-from)
+	copy(result, messages[from:to])
+	return result, nil
+}
+
+func (s *memoryStore) Replies(ctx context.Context, rootId int32, afterId int32, limit int) ([]Message, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	replies := s.threads[rootId]
+	from := sort.Search(len(replies), func(i int) bool {
+		return replies[i].Id > afterId
+	})
+	to := from + limit
+	if to > len(replies) {
+		to = len(replies)
+	}
+	result := make([]Message, to-from)
+	copy(result, replies[from:to])
+	return result, nil
+}
+
+func (s *memoryStore) Expire(ctx context.Context, now time.Time, limit int) ([]Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := make([]int32, 0)
+	collect := func(messages []Message) {
+		for _, msg := range messages {
+			if len(ids) < limit && !msg.ExpiresAt.IsZero() && msg.ExpiresAt.Before(now) {
+				ids = append(ids, msg.Id)
+			}
+		}
+	}
+	for _, messages := range s.rooms {
+		collect(messages)
+	}
+	for _, replies := range s.threads {
+		collect(replies)
+	}
+	return s.remove(ids), nil
+}
+
+func (s *memoryStore) StartExpiry(ctx context.Context, ids []int32, now time.Time) ([]Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]Message, 0, len(ids))
+	for _, id := range ids {
+		msg, err := s.find(id)
+		if err != nil || msg.ReadTtl == 0 || !msg.ExpiresAt.IsZero() {
+			continue
+		}
+		msg.ExpiresAt = now.Add(msg.ReadTtl)
+		result = append(result, *msg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, roomId int32, before time.Time, limit int) ([]Message, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := make([]int32, 0)
+	// Ordered by id is also ordered by creation time
+	for _, msg := range s.rooms[roomId] {
+		if len(ids) == limit || !msg.CreatedAt.Before(before) {
+			break
+		}
+		ids = append(ids, msg.Id)
+	}
+	return s.remove(ids), nil
+}
+
+// remove drops the messages with the replies of the root messages, must be called under the lock. Returns the removed
+// messages ordered by id
+func (s *memoryStore) remove(ids []int32) []Message {
+	removed := make(map[int32]bool)
+	for _, id := range ids {
+		removed[id] = true
+		for _, reply := range s.threads[id] {
+			removed[reply.Id] = true
+		}
+	}
+	rooms := make(map[int32]bool)
+	threads := make(map[int32]bool)
+	for id := range removed {
+		if rootId, ok := s.parents[id]; ok {
+			threads[rootId] = true
+		} else {
+			rooms[s.index[id]] = true
+		}
+	}
+
+	result := make([]Message, 0, len(removed))
+	keep := func(messages []Message) []Message {
+		kept := messages[:0]
+		for _, msg := range messages {
+			if removed[msg.Id] {
+				result = append(result, msg)
+			} else {
+				kept = append(kept, msg)
+			}
+		}
+		return kept
+	}
+	for roomId := range rooms {
+		s.rooms[roomId] = keep(s.rooms[roomId])
+	}
+	for rootId := range threads {
+		replies := len(s.threads[rootId])
+		s.threads[rootId] = keep(s.threads[rootId])
+		if removed[rootId] {
+			delete(s.threads, rootId)
+		} else if root, err := s.find(rootId); err == nil {
+			root.ReplyCount -= int32(replies - len(s.threads[rootId]))
+		}
+	}
+	for id := range removed {
+		delete(s.index, id)
+		delete(s.parents, id)
+	}
+	for requestId, id := range s.requests {
+		if removed[id] {
+			delete(s.requests, requestId)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (s *memoryStore) LastRoomId(ctx context.Context) (int32, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var result int32
+	for roomId := range s.seqs {
+		if roomId > result {
+			result = roomId
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,382 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/iyarkov2/chat/idempotency"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+/*
+	Postgres backed MessageStore, see statements.sql for the table definitions. Duplicate requests are detected with
+	the idempotency.EmbeddedService inside the message insert transaction. Sequence numbers come from a per room
+	counter row incremented by the insert statement itself, the row lock keeps the numbers of a room gapless. Replies
+	are stored with parent_id of the root message and seq 0, the reply statement increases the root reply count.
+	Expired and purged messages are deleted with their replies and their request records by one statement that also
+	decreases the reply count of the remaining root messages
+*/
+
+type SQLConfig struct {
+	TableName string
+	// Table of the per room sequence counters
+	SequenceTableName string
+	// Table of the idempotency.EmbeddedService
+	RequestTableName string
+	// How long request ids are remembered
+	RequestRetentionPeriodSec uint
+}
+
+func (config SQLConfig) validate() error {
+	validation := make([]string, 0)
+	if config.TableName == "" {
+		validation = append(validation, "table name required")
+	}
+	if config.SequenceTableName == "" {
+		validation = append(validation, "sequence table name required")
+	}
+	if config.RequestTableName == "" {
+		validation = append(validation, "request table name required")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+// The idempotency package expects a zerolog logger in the context
+const idempotencyLogKey = "log"
+
+var idempotencyLogger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "2006-01-02T15:04:0543"}).With().Timestamp().Logger()
+
+type sqlStore struct {
+	db       *sql.DB
+	requests idempotency.EmbeddedService
+
+	insertStmt   string
+	replyStmt    string
+	selectStmt   string
+	editStmt     string
+	deleteStmt   string
+	backwardStmt string
+	latestStmt   string
+	forwardStmt  string
+	sinceStmt    string
+	repliesStmt  string
+	expireStmt   string
+	startStmt    string
+	purgeStmt    string
+	lastRoomStmt string
+}
+
+func NewSQLStore(ctx context.Context, db *sql.DB, config SQLConfig) (MessageStore, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, errors.New("DB must not be nil")
+	}
+
+	// Very simple check that the table exists
+	checkStmt := fmt.Sprintf("SELECT %s FROM %s LIMIT 1", columns, config.TableName)
+	rows, err := db.QueryContext(ctx, checkStmt)
+	if err != nil {
+		return nil, fmt.Errorf("DB check failed %w", err)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("DB check failed %w", err)
+	}
+
+	requests, err := idempotency.NewEmbeddedService(ctx, db, idempotency.EmbeddedServiceConfig{
+		TableName:          config.RequestTableName,
+		RetentionPeriodSec: config.RequestRetentionPeriodSec,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create idempotency service %w", err)
+	}
+
+	// Incrementing the counter and inserting the message is one statement, a failed insert does not leave a gap
+	insertStmt := fmt.Sprintf(`WITH next AS (
+			INSERT INTO %s(room_id, seq) VALUES ($1, 1) ON CONFLICT (room_id) DO UPDATE SET seq = %s.seq + 1 RETURNING seq
+		)
+		INSERT INTO %s(room_id, seq, user_id, user_name, text, created_at, attachment_ids, expires_at, read_ttl_seconds) SELECT $1, seq, $2, $7, $3, $4, $5, $6, $8 FROM next
+		RETURNING id, seq`, config.SequenceTableName, config.SequenceTableName, config.TableName)
+	replyStmt := fmt.Sprintf(`WITH root AS (
+			UPDATE %s SET reply_count = reply_count + 1 WHERE id = $9
+		)
+		INSERT INTO %s(room_id, seq, parent_id, user_id, user_name, text, created_at, attachment_ids, expires_at, read_ttl_seconds) VALUES ($1, 0, $9, $2, $7, $3, $4, $5, $6, $8)
+		RETURNING id, seq`, config.TableName, config.TableName)
+
+	return &sqlStore{
+		db:           db,
+		requests:     requests,
+		selectStmt:   fmt.Sprintf("SELECT %s FROM %s WHERE id = $1", columns, config.TableName),
+		insertStmt:   insertStmt,
+		replyStmt:    replyStmt,
+		editStmt:     fmt.Sprintf("UPDATE %s SET text = $2, edited_at = $3 WHERE id = $1 AND NOT deleted RETURNING %s", config.TableName, columns),
+		deleteStmt:   fmt.Sprintf("UPDATE %s SET text = '', deleted = true, attachment_ids = NULL WHERE id = $1 AND NOT deleted RETURNING %s", config.TableName, columns),
+		backwardStmt: fmt.Sprintf("SELECT %s FROM %s WHERE room_id = $1 AND parent_id = 0 AND id < $2 ORDER BY id DESC LIMIT $3", columns, config.TableName),
+		latestStmt:   fmt.Sprintf("SELECT %s FROM %s WHERE room_id = $1 AND parent_id = 0 ORDER BY id DESC LIMIT $2", columns, config.TableName),
+		forwardStmt:  fmt.Sprintf("SELECT %s FROM %s WHERE room_id = $1 AND parent_id = 0 AND id > $2 ORDER BY id ASC LIMIT $3", columns, config.TableName),
+		sinceStmt:    fmt.Sprintf("SELECT %s FROM %s WHERE room_id = $1 AND parent_id = 0 AND seq > $2 ORDER BY seq ASC LIMIT $3", columns, config.TableName),
+		repliesStmt:  fmt.Sprintf("SELECT %s FROM %s WHERE parent_id = $1 AND id > $2 ORDER BY id ASC LIMIT $3", columns, config.TableName),
+		expireStmt:   removeStmt(config.TableName, config.RequestTableName, fmt.Sprintf("SELECT id FROM %s WHERE expires_at < $1 ORDER BY id LIMIT $2", config.TableName)),
+		startStmt:    fmt.Sprintf("UPDATE %s SET expires_at = $2::timestamp + read_ttl_seconds * interval '1 second' WHERE id = ANY($1) AND read_ttl_seconds > 0 AND expires_at IS NULL RETURNING %s", config.TableName, columns),
+		purgeStmt:    removeStmt(config.TableName, config.RequestTableName, fmt.Sprintf("SELECT id FROM %s WHERE room_id = $1 AND parent_id = 0 AND created_at < $2 ORDER BY id LIMIT $3", config.TableName)),
+		// The counters are not removed with the messages, a room is remembered even if its history was purged
+		lastRoomStmt: fmt.Sprintf("SELECT COALESCE(MAX(room_id), 0) FROM %s", config.SequenceTableName),
+	}, nil
+}
+
+// removeStmt deletes the messages with the ids selected by the query and their replies. The reply count of a root
+// message is updated only if the root stays, a row can not be both updated and deleted by one statement. The request
+// records of the removed messages go too, a retried request must not point to a missing message, see InsertOnce
+func removeStmt(table string, requestTable string, selectIds string) string {
+	return fmt.Sprintf(`WITH selected AS (%s),
+		removed AS (
+			DELETE FROM %s WHERE id IN (SELECT id FROM selected) OR parent_id IN (SELECT id FROM selected) RETURNING %s
+		),
+		requests AS (
+			DELETE FROM %s WHERE result IN (SELECT convert_to(id::text, 'UTF8') FROM removed)
+		),
+		roots AS (
+			UPDATE %s AS root SET reply_count = root.reply_count - counts.replies
+			FROM (SELECT parent_id, count(*) AS replies FROM removed WHERE parent_id <> 0 GROUP BY parent_id) counts
+			WHERE root.id = counts.parent_id AND root.id NOT IN (SELECT id FROM selected)
+		)
+		SELECT %s FROM removed ORDER BY id`, selectIds, table, columns, requestTable, table, columns)
+}
+
+const columns = "id, room_id, seq, parent_id, reply_count, user_id, user_name, text, created_at, edited_at, deleted, attachment_ids, expires_at, read_ttl_seconds"
+
+// Implemented by both sql.DB and sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStore) Insert(ctx context.Context, msg Message) (Message, error) {
+	return s.insert(ctx, s.db, msg)
+}
+
+func (s *sqlStore) InsertOnce(ctx context.Context, requestId string, msg Message) (Message, bool, error) {
+	if _, ok := ctx.Value(idempotencyLogKey).(zerolog.Logger); !ok {
+		ctx = context.WithValue(ctx, idempotencyLogKey, idempotencyLogger)
+	}
+	var result Message
+	duplicate := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		record, err := s.requests.Get(ctx, tx, requestId)
+		if err != nil {
+			return fmt.Errorf("idempotency check failed, %w", err)
+		}
+
+		// The request was already processed, the result is the original message id
+		if record.Result != nil {
+			id, err := strconv.ParseInt(string(record.Result), 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid request record %s, %w", requestId, err)
+			}
+			duplicate = true
+			result, err = s.get(ctx, tx, int32(id))
+			return err
+		}
+
+		if result, err = s.insert(ctx, tx, msg); err != nil {
+			return err
+		}
+		record.Result = []byte(strconv.FormatInt(int64(result.Id), 10))
+		return s.requests.Set(ctx, tx, record)
+	})
+	if err != nil {
+		return Message{}, false, err
+	}
+	return result, duplicate, nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, id int32) (Message, error) {
+	return s.get(ctx, s.db, id)
+}
+
+func (s *sqlStore) insert(ctx context.Context, q queryer, msg Message) (Message, error) {
+	msg.CreatedAt = time.Now().UTC()
+	expiresAt := sql.NullTime{Time: msg.ExpiresAt.UTC(), Valid: !msg.ExpiresAt.IsZero()}
+	readTtl := int32(msg.ReadTtl / time.Second)
+	args := []interface{}{msg.RoomId, msg.UserId, msg.Text, msg.CreatedAt, pq.Array(msg.AttachmentIds), expiresAt, msg.UserName, readTtl}
+	stmt := s.insertStmt
+	if msg.ParentId != 0 {
+		stmt = s.replyStmt
+		args = append(args, msg.ParentId)
+	}
+	row := q.QueryRowContext(ctx, stmt, args...)
+	if err := row.Scan(&msg.Id, &msg.Seq); err != nil {
+		return Message{}, fmt.Errorf("failed to insert a message, %w", err)
+	}
+	return msg, nil
+}
+
+func (s *sqlStore) Edit(ctx context.Context, id int32, text string) (Message, error) {
+	return s.update(ctx, id, s.editStmt, text, time.Now().UTC())
+}
+
+func (s *sqlStore) Delete(ctx context.Context, id int32) (Message, error) {
+	return s.update(ctx, id, s.deleteStmt)
+}
+
+// update runs the statement with the message id followed by the arguments
+func (s *sqlStore) update(ctx context.Context, id int32, stmt string, args ...interface{}) (Message, error) {
+	msg, err := scan(s.db.QueryRowContext(ctx, stmt, append([]interface{}{id}, args...)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Either there is no such message or it is a tombstone
+		existing, err := s.get(ctx, s.db, id)
+		if err != nil {
+			return Message{}, err
+		}
+		if existing.Deleted {
+			return Message{}, ErrDeleted
+		}
+		return Message{}, fmt.Errorf("message %d was not updated", existing.Id)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to update a message, %w", err)
+	}
+	return msg, nil
+}
+
+// Implemented by both sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (Message, error) {
+	var msg Message
+	var editedAt, expiresAt sql.NullTime
+	var readTtl int32
+	if err := row.Scan(&msg.Id, &msg.RoomId, &msg.Seq, &msg.ParentId, &msg.ReplyCount, &msg.UserId, &msg.UserName, &msg.Text, &msg.CreatedAt, &editedAt, &msg.Deleted, pq.Array(&msg.AttachmentIds), &expiresAt, &readTtl); err != nil {
+		return Message{}, err
+	}
+	msg.ReadTtl = time.Duration(readTtl) * time.Second
+	if editedAt.Valid {
+		msg.EditedAt = editedAt.Time
+	}
+	if expiresAt.Valid {
+		msg.ExpiresAt = expiresAt.Time
+	}
+	return msg, nil
+}
+
+func (s *sqlStore) get(ctx context.Context, q queryer, id int32) (Message, error) {
+	msg, err := scan(q.QueryRowContext(ctx, s.selectStmt, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrNotFound
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to select a message, %w", err)
+	}
+	return msg, nil
+}
+
+// inTx runs the function in a ReadCommitted transaction, the idempotency service does not support other levels
+func (s *sqlStore) inTx(ctx context.Context, function func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("can not begin a transaction %w", err)
+	}
+	if err := function(tx); err != nil {
+		if rbError := tx.Rollback(); rbError != nil {
+			return fmt.Errorf("tx rollback failed %s, operation failed %w", rbError, err)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("tx commit failed %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) Page(ctx context.Context, roomId int32, anchorId int32, direction Direction, limit int) ([]Message, error) {
+	var result []Message
+	var err error
+	switch {
+	case direction == Forward:
+		result, err = s.query(ctx, limit, s.forwardStmt, roomId, anchorId, limit)
+	case anchorId > 0:
+		result, err = s.query(ctx, limit, s.backwardStmt, roomId, anchorId, limit)
+	default:
+		result, err = s.query(ctx, limit, s.latestStmt, roomId, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Backward queries read the newest first
+	if direction == Backward {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	return result, nil
+}
+
+func (s *sqlStore) Since(ctx context.Context, roomId int32, afterSeq int32, limit int) ([]Message, error) {
+	return s.query(ctx, limit, s.sinceStmt, roomId, afterSeq, limit)
+}
+
+func (s *sqlStore) Replies(ctx context.Context, rootId int32, afterId int32, limit int) ([]Message, error) {
+	return s.query(ctx, limit, s.repliesStmt, rootId, afterId, limit)
+}
+
+func (s *sqlStore) Expire(ctx context.Context, now time.Time, limit int) ([]Message, error) {
+	return s.query(ctx, limit, s.expireStmt, now.UTC(), limit)
+}
+
+func (s *sqlStore) StartExpiry(ctx context.Context, ids []int32, now time.Time) ([]Message, error) {
+	result, err := s.query(ctx, len(ids), s.startStmt, pq.Array(ids), now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (s *sqlStore) Purge(ctx context.Context, roomId int32, before time.Time, limit int) ([]Message, error) {
+	return s.query(ctx, limit, s.purgeStmt, roomId, before.UTC(), limit)
+}
+
+func (s *sqlStore) LastRoomId(ctx context.Context) (int32, error) {
+	var result int32
+	if err := s.db.QueryRowContext(ctx, s.lastRoomStmt).Scan(&result); err != nil {
+		return 0, fmt.Errorf("failed to select the last room id, %w", err)
+	}
+	return result, nil
+}
+
+// query reads up to limit messages selected by the statement
+func (s *sqlStore) query(ctx context.Context, limit int, stmt string, args ...interface{}) ([]Message, error) {
+	rows, err := s.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select messages, %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]Message, 0, limit)
+	for rows.Next() {
+		msg, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process a message, %w", err)
+		}
+		result = append(result, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select messages, %w", err)
+	}
+	return result, nil
+}
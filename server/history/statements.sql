@@ -0,0 +1,47 @@
+CREATE TABLE message (
+  id serial primary key,
+  room_id integer not null,
+  -- Position of the message in the room, assigned from room_sequence. Replies are not numbered and have 0
+  seq integer not null,
+  -- Root message of the thread, 0 for a root message
+  parent_id integer not null default 0,
+  -- Replies of a root message, deleted ones included
+  reply_count integer not null default 0,
+  user_id integer not null,
+  -- Name of the author, user ids change with every session
+  user_name varchar(64) not null default '',
+  text text not null,
+  created_at timestamp not null,
+  edited_at timestamp,
+  -- Deleted messages are kept as tombstones with empty text and no attachments
+  deleted boolean not null default false,
+  attachment_ids text[],
+  -- Null if the message does not expire or expires after read and was not read yet
+  expires_at timestamp,
+  -- Non zero if the message expires this many seconds after it is first read
+  read_ttl_seconds integer not null default 0
+);
+
+CREATE INDEX message_room_id_idx ON message(room_id, id);
+CREATE UNIQUE INDEX message_room_seq_idx ON message(room_id, seq) WHERE parent_id = 0;
+CREATE INDEX message_parent_id_idx ON message(parent_id, id) WHERE parent_id <> 0;
+CREATE INDEX message_expires_at_idx ON message(expires_at) WHERE expires_at IS NOT NULL;
+
+-- Last sequence number of every room, see message.seq
+CREATE TABLE room_sequence (
+  room_id integer primary key,
+  seq integer not null
+);
+
+-- Request records of the idempotency.EmbeddedService, see PostRequest.client_id
+CREATE TABLE request_record (
+   id varchar(255) PRIMARY KEY,
+   result bytea,
+   created_at timestamp,
+   updated_at timestamp,
+   version integer,
+   locked_until timestamp
+);
+
+-- The request records of the expired and purged messages are removed with them, result is the message id
+CREATE INDEX request_record_result_idx ON request_record(result);
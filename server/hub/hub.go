@@ -0,0 +1,319 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+)
+
+/*
+	Broadcast fan-out. Every subscriber has a bounded buffer, the slow consumer policy decides what happens when
+	the buffer is full
+*/
+
+type Policy int8
+
+const (
+	// Drop the message for the slow subscriber, other subscribers are not affected
+	Drop Policy = iota
+	// Disconnect the slow subscriber
+	Disconnect
+	// Keep the messages of a full buffer in the order of publishing, they wait for room off the publisher goroutine.
+	// A subscriber that does not take a message within Config.BlockTimeout, or falls behind by another buffer, is
+	// disconnected
+	Block
+)
+
+var ErrSlowConsumer = errors.New("slow consumer")
+
+func (p Policy) String() string {
+	switch p {
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+func ParsePolicy(value string) (Policy, error) {
+	for _, p := range []Policy{Drop, Disconnect, Block} {
+		if p.String() == value {
+			return p, nil
+		}
+	}
+	return Drop, fmt.Errorf("unknown slow consumer policy %s", value)
+}
+
+type Config struct {
+	BufferSize   int
+	Policy       Policy
+	BlockTimeout time.Duration
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.BufferSize <= 0 {
+		validation = append(validation, "buffer size must be positive")
+	}
+	if config.Policy != Drop && config.Policy != Disconnect && config.Policy != Block {
+		validation = append(validation, "unknown policy")
+	}
+	if config.Policy == Block && config.BlockTimeout <= 0 {
+		validation = append(validation, "block timeout must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+// Filter selects the subscribers a message is delivered to
+type Filter func(s *Subscriber) bool
+
+type Hub struct {
+	// Messages not delivered to slow consumers, updated atomically. First to be 64-bit aligned
+	dropped uint64
+	config  Config
+
+	mtx         *sync.RWMutex
+	lastId      uint64
+	subscribers map[uint64]*Subscriber
+}
+
+type Subscriber struct {
+	id     uint64
+	UserId int32
+
+	messages  chan *api.PostResponse
+	done      chan struct{}
+	closeOnce *sync.Once
+	err       error
+
+	// Messages waiting for room in the buffer, Block policy only
+	pendingMtx *sync.Mutex
+	pending    []*api.PostResponse
+	// A goroutine moves the pending messages to the buffer
+	draining bool
+}
+
+func New(config Config) (*Hub, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Hub{
+		config:      config,
+		mtx:         new(sync.RWMutex),
+		subscribers: make(map[uint64]*Subscriber),
+	}, nil
+}
+
+// Subscribe registers a new subscriber. The subscriber must be released with Unsubscribe
+func (h *Hub) Subscribe(userId int32) *Subscriber {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.lastId++
+	s := &Subscriber{
+		id:         h.lastId,
+		UserId:     userId,
+		messages:   make(chan *api.PostResponse, h.config.BufferSize),
+		done:       make(chan struct{}),
+		closeOnce:  new(sync.Once),
+		pendingMtx: new(sync.Mutex),
+	}
+	h.subscribers[s.id] = s
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.mtx.Lock()
+	delete(h.subscribers, s.id)
+	h.mtx.Unlock()
+	s.close(nil)
+}
+
+// Size returns the number of subscribers
+func (h *Hub) Size() int {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return len(h.subscribers)
+}
+
+// Queued returns the number of messages waiting in the subscriber buffers
+func (h *Hub) Queued() int {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	result := 0
+	for _, s := range h.subscribers {
+		result += len(s.messages)
+		s.pendingMtx.Lock()
+		result += len(s.pending)
+		s.pendingMtx.Unlock()
+	}
+	return result
+}
+
+// Dropped returns the number of messages that were not delivered to slow consumers
+func (h *Hub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Publish delivers the message to every subscriber accepted by the filter except the sender.
+// Sender and filter may be nil
+func (h *Hub) Publish(sender *Subscriber, msg *api.PostResponse, filter Filter) {
+	h.mtx.RLock()
+	recipients := make([]*Subscriber, 0, len(h.subscribers))
+	for id, s := range h.subscribers {
+		if (sender == nil || id != sender.id) && (filter == nil || filter(s)) {
+			recipients = append(recipients, s)
+		}
+	}
+	h.mtx.RUnlock()
+
+	for _, s := range recipients {
+		h.deliver(s, msg)
+	}
+}
+
+func (h *Hub) deliver(s *Subscriber, msg *api.PostResponse) {
+	if h.config.Policy == Block {
+		h.enqueue(s, msg)
+		return
+	}
+	select {
+	case s.messages <- msg:
+		return
+	case <-s.done:
+		return
+	default:
+	}
+
+	// The buffer is full
+	switch h.config.Policy {
+	case Drop:
+		atomic.AddUint64(&h.dropped, 1)
+	case Disconnect:
+		atomic.AddUint64(&h.dropped, 1)
+		h.evict(s)
+	}
+}
+
+// enqueue buffers the message or queues it behind the pending ones, never blocks the publisher
+func (h *Hub) enqueue(s *Subscriber, msg *api.PostResponse) {
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+	if !s.draining {
+		select {
+		case s.messages <- msg:
+			return
+		case <-s.done:
+			return
+		default:
+		}
+	}
+	if len(s.pending) >= h.config.BufferSize {
+		atomic.AddUint64(&h.dropped, uint64(len(s.pending)+1))
+		s.pending = nil
+		h.evict(s)
+		return
+	}
+	s.pending = append(s.pending, msg)
+	if !s.draining {
+		s.draining = true
+		go h.drain(s)
+	}
+}
+
+// drain moves the pending messages to the buffer, the subscriber is evicted if it does not take one in time
+func (h *Hub) drain(s *Subscriber) {
+	for {
+		s.pendingMtx.Lock()
+		if len(s.pending) == 0 {
+			s.draining = false
+			s.pendingMtx.Unlock()
+			return
+		}
+		msg := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.pendingMtx.Unlock()
+
+		timer := time.NewTimer(h.config.BlockTimeout)
+		select {
+		case s.messages <- msg:
+			timer.Stop()
+		case <-s.done:
+			timer.Stop()
+			h.discard(s, 0)
+			return
+		case <-timer.C:
+			h.discard(s, 1)
+			h.evict(s)
+			return
+		}
+	}
+}
+
+// discard drops the pending messages of a closed subscriber, counting them and the extra ones as dropped
+func (h *Hub) discard(s *Subscriber, extra int) {
+	s.pendingMtx.Lock()
+	defer s.pendingMtx.Unlock()
+	atomic.AddUint64(&h.dropped, uint64(len(s.pending)+extra))
+	s.pending = nil
+	s.draining = false
+}
+
+// Close ends the subscriptions of the user with the error, e.g. when the session was ended by an operator. Returns
+// the number of the ended subscriptions
+func (h *Hub) Close(userId int32, err error) int {
+	h.mtx.Lock()
+	closed := make([]*Subscriber, 0)
+	for id, s := range h.subscribers {
+		if s.UserId == userId {
+			delete(h.subscribers, id)
+			closed = append(closed, s)
+		}
+	}
+	h.mtx.Unlock()
+
+	for _, s := range closed {
+		s.close(err)
+	}
+	return len(closed)
+}
+
+func (h *Hub) evict(s *Subscriber) {
+	h.mtx.Lock()
+	delete(h.subscribers, s.id)
+	h.mtx.Unlock()
+	s.close(ErrSlowConsumer)
+}
+
+// Messages returns the channel of messages to be delivered to the subscriber
+func (s *Subscriber) Messages() <-chan *api.PostResponse {
+	return s.messages
+}
+
+// Done is closed when the subscriber is unsubscribed or evicted
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns ErrSlowConsumer if the subscriber was evicted or the error of Close. Must be called after Done is closed
+func (s *Subscriber) Err() error {
+	return s.err
+}
+
+func (s *Subscriber) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
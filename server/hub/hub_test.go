@@ -0,0 +1,167 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+)
+
+func newTestHub(t *testing.T, policy Policy) *Hub {
+	h, err := New(Config{BufferSize: 1, Policy: policy, BlockTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create hub: %s", err)
+	}
+	return h
+}
+
+func TestConfigValidation(t *testing.T) {
+	if _, err := New(Config{BufferSize: 0}); err == nil {
+		t.Errorf("zero buffer size expected to be invalid")
+	}
+	if _, err := New(Config{BufferSize: 1, Policy: Block}); err == nil {
+		t.Errorf("block policy without timeout expected to be invalid")
+	}
+}
+
+func TestPublishSkipsSender(t *testing.T) {
+	h := newTestHub(t, Drop)
+	sender := h.Subscribe(1)
+	receiver := h.Subscribe(2)
+
+	h.Publish(sender, &api.PostResponse{Id: 1, UserId: 1, Text: "hello"}, nil)
+
+	select {
+	case msg := <-receiver.Messages():
+		if msg.Text != "hello" {
+			t.Errorf("unexpected message %v", msg)
+		}
+	default:
+		t.Errorf("receiver expected to get the message")
+	}
+	select {
+	case msg := <-sender.Messages():
+		t.Errorf("sender not expected to get the message, got %v", msg)
+	default:
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	h := newTestHub(t, Drop)
+	slow := h.Subscribe(1)
+	h.Publish(nil, &api.PostResponse{Id: 1}, nil)
+	h.Publish(nil, &api.PostResponse{Id: 2}, nil)
+
+	if h.Queued() != 1 || h.Dropped() != 1 {
+		t.Errorf("expected 1 queued and 1 dropped, actual %d %d", h.Queued(), h.Dropped())
+	}
+	if msg := <-slow.Messages(); msg.Id != 1 {
+		t.Errorf("expected message 1, actual %d", msg.Id)
+	}
+	select {
+	case <-slow.Done():
+		t.Errorf("slow subscriber not expected to be disconnected")
+	default:
+	}
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	h := newTestHub(t, Disconnect)
+	slow := h.Subscribe(1)
+	h.Publish(nil, &api.PostResponse{Id: 1}, nil)
+	h.Publish(nil, &api.PostResponse{Id: 2}, nil)
+
+	select {
+	case <-slow.Done():
+		if slow.Err() != ErrSlowConsumer {
+			t.Errorf("expected ErrSlowConsumer, actual %v", slow.Err())
+		}
+	default:
+		t.Errorf("slow subscriber expected to be disconnected")
+	}
+}
+
+func TestBlockPolicy(t *testing.T) {
+	h := newTestHub(t, Block)
+	s := h.Subscribe(1)
+	stalled := h.Subscribe(2)
+
+	// The publisher does not wait for the full buffers
+	start := time.Now()
+	for id := int32(1); id <= 2; id++ {
+		h.Publish(nil, &api.PostResponse{Id: id}, nil)
+	}
+	h.Publish(nil, &api.PostResponse{Id: 3}, func(subscriber *Subscriber) bool {
+		return subscriber == stalled
+	})
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("publisher blocked for %s", elapsed)
+	}
+	// Pending messages keep the order, the third one is over the limit of the stalled subscriber
+	for id := int32(1); id <= 2; id++ {
+		if msg := <-s.Messages(); msg.Id != id {
+			t.Errorf("expected message %d, actual %d", id, msg.Id)
+		}
+	}
+	select {
+	case <-stalled.Done():
+	case <-time.After(time.Second):
+		t.Errorf("stalled subscriber expected to be disconnected")
+	}
+
+	// The consumer does not take the pending message in time
+	h.Publish(nil, &api.PostResponse{Id: 4}, nil)
+	h.Publish(nil, &api.PostResponse{Id: 5}, nil)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Errorf("subscriber expected to be disconnected after the block timeout")
+	}
+}
+
+func TestPublishFilter(t *testing.T) {
+	h := newTestHub(t, Drop)
+	member := h.Subscribe(1)
+	stranger := h.Subscribe(2)
+
+	h.Publish(nil, &api.PostResponse{Id: 1}, func(s *Subscriber) bool {
+		return s.UserId == 1
+	})
+	if len(member.Messages()) != 1 {
+		t.Errorf("member expected to get the message")
+	}
+	if len(stranger.Messages()) != 0 {
+		t.Errorf("stranger not expected to get the message")
+	}
+}
+
+func TestCloseUser(t *testing.T) {
+	h := newTestHub(t, Drop)
+	first := h.Subscribe(1)
+	second := h.Subscribe(1)
+	other := h.Subscribe(2)
+	kicked := errors.New("kicked")
+
+	if closed := h.Close(1, kicked); closed != 2 {
+		t.Errorf("expected 2 closed subscribers, actual %d", closed)
+	}
+	for _, s := range []*Subscriber{first, second} {
+		select {
+		case <-s.Done():
+			if s.Err() != kicked {
+				t.Errorf("expected the close error, actual %v", s.Err())
+			}
+		default:
+			t.Errorf("subscriber expected to be closed")
+		}
+	}
+	select {
+	case <-other.Done():
+		t.Errorf("subscriber of another user not expected to be closed")
+	default:
+	}
+	if h.Size() != 1 {
+		t.Errorf("expected a single subscriber, actual %d", h.Size())
+	}
+}
@@ -0,0 +1,237 @@
+package inbox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Per user notification inbox. The inbox is keyed by the user name, case insensitive, the user ids change from
+	session to session. Notifications are kept in memory across the sessions of the user until the server restarts,
+	the oldest ones are dropped once the inbox is full. Watchers receive the new notifications of a user as they arrive
+*/
+
+type Kind int8
+
+const (
+	// The author mentioned the user as @name
+	Mention Kind = iota
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Mention:
+		return "mention"
+	default:
+		return "unknown"
+	}
+}
+
+type Notification struct {
+	Id int32
+	// Name of the recipient
+	UserName  string
+	Kind      Kind
+	RoomId    int32
+	MessageId int32
+	AuthorId  int32
+	Text      string
+	CreatedAt time.Time
+	Read      bool
+}
+
+type Config struct {
+	// Most notifications kept per user
+	MaxPerUser int
+	// Number of notifications buffered for every watcher
+	BufferSize int
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.MaxPerUser <= 0 {
+		validation = append(validation, "max notifications per user must be positive")
+	}
+	if config.BufferSize <= 0 {
+		validation = append(validation, "buffer size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Inbox struct {
+	config Config
+
+	mtx    *sync.Mutex
+	lastId int32
+	// Notifications of every user ordered by id, the key is the lower case user name
+	users         map[string][]Notification
+	lastWatcherId uint64
+	watchers      map[uint64]*Watcher
+}
+
+// Watcher receives the new notifications of a user
+type Watcher struct {
+	id  uint64
+	key string
+
+	notifications chan Notification
+	done          chan struct{}
+	closeOnce     *sync.Once
+}
+
+func NewInbox(config Config) (*Inbox, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Inbox{
+		config:   config,
+		mtx:      new(sync.Mutex),
+		users:    make(map[string][]Notification),
+		watchers: make(map[uint64]*Watcher),
+	}, nil
+}
+
+// Add stores the notification, assigns its id and creation time and delivers it to the watchers of the recipient
+func (in *Inbox) Add(n Notification) Notification {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	in.lastId++
+	n.Id = in.lastId
+	n.CreatedAt = time.Now()
+	n.Read = false
+	key := strings.ToLower(n.UserName)
+	notifications := append(in.users[key], n)
+	if len(notifications) > in.config.MaxPerUser {
+		notifications = notifications[len(notifications)-in.config.MaxPerUser:]
+	}
+	in.users[key] = notifications
+	in.publish(key, n)
+	return n
+}
+
+// List returns up to limit notifications of the user older than beforeId, newest first. Zero beforeId starts from the
+// newest notification
+func (in *Inbox) List(userName string, beforeId int32, unreadOnly bool, limit int) []Notification {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	notifications := in.users[strings.ToLower(userName)]
+	to := len(notifications)
+	if beforeId > 0 {
+		to = sort.Search(len(notifications), func(i int) bool {
+			return notifications[i].Id >= beforeId
+		})
+	}
+	result := make([]Notification, 0, limit)
+	for i := to - 1; i >= 0 && len(result) < limit; i-- {
+		if unreadOnly && notifications[i].Read {
+			continue
+		}
+		result = append(result, notifications[i])
+	}
+	return result
+}
+
+func (in *Inbox) Unread(userName string) int {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	return in.unread(strings.ToLower(userName))
+}
+
+// MarkRead marks the notifications of the user read, all of them if ids is empty. Unknown ids are ignored. Returns
+// the number of unread notifications
+func (in *Inbox) MarkRead(userName string, ids []int32) int {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	selected := make(map[int32]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	key := strings.ToLower(userName)
+	notifications := in.users[key]
+	for i := range notifications {
+		if len(ids) == 0 || selected[notifications[i].Id] {
+			notifications[i].Read = true
+		}
+	}
+	return in.unread(key)
+}
+
+// Watch registers a watcher of the user notifications. The watcher must be released with Unwatch
+func (in *Inbox) Watch(userName string) *Watcher {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	in.lastWatcherId++
+	w := &Watcher{
+		id:            in.lastWatcherId,
+		key:           strings.ToLower(userName),
+		notifications: make(chan Notification, in.config.BufferSize),
+		done:          make(chan struct{}),
+		closeOnce:     new(sync.Once),
+	}
+	in.watchers[w.id] = w
+	return w
+}
+
+func (in *Inbox) Unwatch(w *Watcher) {
+	in.mtx.Lock()
+	delete(in.watchers, w.id)
+	in.mtx.Unlock()
+	w.close()
+}
+
+// Watchers returns the number of the registered watchers
+func (in *Inbox) Watchers() int {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	return len(in.watchers)
+}
+
+// Notifications returns the channel of the new notifications
+func (w *Watcher) Notifications() <-chan Notification {
+	return w.notifications
+}
+
+// Done is closed when the watcher is released or falls behind
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *Watcher) close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+// unread must be called under the lock, the key is the lower case user name
+func (in *Inbox) unread(key string) int {
+	count := 0
+	for _, n := range in.users[key] {
+		if !n.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// publish delivers the notification to the watchers of the recipient, must be called under the lock. Watchers never
+// block the inbox
+func (in *Inbox) publish(key string, n Notification) {
+	for id, w := range in.watchers {
+		if w.key != key {
+			continue
+		}
+		select {
+		case w.notifications <- n:
+		default:
+			// The watcher fell behind, it has to list the notifications and watch again
+			delete(in.watchers, id)
+			w.close()
+		}
+	}
+}
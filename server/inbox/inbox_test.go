@@ -0,0 +1,82 @@
+package inbox
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newTestInbox(t *testing.T, maxPerUser int) *Inbox {
+	in, err := NewInbox(Config{MaxPerUser: maxPerUser, BufferSize: 1})
+	if err != nil {
+		t.Fatalf("failed to create inbox: %s", err)
+	}
+	return in
+}
+
+func ids(notifications []Notification) []int32 {
+	result := make([]int32, 0, len(notifications))
+	for _, n := range notifications {
+		result = append(result, n.Id)
+	}
+	return result
+}
+
+func TestParseMentions(t *testing.T) {
+	for text, expected := range map[string]string{
+		"hi @alice":              "[alice]",
+		"@Bob, @alice and @bob.": "[Bob alice]",
+		"mail john@example.com":  "[]",
+		"@jane_doe-2: @ @..":     "[jane_doe-2]",
+		"(@alice)":               "[alice]",
+		"no mentions":            "[]",
+		"@élodie":                "[élodie]",
+	} {
+		if actual := fmt.Sprint(ParseMentions(text)); actual != expected {
+			t.Errorf("[%s] expected %s, actual %s", text, expected, actual)
+		}
+	}
+}
+
+func TestListAndMarkRead(t *testing.T) {
+	in := newTestInbox(t, 3)
+	for i := 0; i < 4; i++ {
+		in.Add(Notification{UserName: "John", Text: "hello"})
+	}
+	in.Add(Notification{UserName: "Jane", Text: "other"})
+
+	// The oldest notification was dropped
+	if list := in.List("john", 0, false, 10); fmt.Sprint(ids(list)) != "[4 3 2]" {
+		t.Fatalf("unexpected notifications %v", ids(list))
+	}
+	if list := in.List("john", 4, false, 1); fmt.Sprint(ids(list)) != "[3]" {
+		t.Errorf("unexpected page %v", ids(list))
+	}
+	if unread := in.MarkRead("JOHN", []int32{3, 100}); unread != 2 {
+		t.Errorf("expected 2 unread, actual %d", unread)
+	}
+	if list := in.List("john", 0, true, 10); fmt.Sprint(ids(list)) != "[4 2]" {
+		t.Errorf("unexpected unread notifications %v", ids(list))
+	}
+	if unread := in.MarkRead("JOHN", nil); unread != 0 || in.Unread("jane") != 1 {
+		t.Errorf("expected all read, actual %d", unread)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	in := newTestInbox(t, 10)
+	w := in.Watch("john")
+	defer in.Unwatch(w)
+	in.Add(Notification{UserName: "Jane", Text: "other"})
+	in.Add(Notification{UserName: "John", Text: "first"})
+	if n := <-w.Notifications(); n.Text != "first" {
+		t.Errorf("expected the first notification, actual %v", n)
+	}
+	// The buffer holds one notification, the watcher falls behind
+	in.Add(Notification{UserName: "John", Text: "second"})
+	in.Add(Notification{UserName: "John", Text: "third"})
+	select {
+	case <-w.Done():
+	default:
+		t.Errorf("the watcher expected to be closed")
+	}
+}
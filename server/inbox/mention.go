@@ -0,0 +1,45 @@
+package inbox
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseMentions returns the names mentioned in the text as @name, in the order of appearance without duplicates.
+// Names consist of letters, digits and "_-." characters, users with other characters in the name can not be
+// mentioned. An @ inside a word, e.g. in an email address, is not a mention
+func ParseMentions(text string) []string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	previous := ' '
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r != '@' || isNameRune(previous) {
+			previous = r
+			i += size
+			continue
+		}
+		end := i + size
+		for end < len(text) {
+			next, nextSize := utf8.DecodeRuneInString(text[end:])
+			if !isNameRune(next) {
+				break
+			}
+			end += nextSize
+		}
+		// Punctuation after a name ends the sentence, it is not a part of the name
+		name := strings.TrimRight(text[i+size:end], ".-")
+		if key := strings.ToLower(name); name != "" && !seen[key] {
+			seen[key] = true
+			result = append(result, name)
+		}
+		previous = r
+		i = end
+	}
+	return result
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/iyarkov2/chat/core/tlsconfig"
+	"github.com/iyarkov2/chat/server/load"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var (
+	address     = flag.String("addr", "", "Chat server address, an in-process server is started if not set")
+	users       = flag.Int("users", 10, "Number of simulated users")
+	roomSize    = flag.Int("room-size", 10, "Users are split into rooms of this size")
+	rate        = flag.Float64("rate", 1, "Messages per second posted by every user")
+	messageSize = flag.Int("size", 32, "Length of the posted text")
+	duration    = flag.Duration("duration", 30*time.Second, "How long the users post")
+	drain       = flag.Duration("drain", 2*time.Second, "How long the messages in flight are waited for")
+	asJSON      = flag.Bool("json", false, "Print the report as JSON")
+	tlsFlags    = tlsconfig.RegisterClientFlags(flag.CommandLine)
+)
+
+// transportCredentials returns the credentials of the TLS options, see tlsconfig.RegisterClientFlags
+func transportCredentials() grpc.DialOption {
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalln("Failed to load certificates:", err)
+	}
+	if config == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config))
+}
+
+func main() {
+	flag.Parse()
+	dial := func(ctx context.Context) (*grpc.ClientConn, error) {
+		return grpc.DialContext(ctx, *address, transportCredentials())
+	}
+	if *address == "" {
+		server, err := load.StartInProcess(64)
+		if err != nil {
+			log.Fatalln("Failed to start the in-process server:", err)
+		}
+		defer server.Stop()
+		dial = server.Dial
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := load.Run(ctx, load.Config{
+		Dial:        dial,
+		Users:       *users,
+		RoomSize:    *roomSize,
+		Rate:        *rate,
+		MessageSize: *messageSize,
+		Duration:    *duration,
+		Drain:       *drain,
+	})
+	if err != nil {
+		log.Fatalln("Load failed:", err)
+	}
+	if !*asJSON {
+		fmt.Print(report)
+		return
+	}
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalln("Failed to encode the report:", err)
+	}
+	fmt.Println(string(encoded))
+}
@@ -0,0 +1,149 @@
+package load
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/block"
+	"github.com/iyarkov2/chat/server/chat"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/inbox"
+	"github.com/iyarkov2/chat/server/metrics"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/purge"
+	"github.com/iyarkov2/chat/server/ratelimit"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"github.com/iyarkov2/chat/server/thread"
+	"github.com/iyarkov2/chat/server/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// InProcess is a chat server with in-memory stores and without rate limits, reachable through an in-memory listener
+type InProcess struct {
+	listener *bufconn.Listener
+	server   *grpc.Server
+	tracker  *presence.Tracker
+	sweeper  *purge.Sweeper
+	blobDir  string
+}
+
+// StartInProcess starts the server, it must be stopped with Stop
+func StartInProcess(bufferSize int) (*InProcess, error) {
+	users, err := user.NewRegistry(user.NewMemoryStore())
+	if err != nil {
+		return nil, err
+	}
+	h, err := hub.New(hub.Config{BufferSize: bufferSize, Policy: hub.Drop})
+	if err != nil {
+		return nil, err
+	}
+	signer, err := auth.NewSigner([]byte("in-process load test token secret"), time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := ratelimit.New(ratelimit.Config{})
+	if err != nil {
+		return nil, err
+	}
+	blobDir, err := ioutil.TempDir("", "chat-load")
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := attachment.NewFileStore(blobDir)
+	if err != nil {
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	attachments, err := attachment.NewService(blobs, attachment.Config{MaxSize: 1024 * 1024, ChunkSize: 64 * 1024})
+	if err != nil {
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	notifications, err := inbox.NewInbox(inbox.Config{MaxPerUser: 100, BufferSize: bufferSize})
+	if err != nil {
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	rooms := room.NewRegistry()
+	messages := history.NewMemoryStore()
+	sweeper, err := purge.NewSweeper(messages, rooms, purge.Config{
+		Interval:  time.Second,
+		BatchSize: 1000,
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	tracker, err := presence.NewTracker(presence.Config{
+		Timeout:       time.Minute,
+		TypingTimeout: time.Second,
+		SweepInterval: time.Second,
+		BufferSize:    bufferSize,
+	})
+	if err != nil {
+		sweeper.Close()
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	s, err := chat.NewServer(chat.Config{
+		Users:       users,
+		Hub:         h,
+		Rooms:       rooms,
+		Messages:    messages,
+		Signer:      signer,
+		Presence:    tracker,
+		Limiter:     limiter,
+		Filters:     filter.NewChain(),
+		Search:      search.NewIndex(),
+		Attachments: attachments,
+		Metrics:     metrics.New(),
+		Threads:     thread.NewRegistry(),
+		Inbox:       notifications,
+		Sweeper:     sweeper,
+		Blocks:      block.NewRegistry(),
+		Bans:        user.NewBans(),
+	})
+	if err != nil {
+		tracker.Close()
+		sweeper.Close()
+		os.RemoveAll(blobDir)
+		return nil, err
+	}
+	p := &InProcess{
+		listener: bufconn.Listen(1024 * 1024),
+		server:   grpc.NewServer(s.ServerOptions()...),
+		tracker:  tracker,
+		sweeper:  sweeper,
+		blobDir:  blobDir,
+	}
+	api.RegisterChatServiceServer(p.server, s)
+	go p.server.Serve(p.listener)
+	return p, nil
+}
+
+// Dial opens a client connection, see Config.Dial
+func (p *InProcess) Dial(ctx context.Context) (*grpc.ClientConn, error) {
+	return grpc.DialContext(ctx, "in-process",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return p.listener.Dial()
+		}),
+		grpc.WithInsecure())
+}
+
+func (p *InProcess) Stop() {
+	p.server.Stop()
+	p.tracker.Close()
+	p.sweeper.Close()
+	os.RemoveAll(p.blobDir)
+}
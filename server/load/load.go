@@ -0,0 +1,401 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+	Load generator. Every simulated user connects, joins a room and posts at a fixed rate. The fan-out latency is the
+	time between PostRequest.ts of a message and its delivery to another member of the room
+*/
+
+type Config struct {
+	// Opens a connection of a simulated user
+	Dial  func(ctx context.Context) (*grpc.ClientConn, error)
+	Users int
+	// Users are split into rooms of this size
+	RoomSize int
+	// Messages per second posted by every user
+	Rate float64
+	// Length of the posted text
+	MessageSize int
+	// How long the users post
+	Duration time.Duration
+	// How long the messages in flight are waited for after the users stop posting
+	Drain time.Duration
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.Dial == nil {
+		validation = append(validation, "dial required")
+	}
+	if config.Users <= 0 {
+		validation = append(validation, "users must be positive")
+	}
+	if config.RoomSize <= 0 {
+		validation = append(validation, "room size must be positive")
+	}
+	if config.Rate <= 0 {
+		validation = append(validation, "rate must be positive")
+	}
+	if config.MessageSize < 0 {
+		validation = append(validation, "message size must not be negative")
+	}
+	if config.Duration <= 0 {
+		validation = append(validation, "duration must be positive")
+	}
+	if config.Drain < 0 {
+		validation = append(validation, "drain must not be negative")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Latency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type Report struct {
+	Users       int     `json:"users"`
+	DurationSec float64 `json:"duration_sec"`
+	Sent        int     `json:"sent"`
+	Delivered   int     `json:"delivered"`
+	// Messages per second
+	SentRate      float64 `json:"sent_rate"`
+	DeliveredRate float64 `json:"delivered_rate"`
+	// Fan-out latency in milliseconds
+	LatencyMs Latency `json:"latency_ms"`
+	// Error counts by kind, e.g. "connect" or "throttled"
+	Errors map[string]int `json:"errors"`
+	// The first error message of every kind
+	ErrorSamples map[string]string `json:"error_samples,omitempty"`
+}
+
+func (r Report) String() string {
+	result := new(strings.Builder)
+	fmt.Fprintf(result, "Users:      %d\n", r.Users)
+	fmt.Fprintf(result, "Duration:   %.1fs\n", r.DurationSec)
+	fmt.Fprintf(result, "Sent:       %d (%.1f/s)\n", r.Sent, r.SentRate)
+	fmt.Fprintf(result, "Delivered:  %d (%.1f/s)\n", r.Delivered, r.DeliveredRate)
+	fmt.Fprintf(result, "Latency ms: p50 %.2f, p95 %.2f, p99 %.2f, max %.2f\n", r.LatencyMs.P50, r.LatencyMs.P95, r.LatencyMs.P99, r.LatencyMs.Max)
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	errorCounts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		if sample, ok := r.ErrorSamples[kind]; ok {
+			errorCounts = append(errorCounts, fmt.Sprintf("%s %d (%s)", kind, r.Errors[kind], sample))
+		} else {
+			errorCounts = append(errorCounts, fmt.Sprintf("%s %d", kind, r.Errors[kind]))
+		}
+	}
+	if len(errorCounts) == 0 {
+		errorCounts = append(errorCounts, "none")
+	}
+	fmt.Fprintf(result, "Errors:     %s\n", strings.Join(errorCounts, ", "))
+	return result.String()
+}
+
+// Run simulates the users until the duration elapses or the context is cancelled
+func Run(ctx context.Context, config Config) (Report, error) {
+	if err := config.validate(); err != nil {
+		return Report{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := newCollector()
+
+	// Every user connects and joins its room before anyone posts
+	users := make([]*simulatedUser, config.Users)
+	roomIds := make(map[int]int32)
+	for i := range users {
+		u, err := connect(ctx, config, i, c)
+		if err != nil {
+			c.failed("connect", err)
+			continue
+		}
+		defer u.conn.Close()
+		room := i / config.RoomSize
+		if roomIds[room], err = u.join(ctx, room, roomIds[room]); err != nil {
+			c.failed("join", err)
+			continue
+		}
+		users[i] = u
+	}
+
+	start := time.Now()
+	postCtx, stopPosting := context.WithTimeout(ctx, config.Duration)
+	defer stopPosting()
+	receivers := new(sync.WaitGroup)
+	senders := new(sync.WaitGroup)
+	for _, u := range users {
+		if u == nil {
+			continue
+		}
+		receivers.Add(1)
+		go u.receive(receivers)
+		senders.Add(1)
+		go u.post(postCtx, senders, config)
+	}
+	senders.Wait()
+	elapsed := time.Since(start)
+
+	select {
+	case <-time.After(config.Drain):
+	case <-ctx.Done():
+	}
+	for _, u := range users {
+		if u != nil {
+			u.stream.CloseSend()
+		}
+	}
+	cancel()
+	receivers.Wait()
+	return c.report(config.Users, elapsed), nil
+}
+
+type simulatedUser struct {
+	index     int
+	id        int32
+	token     string
+	roomId    int32
+	conn      *grpc.ClientConn
+	client    api.ChatServiceClient
+	ctx       context.Context
+	stream    api.ChatService_PostClient
+	collector *collector
+}
+
+func connect(ctx context.Context, config Config, index int, c *collector) (*simulatedUser, error) {
+	conn, err := config.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := api.NewChatServiceClient(conn)
+	response, err := client.Connect(ctx, &api.ConnectRequest{Name: fmt.Sprintf("load-%d-%d", time.Now().UnixNano(), index)})
+	if err == nil && response.Status != api.ConnectResponse_SUCCESS {
+		err = fmt.Errorf("connect failed: %s", response.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u := &simulatedUser{
+		index:     index,
+		id:        response.UserId,
+		token:     response.Token,
+		conn:      conn,
+		client:    client,
+		collector: c,
+	}
+	// The stream outlives the setup context, Run closes the connection
+	u.ctx = auth.AppendToken(context.Background(), response.Token)
+	if u.stream, err = client.Post(u.ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// join creates the room if the id is 0, returns the room id
+func (u *simulatedUser) join(ctx context.Context, room int, roomId int32) (int32, error) {
+	ctx = auth.AppendToken(ctx, u.token)
+	if roomId == 0 {
+		response, err := u.client.CreateRoom(ctx, &api.CreateRoomRequest{Name: fmt.Sprintf("load-%d-%d", time.Now().UnixNano(), room)})
+		if err != nil {
+			return 0, err
+		}
+		if response.Status != api.CreateRoomResponse_SUCCESS {
+			return 0, fmt.Errorf("create room failed: %s", response.Status)
+		}
+		u.roomId = response.Room.Id
+		return u.roomId, nil
+	}
+	if _, err := u.client.JoinRoom(ctx, &api.JoinRoomRequest{RoomId: roomId}); err != nil {
+		return 0, err
+	}
+	u.roomId = roomId
+	return roomId, nil
+}
+
+func (u *simulatedUser) post(ctx context.Context, done *sync.WaitGroup, config Config) {
+	defer done.Done()
+	text := strings.Repeat("x", config.MessageSize)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.Rate))
+	defer ticker.Stop()
+	var clientId int32
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			clientId++
+			ts := timestamppb.Now()
+			u.collector.sent(u.index, clientId, ts.AsTime())
+			if err := u.stream.Send(&api.PostRequest{ClientId: clientId, Text: text, RoomId: u.roomId, Ts: ts}); err != nil {
+				u.collector.failed("send", err)
+				return
+			}
+		}
+	}
+}
+
+func (u *simulatedUser) receive(done *sync.WaitGroup) {
+	defer done.Done()
+	for {
+		msg, err := u.stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			u.collector.failed("stream", err)
+			return
+		}
+		now := time.Now()
+		switch {
+		case msg.Event == api.PostResponse_THROTTLED:
+			u.collector.failed("throttled", nil)
+		case msg.Event == api.PostResponse_REJECTED:
+			u.collector.failed("rejected", nil)
+		case msg.Event != api.PostResponse_POSTED:
+		case msg.UserId == u.id && msg.ClientId != 0:
+			u.collector.acked(u.index, msg.ClientId, msg.Id)
+		default:
+			u.collector.received(msg.Id, now)
+		}
+	}
+}
+
+// collector gathers the measurements of all users
+type collector struct {
+	mtx *sync.Mutex
+	// Send time by user index and client id
+	sentAt map[[2]int32]time.Time
+	// Send time by message id, known once the message is acknowledged
+	messageSentAt map[int32]time.Time
+	receipts      []receipt
+	errors        map[string]int
+	// The first error message of every kind
+	samples map[string]string
+}
+
+type receipt struct {
+	messageId int32
+	at        time.Time
+}
+
+func newCollector() *collector {
+	return &collector{
+		mtx:           new(sync.Mutex),
+		sentAt:        make(map[[2]int32]time.Time),
+		messageSentAt: make(map[int32]time.Time),
+		receipts:      make([]receipt, 0),
+		errors:        make(map[string]int),
+		samples:       make(map[string]string),
+	}
+}
+
+func (c *collector) sent(index int, clientId int32, at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.sentAt[[2]int32{int32(index), clientId}] = at
+}
+
+func (c *collector) acked(index int, clientId int32, messageId int32) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := [2]int32{int32(index), clientId}
+	if at, ok := c.sentAt[key]; ok {
+		c.messageSentAt[messageId] = at
+	}
+}
+
+// received may be called before the message is acknowledged, the latency is calculated in the report
+func (c *collector) received(messageId int32, at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.receipts = append(c.receipts, receipt{messageId: messageId, at: at})
+}
+
+func (c *collector) failed(kind string, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.errors[kind]++
+	if _, ok := c.samples[kind]; !ok && err != nil {
+		if s, ok := status.FromError(err); ok {
+			c.samples[kind] = s.Message()
+		} else {
+			c.samples[kind] = err.Error()
+		}
+	}
+}
+
+func (c *collector) report(users int, elapsed time.Duration) Report {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	latencies := make([]float64, 0, len(c.receipts))
+	for _, r := range c.receipts {
+		if at, ok := c.messageSentAt[r.messageId]; ok {
+			latencies = append(latencies, float64(r.at.Sub(at))/float64(time.Millisecond))
+		}
+	}
+	sort.Float64s(latencies)
+	errorCounts := make(map[string]int, len(c.errors))
+	for kind, count := range c.errors {
+		errorCounts[kind] = count
+	}
+	samples := make(map[string]string, len(c.samples))
+	for kind, message := range c.samples {
+		samples[kind] = message
+	}
+	seconds := elapsed.Seconds()
+	return Report{
+		Users:         users,
+		DurationSec:   seconds,
+		Sent:          len(c.sentAt),
+		Delivered:     len(c.receipts),
+		SentRate:      float64(len(c.sentAt)) / seconds,
+		DeliveredRate: float64(len(c.receipts)) / seconds,
+		LatencyMs: Latency{
+			P50: percentile(latencies, 0.50),
+			P95: percentile(latencies, 0.95),
+			P99: percentile(latencies, 0.99),
+			Max: percentile(latencies, 1),
+		},
+		Errors:       errorCounts,
+		ErrorSamples: samples,
+	}
+}
+
+// percentile of the sorted values, nearest rank
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,61 @@
+package load
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunInProcess(t *testing.T) {
+	server, err := StartInProcess(64)
+	if err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer server.Stop()
+
+	report, err := Run(context.Background(), Config{
+		Dial:        server.Dial,
+		Users:       4,
+		RoomSize:    2,
+		Rate:        50,
+		MessageSize: 16,
+		Duration:    300 * time.Millisecond,
+		Drain:       200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("run failed: %s", err)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("unexpected errors %v %v", report.Errors, report.ErrorSamples)
+	}
+	// Every message has one more room member to be delivered to
+	if report.Sent == 0 || report.Delivered != report.Sent {
+		t.Errorf("expected every sent message delivered, actual %d of %d", report.Delivered, report.Sent)
+	}
+	if report.LatencyMs.P50 <= 0 || report.LatencyMs.P50 > report.LatencyMs.P99 {
+		t.Errorf("unexpected latency %v", report.LatencyMs)
+	}
+	if !strings.Contains(report.String(), "Errors:     none") {
+		t.Errorf("unexpected text report\n%s", report)
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("failed to encode report: %s", err)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, test := range []struct {
+		p        float64
+		expected float64
+	}{{0.5, 5}, {0.95, 10}, {0.1, 1}, {1, 10}} {
+		if actual := percentile(values, test.p); actual != test.expected {
+			t.Errorf("p%v expected %v, actual %v", test.p, test.expected, actual)
+		}
+	}
+	if percentile(nil, 0.5) != 0 {
+		t.Errorf("expected 0 without values")
+	}
+}
@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Prometheus metrics of the gRPC layer and the chat server, served by Handler. Every Metrics has its own registry
+*/
+
+const (
+	namespace = "chat"
+	// Rooms are labeled one by one up to the limit, the messages of the rooms over it are counted under otherRooms
+	maxRoomLabels = 1000
+	otherRooms    = "other"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	rpcStarted  *prometheus.CounterVec
+	rpcHandled  *prometheus.CounterVec
+	rpcDuration *prometheus.HistogramVec
+
+	streams  prometheus.Gauge
+	users    prometheus.Gauge
+	messages *prometheus.CounterVec
+
+	mtx      *sync.Mutex
+	maxRooms int
+	rooms    map[int32]bool
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rpcStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_started_total",
+			Help:      "RPCs started on the server",
+		}, []string{"service", "method", "type"}),
+		rpcHandled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_handled_total",
+			Help:      "RPCs completed on the server, by status code",
+		}, []string{"service", "method", "type", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "RPC latency, streams are measured from open to close",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "method", "type"}),
+		streams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "post_streams",
+			Help:      "Open Post streams",
+		}),
+		users: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_users",
+			Help:      "Connected users",
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_total",
+			Help:      "Messages posted, by room id",
+		}, []string{"room"}),
+		mtx:      new(sync.Mutex),
+		maxRooms: maxRoomLabels,
+		rooms:    make(map[int32]bool),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.rpcStarted, m.rpcHandled, m.rpcDuration, m.streams, m.users, m.messages)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ServerOptions returns the interceptors, they must be installed before the others to see every RPC
+func (m *Metrics) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(m.unaryServerInterceptor),
+		grpc.ChainStreamInterceptor(m.streamServerInterceptor),
+	}
+}
+
+func (m *Metrics) StreamOpened() {
+	m.streams.Inc()
+}
+
+func (m *Metrics) StreamClosed() {
+	m.streams.Dec()
+}
+
+func (m *Metrics) UserConnected() {
+	m.users.Inc()
+}
+
+func (m *Metrics) UserDisconnected() {
+	m.users.Dec()
+}
+
+func (m *Metrics) Posted(roomId int32) {
+	m.messages.WithLabelValues(m.roomLabel(roomId)).Inc()
+}
+
+// roomLabel returns the label of the room, every room would be a series of its own without the limit
+func (m *Metrics) roomLabel(roomId int32) string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.rooms[roomId] {
+		if len(m.rooms) >= m.maxRooms {
+			return otherRooms
+		}
+		m.rooms[roomId] = true
+	}
+	return strconv.Itoa(int(roomId))
+}
+
+// RegisterQueue exports the depth and the dropped messages of a delivery queue, e.g. the hub. The functions are
+// called on every scrape
+func (m *Metrics) RegisterQueue(name string, depth func() int, dropped func() uint64) error {
+	labels := prometheus.Labels{"queue": name}
+	depthGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Messages waiting to be delivered",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(depth())
+	})
+	if err := m.registry.Register(depthGauge); err != nil {
+		return err
+	}
+	droppedCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Name:        "dropped_messages_total",
+		Help:        "Messages that were not delivered",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(dropped())
+	})
+	if err := m.registry.Register(droppedCounter); err != nil {
+		m.registry.Unregister(depthGauge)
+		return err
+	}
+	return nil
+}
+
+func (m *Metrics) unaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	done := m.started(info.FullMethod, "unary")
+	result, err := handler(ctx, req)
+	done(err)
+	return result, err
+}
+
+func (m *Metrics) streamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	done := m.started(info.FullMethod, streamType(info))
+	err := handler(srv, ss)
+	done(err)
+	return err
+}
+
+// started counts the RPC, the returned function records its completion
+func (m *Metrics) started(fullMethod string, rpcType string) func(err error) {
+	service, method := splitMethod(fullMethod)
+	m.rpcStarted.WithLabelValues(service, method, rpcType).Inc()
+	start := time.Now()
+	return func(err error) {
+		m.rpcHandled.WithLabelValues(service, method, rpcType, status.Code(err).String()).Inc()
+		m.rpcDuration.WithLabelValues(service, method, rpcType).Observe(time.Since(start).Seconds())
+	}
+}
+
+func streamType(info *grpc.StreamServerInfo) string {
+	switch {
+	case info.IsClientStream && info.IsServerStream:
+		return "bidi_stream"
+	case info.IsClientStream:
+		return "client_stream"
+	default:
+		return "server_stream"
+	}
+}
+
+// splitMethod splits "/package.Service/Method"
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.Index(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
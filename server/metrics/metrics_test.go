@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	m := New()
+	info := &grpc.UnaryServerInfo{FullMethod: "/iyarkov2.chat.api.ChatService/JoinRoom"}
+	for _, err := range []error{nil, status.Error(codes.NotFound, "no room"), nil} {
+		_, actual := m.unaryServerInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		})
+		if actual != err {
+			t.Errorf("expected %v, actual %v", err, actual)
+		}
+	}
+	service := "iyarkov2.chat.api.ChatService"
+	if count := testutil.ToFloat64(m.rpcStarted.WithLabelValues(service, "JoinRoom", "unary")); count != 3 {
+		t.Errorf("expected 3 started, actual %v", count)
+	}
+	if count := testutil.ToFloat64(m.rpcHandled.WithLabelValues(service, "JoinRoom", "unary", "OK")); count != 2 {
+		t.Errorf("expected 2 OK, actual %v", count)
+	}
+	if count := testutil.ToFloat64(m.rpcHandled.WithLabelValues(service, "JoinRoom", "unary", "NotFound")); count != 1 {
+		t.Errorf("expected 1 NotFound, actual %v", count)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	info := &grpc.StreamServerInfo{FullMethod: "/iyarkov2.chat.api.ChatService/Post", IsClientStream: true, IsServerStream: true}
+	if err := m.streamServerInterceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+		m.StreamOpened()
+		m.Posted(1)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := m.RegisterQueue("hub", func() int { return 5 }, func() uint64 { return 2 }); err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+	if err := m.RegisterQueue("hub", func() int { return 0 }, func() uint64 { return 0 }); err == nil {
+		t.Errorf("expected duplicate queue to fail")
+	}
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`chat_rpc_handled_total{code="OK",method="Post",service="iyarkov2.chat.api.ChatService",type="bidi_stream"} 1`,
+		`chat_rpc_duration_seconds_count{method="Post",service="iyarkov2.chat.api.ChatService",type="bidi_stream"} 1`,
+		`chat_post_streams 1`,
+		`chat_messages_total{room="1"} 1`,
+		`chat_queue_depth{queue="hub"} 5`,
+		`chat_dropped_messages_total{queue="hub"} 2`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected [%s] in\n%s", expected, body)
+		}
+	}
+}
+
+func TestRoomLabelsLimited(t *testing.T) {
+	m := New()
+	m.maxRooms = 2
+	for _, roomId := range []int32{1, 2, 3, 1, 4} {
+		m.Posted(roomId)
+	}
+	for label, expected := range map[string]float64{"1": 2, "2": 1, otherRooms: 2} {
+		if count := testutil.ToFloat64(m.messages.WithLabelValues(label)); count != expected {
+			t.Errorf("expected %v messages of room %s, actual %v", expected, label, count)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package presence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+	Presence tracking. A user is online while it has an open Post stream or sends heartbeats, away if the last heartbeat
+	says so and offline otherwise. Typing indicators come with heartbeats and expire after Config.TypingTimeout
+*/
+
+type State int8
+
+const (
+	Offline State = iota
+	Online
+	Away
+)
+
+func (s State) String() string {
+	switch s {
+	case Offline:
+		return "offline"
+	case Online:
+		return "online"
+	case Away:
+		return "away"
+	default:
+		return "unknown"
+	}
+}
+
+type Status struct {
+	UserId int32
+	State  State
+	// Room the user is typing in, 0 if not typing
+	TypingRoomId int32
+	UpdatedAt    time.Time
+}
+
+type Config struct {
+	// Heartbeats older than the timeout are ignored
+	Timeout time.Duration
+	// How long a typing indicator lasts without a new heartbeat
+	TypingTimeout time.Duration
+	// How often expired heartbeats and typing indicators are checked
+	SweepInterval time.Duration
+	// Number of events buffered for every watcher
+	BufferSize int
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.Timeout <= 0 {
+		validation = append(validation, "timeout must be positive")
+	}
+	if config.TypingTimeout <= 0 {
+		validation = append(validation, "typing timeout must be positive")
+	}
+	if config.SweepInterval <= 0 {
+		validation = append(validation, "sweep interval must be positive")
+	}
+	if config.BufferSize <= 0 {
+		validation = append(validation, "buffer size must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Tracker struct {
+	config Config
+
+	mtx      *sync.Mutex
+	users    map[int32]*entry
+	lastId   uint64
+	watchers map[uint64]*Watcher
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type entry struct {
+	streams        int
+	heartbeatState State
+	heartbeatAt    time.Time
+	typingRoomId   int32
+	typingUntil    time.Time
+	// The status watchers were told about
+	published Status
+}
+
+// Watcher receives the status changes of the users accepted by its filter
+type Watcher struct {
+	id     uint64
+	filter func(userId int32) bool
+
+	events    chan Status
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewTracker creates a tracker and starts the sweeper, the tracker must be released with Close
+func NewTracker(config Config) (*Tracker, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	t := &Tracker{
+		config:   config,
+		mtx:      new(sync.Mutex),
+		users:    make(map[int32]*entry),
+		watchers: make(map[uint64]*Watcher),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.sweep()
+	return t, nil
+}
+
+func (t *Tracker) Close() {
+	close(t.stop)
+	<-t.done
+}
+
+// Timeout returns how often heartbeats must be sent to keep the user online
+func (t *Tracker) Timeout() time.Duration {
+	return t.config.Timeout
+}
+
+// Connected counts as a heartbeat
+func (t *Tracker) Connected(userId int32) {
+	t.update(userId, func(e *entry, now time.Time) {
+		e.heartbeatState = Online
+		e.heartbeatAt = now
+	})
+}
+
+func (t *Tracker) Disconnected(userId int32) {
+	t.mtx.Lock()
+	e, ok := t.users[userId]
+	if !ok {
+		t.mtx.Unlock()
+		return
+	}
+	delete(t.users, userId)
+	if e.published.State != Offline {
+		t.publish(Status{UserId: userId, State: Offline, UpdatedAt: time.Now()})
+	}
+	t.mtx.Unlock()
+}
+
+func (t *Tracker) StreamOpened(userId int32) {
+	t.update(userId, func(e *entry, now time.Time) {
+		e.streams++
+	})
+}
+
+func (t *Tracker) StreamClosed(userId int32) {
+	t.update(userId, func(e *entry, now time.Time) {
+		if e.streams > 0 {
+			e.streams--
+		}
+	})
+}
+
+// Heartbeat sets the user state, Online or Away, and the room the user is typing in, 0 if not typing
+func (t *Tracker) Heartbeat(userId int32, state State, typingRoomId int32) {
+	t.update(userId, func(e *entry, now time.Time) {
+		e.heartbeatState = state
+		e.heartbeatAt = now
+		e.typingRoomId = typingRoomId
+		e.typingUntil = now.Add(t.config.TypingTimeout)
+	})
+}
+
+// Posted clears the typing indicator of the room
+func (t *Tracker) Posted(userId int32, roomId int32) {
+	t.update(userId, func(e *entry, now time.Time) {
+		if e.typingRoomId == roomId {
+			e.typingRoomId = 0
+		}
+	})
+}
+
+func (t *Tracker) Get(userId int32) Status {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if e, ok := t.users[userId]; ok {
+		return e.published
+	}
+	return Status{UserId: userId, State: Offline}
+}
+
+// Watch registers a watcher of the users accepted by the filter. The watcher must be released with Unwatch
+func (t *Tracker) Watch(filter func(userId int32) bool) *Watcher {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.lastId++
+	w := &Watcher{
+		id:        t.lastId,
+		filter:    filter,
+		events:    make(chan Status, t.config.BufferSize),
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	t.watchers[w.id] = w
+	return w
+}
+
+func (t *Tracker) Unwatch(w *Watcher) {
+	t.mtx.Lock()
+	delete(t.watchers, w.id)
+	t.mtx.Unlock()
+	w.close()
+}
+
+// Events returns the channel of status changes
+func (w *Watcher) Events() <-chan Status {
+	return w.events
+}
+
+// Done is closed when the watcher is released or falls behind
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *Watcher) close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (t *Tracker) update(userId int32, change func(e *entry, now time.Time)) {
+	t.mtx.Lock()
+	now := time.Now()
+	e, ok := t.users[userId]
+	if !ok {
+		e = &entry{published: Status{UserId: userId, State: Offline}}
+		t.users[userId] = e
+	}
+	change(e, now)
+	t.refresh(userId, e, now)
+	t.mtx.Unlock()
+}
+
+// refresh recalculates the user status and publishes the change, must be called under the lock
+func (t *Tracker) refresh(userId int32, e *entry, now time.Time) {
+	heartbeatAlive := now.Sub(e.heartbeatAt) < t.config.Timeout
+	status := Status{UserId: userId, State: Offline, UpdatedAt: now}
+	switch {
+	case heartbeatAlive && e.heartbeatState == Away:
+		status.State = Away
+	case heartbeatAlive || e.streams > 0:
+		status.State = Online
+	}
+	if status.State != Offline && e.typingRoomId != 0 && now.Before(e.typingUntil) {
+		status.TypingRoomId = e.typingRoomId
+	}
+	if status.State == Offline && e.streams == 0 {
+		// Nothing to remember about an offline user
+		delete(t.users, userId)
+	}
+	if status.State == e.published.State && status.TypingRoomId == e.published.TypingRoomId {
+		return
+	}
+	e.published = status
+	t.publish(status)
+}
+
+// publish delivers the status change to the watchers, must be called under the lock. Watchers never block the tracker
+func (t *Tracker) publish(status Status) {
+	for id, w := range t.watchers {
+		if !w.filter(status.UserId) {
+			continue
+		}
+		select {
+		case w.events <- status:
+		default:
+			// The watcher fell behind, it has to watch again and read the current state
+			delete(t.watchers, id)
+			w.close()
+		}
+	}
+}
+
+func (t *Tracker) sweep() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.mtx.Lock()
+			for userId, e := range t.users {
+				t.refresh(userId, e, now)
+			}
+			t.mtx.Unlock()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTracker(t *testing.T, timeout time.Duration) *Tracker {
+	tracker, err := NewTracker(Config{
+		Timeout:       timeout,
+		TypingTimeout: timeout,
+		SweepInterval: 5 * time.Millisecond,
+		BufferSize:    16,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracker: %s", err)
+	}
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+func expectEvent(t *testing.T, w *Watcher, state State, typingRoomId int32) {
+	select {
+	case event := <-w.Events():
+		if event.State != state || event.TypingRoomId != typingRoomId {
+			t.Errorf("expected %s typing in %d, actual %s typing in %d", state, typingRoomId, event.State, event.TypingRoomId)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected %s event", state)
+	}
+}
+
+func TestStreamLifecycle(t *testing.T) {
+	tracker := newTestTracker(t, time.Minute)
+	w := tracker.Watch(func(userId int32) bool {
+		return true
+	})
+	defer tracker.Unwatch(w)
+
+	tracker.StreamOpened(1)
+	expectEvent(t, w, Online, 0)
+	tracker.StreamClosed(1)
+	expectEvent(t, w, Offline, 0)
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	tracker := newTestTracker(t, 50*time.Millisecond)
+	w := tracker.Watch(func(userId int32) bool {
+		return true
+	})
+	defer tracker.Unwatch(w)
+
+	tracker.Heartbeat(1, Away, 7)
+	expectEvent(t, w, Away, 7)
+	// Both the heartbeat and the typing indicator expire
+	expectEvent(t, w, Offline, 0)
+}
+
+func TestTypingClearedByPost(t *testing.T) {
+	tracker := newTestTracker(t, time.Minute)
+	w := tracker.Watch(func(userId int32) bool {
+		return true
+	})
+	defer tracker.Unwatch(w)
+
+	tracker.Heartbeat(1, Online, 7)
+	expectEvent(t, w, Online, 7)
+	tracker.Posted(1, 7)
+	expectEvent(t, w, Online, 0)
+	tracker.Disconnected(1)
+	expectEvent(t, w, Offline, 0)
+}
+
+func TestWatcherFilter(t *testing.T) {
+	tracker := newTestTracker(t, time.Minute)
+	w := tracker.Watch(func(userId int32) bool {
+		return userId == 2
+	})
+	defer tracker.Unwatch(w)
+
+	tracker.Connected(1)
+	tracker.Connected(2)
+	select {
+	case event := <-w.Events():
+		if event.UserId != 2 {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an event")
+	}
+}
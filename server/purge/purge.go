@@ -0,0 +1,141 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/room"
+)
+
+/*
+	Periodic removal of the expired messages and the messages out of the room retention. Every sweep removes up to
+	Config.BatchSize messages of each kind, a backlog is worked off by the following sweeps. The removed messages are
+	published on the Sweeper.Removed channel, the chat server broadcasts the tombstones
+*/
+
+type Config struct {
+	// How often the messages are checked
+	Interval time.Duration
+	// Most messages removed by one store call
+	BatchSize int
+	// How long a sweep may take
+	Timeout time.Duration
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	if config.Interval <= 0 {
+		validation = append(validation, "interval must be positive")
+	}
+	if config.BatchSize <= 0 {
+		validation = append(validation, "batch size must be positive")
+	}
+	if config.Timeout <= 0 {
+		validation = append(validation, "timeout must be positive")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Sweeper struct {
+	config   Config
+	messages history.MessageStore
+	rooms    *room.Registry
+
+	removed chan history.Message
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewSweeper creates a sweeper and starts it, the sweeper must be released with Close
+func NewSweeper(messages history.MessageStore, rooms *room.Registry, config Config) (*Sweeper, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		return nil, errors.New("message store must not be nil")
+	}
+	if rooms == nil {
+		return nil, errors.New("room registry must not be nil")
+	}
+	s := &Sweeper{
+		config:   config,
+		messages: messages,
+		rooms:    rooms,
+		removed:  make(chan history.Message, config.BatchSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Removed returns the channel of the removed messages, it is closed by Close. The sweeper waits for the messages to be
+// read
+func (s *Sweeper) Removed() <-chan history.Message {
+	return s.removed
+}
+
+func (s *Sweeper) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+	defer close(s.removed)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if !s.sweep(now) {
+				return
+			}
+		}
+	}
+}
+
+// sweep removes a batch of the expired messages and of the messages of every room with retention. Returns false if
+// the sweeper was closed
+func (s *Sweeper) sweep(now time.Time) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	expired, err := s.messages.Expire(ctx, now, s.config.BatchSize)
+	if err != nil {
+		log.Printf("Failed to remove expired messages: %s", err)
+	}
+	if !s.publish(expired) {
+		return false
+	}
+	for roomId, retention := range s.rooms.Retentions() {
+		purged, err := s.messages.Purge(ctx, roomId, now.Add(-retention), s.config.BatchSize)
+		if err != nil {
+			log.Printf("Failed to purge messages of room %d: %s", roomId, err)
+			continue
+		}
+		if !s.publish(purged) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Sweeper) publish(messages []history.Message) bool {
+	for _, msg := range messages {
+		select {
+		case s.removed <- msg:
+		case <-s.stop:
+			return false
+		}
+	}
+	return true
+}
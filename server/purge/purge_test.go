@@ -0,0 +1,62 @@
+package purge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/room"
+)
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	messages := history.NewMemoryStore()
+	rooms := room.NewRegistry()
+	kept, err := rooms.Create("kept", 1, "John")
+	if err != nil {
+		t.Fatalf("create failed: %s", err)
+	}
+	purged, err := rooms.Create("purged", 1, "John")
+	if err != nil {
+		t.Fatalf("create failed: %s", err)
+	}
+	if _, err := rooms.SetRetention(purged.Id, time.Millisecond); err != nil {
+		t.Fatalf("set retention failed: %s", err)
+	}
+	inserts := []history.Message{
+		{RoomId: kept.Id, Text: "kept"},
+		{RoomId: kept.Id, Text: "expired", ExpiresAt: time.Now()},
+		{RoomId: purged.Id, Text: "purged"},
+	}
+	for _, msg := range inserts {
+		if _, err := messages.Insert(ctx, msg); err != nil {
+			t.Fatalf("insert failed: %s", err)
+		}
+	}
+
+	sweeper, err := NewSweeper(messages, rooms, Config{Interval: 5 * time.Millisecond, BatchSize: 10, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("failed to create sweeper: %s", err)
+	}
+	removed := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(removed) < 2 {
+		select {
+		case msg := <-sweeper.Removed():
+			removed[msg.Text] = true
+		case <-timeout:
+			t.Fatalf("expected 2 removed messages, actual %v", removed)
+		}
+	}
+	sweeper.Close()
+	if !removed["expired"] || !removed["purged"] {
+		t.Errorf("unexpected removed messages %v", removed)
+	}
+	if _, ok := <-sweeper.Removed(); ok {
+		t.Errorf("expected the channel closed")
+	}
+	if page, err := messages.Page(ctx, kept.Id, 0, history.Backward, 10); err != nil || len(page) != 1 || page[0].Text != "kept" {
+		t.Errorf("expected the kept message, actual %v %v", page, err)
+	}
+}
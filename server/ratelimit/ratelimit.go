@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Token bucket rate limiting of posted messages. Every user and every room has its own bucket, a message is accepted
+	only if both buckets have a token. User buckets are keyed on the user name, reconnecting does not refill them. A
+	bucket is released once it has refilled, a full bucket is no different from a new one
+*/
+
+// How often the refilled buckets are released
+const sweepInterval = time.Minute
+
+type Policy int8
+
+const (
+	// End the Post stream with RESOURCE_EXHAUSTED
+	Reject Policy = iota
+	// Drop the message and send a throttle notice back to the author
+	Throttle
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Reject:
+		return "reject"
+	case Throttle:
+		return "throttle"
+	default:
+		return "unknown"
+	}
+}
+
+func ParsePolicy(value string) (Policy, error) {
+	for _, p := range []Policy{Reject, Throttle} {
+		if p.String() == value {
+			return p, nil
+		}
+	}
+	return Reject, fmt.Errorf("unknown rate limit policy %s", value)
+}
+
+type Limit struct {
+	// Tokens added per second, 0 disables the limit
+	Rate float64
+	// Bucket capacity, the number of messages that can be posted at once
+	Burst int
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0
+}
+
+type Config struct {
+	User   Limit
+	Room   Limit
+	Policy Policy
+}
+
+func (config Config) validate() error {
+	validation := make([]string, 0)
+	for name, limit := range map[string]Limit{"user": config.User, "room": config.Room} {
+		if limit.Rate < 0 {
+			validation = append(validation, name+" rate must not be negative")
+		}
+		if limit.enabled() && limit.Burst <= 0 {
+			validation = append(validation, name+" burst must be positive")
+		}
+	}
+	if config.Policy != Reject && config.Policy != Throttle {
+		validation = append(validation, "unknown policy")
+	}
+	if len(validation) > 0 {
+		return fmt.Errorf("invalid configuration %v", validation)
+	}
+	return nil
+}
+
+type Limiter struct {
+	config Config
+	now    func() time.Time
+
+	mtx     *sync.Mutex
+	users   map[string]*bucket
+	rooms   map[int32]*bucket
+	sweptAt time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func New(config Config) (*Limiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Limiter{
+		config: config,
+		now:    time.Now,
+		mtx:    new(sync.Mutex),
+		users:  make(map[string]*bucket),
+		rooms:  make(map[int32]*bucket),
+	}, nil
+}
+
+// Policy tells what to do with a rejected message
+func (l *Limiter) Policy() Policy {
+	return l.config.Policy
+}
+
+// Allow takes a token from the bucket of the user with the given name and from the room bucket. A rejected message
+// takes nothing, the duration tells when the next message will be accepted
+func (l *Limiter) Allow(name string, roomId int32) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.sweep(now)
+	userKey := strings.ToLower(name)
+	user := refill(l.users[userKey], l.config.User, now)
+	room := refill(l.rooms[roomId], l.config.Room, now)
+	if wait := retryAfter(user, l.config.User); wait > 0 {
+		return false, wait
+	}
+	if wait := retryAfter(room, l.config.Room); wait > 0 {
+		return false, wait
+	}
+	if user != nil {
+		user.tokens--
+		l.users[userKey] = user
+	}
+	if room != nil {
+		room.tokens--
+		l.rooms[roomId] = room
+	}
+	return true, 0
+}
+
+// Buckets returns the number of the user and room buckets that have not refilled yet
+func (l *Limiter) Buckets() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return len(l.users) + len(l.rooms)
+}
+
+// sweep releases the buckets that have refilled, at most once per sweepInterval
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < sweepInterval {
+		return
+	}
+	l.sweptAt = now
+	for key, b := range l.users {
+		if refill(b, l.config.User, now).full(l.config.User) {
+			delete(l.users, key)
+		}
+	}
+	for key, b := range l.rooms {
+		if refill(b, l.config.Room, now).full(l.config.Room) {
+			delete(l.rooms, key)
+		}
+	}
+}
+
+// refill returns the bucket with the tokens accumulated since the last update, a full bucket if there is none yet and
+// nil if the limit is disabled
+func refill(b *bucket, limit Limit, now time.Time) *bucket {
+	if !limit.enabled() {
+		return nil
+	}
+	if b == nil {
+		return &bucket{tokens: float64(limit.Burst), updatedAt: now}
+	}
+	b.tokens += now.Sub(b.updatedAt).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.updatedAt = now
+	return b
+}
+
+func (b *bucket) full(limit Limit) bool {
+	return b == nil || b.tokens >= float64(limit.Burst)
+}
+
+func retryAfter(b *bucket, limit Limit) time.Duration {
+	if b == nil || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
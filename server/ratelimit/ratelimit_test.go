@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T, config Config) (*Limiter, *time.Time) {
+	limiter, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create limiter: %s", err)
+	}
+	now := time.Now()
+	limiter.now = func() time.Time {
+		return now
+	}
+	return limiter, &now
+}
+
+func TestUserLimit(t *testing.T) {
+	limiter, now := newTestLimiter(t, Config{User: Limit{Rate: 2, Burst: 2}})
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("john", 1); !ok {
+			t.Fatalf("burst expected to be allowed")
+		}
+	}
+	ok, wait := limiter.Allow("john", 1)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected rejection for 500ms, actual %v %s", ok, wait)
+	}
+	if ok, _ := limiter.Allow("jane", 1); !ok {
+		t.Errorf("other users must not be affected")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.Allow("john", 1); !ok {
+		t.Errorf("expected to be allowed after refill")
+	}
+}
+
+func TestRoomLimit(t *testing.T) {
+	limiter, _ := newTestLimiter(t, Config{
+		User: Limit{Rate: 1, Burst: 1},
+		Room: Limit{Rate: 1, Burst: 1},
+	})
+
+	if ok, _ := limiter.Allow("john", 1); !ok {
+		t.Fatalf("first message expected to be allowed")
+	}
+	if ok, _ := limiter.Allow("jane", 1); ok {
+		t.Errorf("room limit expected to reject")
+	}
+	// The rejected message did not take the user token
+	if ok, _ := limiter.Allow("jane", 2); !ok {
+		t.Errorf("expected to be allowed in another room")
+	}
+}
+
+func TestBucketKeptUntilRefilled(t *testing.T) {
+	limiter, now := newTestLimiter(t, Config{User: Limit{Rate: 0.001, Burst: 1}})
+
+	if ok, _ := limiter.Allow("john", 1); !ok {
+		t.Fatalf("first message expected to be allowed")
+	}
+	// The user reconnects after a while, the name is the same
+	*now = now.Add(2 * sweepInterval)
+	if ok, _ := limiter.Allow("John", 1); ok {
+		t.Errorf("expected rejection until the bucket refills")
+	}
+	*now = now.Add(1000 * time.Second)
+	if ok, _ := limiter.Allow("jane", 1); !ok || limiter.Buckets() != 1 {
+		t.Errorf("expected the refilled bucket released, actual %v %d", ok, limiter.Buckets())
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	if _, err := New(Config{User: Limit{Rate: 1}}); err == nil {
+		t.Errorf("zero burst expected to be rejected")
+	}
+	if _, err := New(Config{}); err != nil {
+		t.Errorf("disabled limits expected to be valid, actual %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package resume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/*
+	Resuming a Post stream. Every room numbers its messages with a sequence, a client remembers the last seen number
+	of every room and reopens the stream with the "resume-after" metadata, the server sends the missed messages before
+	live traffic. Tracker does the client side bookkeeping and detects gaps
+*/
+
+// Clients send the positions as "resume-after: <room id>:<seq>,<room id>:<seq>"
+const Header = "resume-after"
+
+var ErrInvalidPosition = errors.New("invalid resume position")
+
+// Positions are the last seen sequence numbers by room id
+type Positions map[int32]int32
+
+func (p Positions) String() string {
+	rooms := make([]int, 0, len(p))
+	for roomId := range p {
+		rooms = append(rooms, int(roomId))
+	}
+	sort.Ints(rooms)
+	pairs := make([]string, len(rooms))
+	for i, roomId := range rooms {
+		pairs[i] = fmt.Sprintf("%d:%d", roomId, p[int32(roomId)])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func ParsePositions(value string) (Positions, error) {
+	result := make(Positions)
+	if value == "" {
+		return result, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w [%s]", ErrInvalidPosition, pair)
+		}
+		roomId, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w [%s]", ErrInvalidPosition, pair)
+		}
+		seq, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || seq < 0 {
+			return nil, fmt.Errorf("%w [%s]", ErrInvalidPosition, pair)
+		}
+		result[int32(roomId)] = int32(seq)
+	}
+	return result, nil
+}
+
+// AppendPositions adds the positions to the outgoing metadata, empty positions are not sent
+func AppendPositions(ctx context.Context, positions Positions) context.Context {
+	if len(positions) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, Header, positions.String())
+}
+
+// PositionsFromContext reads the positions of the incoming metadata, empty if the client did not send any
+func PositionsFromContext(ctx context.Context) (Positions, error) {
+	result := make(Positions)
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return result, nil
+	}
+	for _, value := range md.Get(Header) {
+		positions, err := ParsePositions(value)
+		if err != nil {
+			return nil, err
+		}
+		for roomId, seq := range positions {
+			result[roomId] = seq
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package resume
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestPositionsInMetadata(t *testing.T) {
+	ctx := AppendPositions(context.Background(), Positions{2: 10, 1: 5})
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if values := md.Get(Header); len(values) != 1 || values[0] != "1:5,2:10" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	positions, err := PositionsFromContext(metadata.NewIncomingContext(context.Background(), md))
+	if err != nil || len(positions) != 2 || positions[1] != 5 || positions[2] != 10 {
+		t.Errorf("unexpected positions %v %v", positions, err)
+	}
+	for _, value := range []string{"1", "a:1", "1:b", "1:-1", "1:2,"} {
+		if _, err := ParsePositions(value); !errors.Is(err, ErrInvalidPosition) {
+			t.Errorf("[%s] expected ErrInvalidPosition, actual %v", value, err)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	for _, step := range []struct {
+		seq      int32
+		expected Result
+	}{
+		{3, Accepted},
+		{4, Accepted},
+		{4, Duplicate},
+		{7, Gap},
+		{8, Accepted},
+		// Resumed after 4
+		{5, Accepted},
+		{6, Accepted},
+		{7, Duplicate},
+		{2, Duplicate},
+	} {
+		if result := tracker.Observe(1, step.seq); result != step.expected {
+			t.Errorf("seq %d expected %s, actual %s", step.seq, step.expected, result)
+		}
+		if step.seq == 8 {
+			if positions := tracker.Positions(); positions[1] != 4 || tracker.Missing(1) != 2 {
+				t.Errorf("expected position 4 with 2 missing, actual %v %d", positions, tracker.Missing(1))
+			}
+		}
+	}
+	if positions := tracker.Positions(); positions[1] != 8 || tracker.Missing(1) != 0 {
+		t.Errorf("expected position 8, actual %v %d", positions, tracker.Missing(1))
+	}
+}
+
+func TestTrackerGivesUp(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Start(1, 0)
+	// Message 1 never arrives
+	for seq := int32(2); seq <= maxPending+2; seq++ {
+		tracker.Observe(1, seq)
+	}
+	if positions := tracker.Positions(); positions[1] != maxPending+2 {
+		t.Errorf("expected the hole to be given up, actual %v", positions)
+	}
+}
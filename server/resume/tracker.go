@@ -0,0 +1,137 @@
+package resume
+
+import (
+	"sync"
+)
+
+type Result int8
+
+const (
+	// The message was not seen before
+	Accepted Result = iota
+	// The message was already seen, e.g. delivered live and then again by the resume
+	Duplicate
+	// The message was not seen before and there are missed messages before it. Reopening the stream with the
+	// tracker positions fetches them
+	Gap
+)
+
+func (r Result) String() string {
+	switch r {
+	case Accepted:
+		return "accepted"
+	case Duplicate:
+		return "duplicate"
+	case Gap:
+		return "gap"
+	default:
+		return "unknown"
+	}
+}
+
+// Holes are given up when this many messages above them were seen, e.g. the missed messages were deleted
+const maxPending = 1000
+
+type position struct {
+	// Every message up to the watermark was seen
+	watermark int32
+	highest   int32
+	// Seen sequence numbers above the watermark
+	seen map[int32]bool
+}
+
+// Tracker remembers the seen sequence numbers of every room. Safe for concurrent use
+type Tracker struct {
+	mtx   *sync.Mutex
+	rooms map[int32]*position
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		mtx:   new(sync.Mutex),
+		rooms: make(map[int32]*position),
+	}
+}
+
+// Observe records the sequence number of a POSTED message. The first message of a room is the starting point, earlier
+// messages are not tracked, see Start. A gap is reported once, when the first message after it arrives
+func (t *Tracker) Observe(roomId int32, seq int32) Result {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	p, ok := t.rooms[roomId]
+	if !ok {
+		t.rooms[roomId] = &position{watermark: seq, highest: seq, seen: make(map[int32]bool)}
+		return Accepted
+	}
+	if seq <= p.watermark || p.seen[seq] {
+		return Duplicate
+	}
+	result := Accepted
+	if seq > p.highest+1 {
+		result = Gap
+	}
+	if seq > p.highest {
+		p.highest = seq
+	}
+	p.seen[seq] = true
+	p.advance()
+	if len(p.seen) > maxPending {
+		p.giveUp()
+	}
+	return result
+}
+
+// Start sets the starting point of the room, messages up to seq are considered seen
+func (t *Tracker) Start(roomId int32, seq int32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rooms[roomId] = &position{watermark: seq, highest: seq, seen: make(map[int32]bool)}
+}
+
+// Forget stops tracking the room, e.g. after the user left it
+func (t *Tracker) Forget(roomId int32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.rooms, roomId)
+}
+
+// Positions returns the last sequence number of every room before the first missed message
+func (t *Tracker) Positions() Positions {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	result := make(Positions, len(t.rooms))
+	for roomId, p := range t.rooms {
+		result[roomId] = p.watermark
+	}
+	return result
+}
+
+// Missing returns the number of the missed messages of the room
+func (t *Tracker) Missing(roomId int32) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	p, ok := t.rooms[roomId]
+	if !ok {
+		return 0
+	}
+	return int(p.highest-p.watermark) - len(p.seen)
+}
+
+func (p *position) advance() {
+	for p.seen[p.watermark+1] {
+		delete(p.seen, p.watermark+1)
+		p.watermark++
+	}
+}
+
+// giveUp moves the watermark over the lowest hole
+func (p *position) giveUp() {
+	lowest := p.highest
+	for seq := range p.seen {
+		if seq < lowest {
+			lowest = seq
+		}
+	}
+	p.watermark = lowest - 1
+	p.advance()
+}
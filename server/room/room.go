@@ -0,0 +1,259 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Chat rooms and their members. A message posted to a room is delivered to the room members only
+*/
+
+const (
+	MaxNameLength = 64
+)
+
+var (
+	ErrNameTaken   = errors.New("room name taken")
+	ErrNotFound    = errors.New("room not found")
+	ErrNotMember   = errors.New("not a room member")
+	ErrInvalidName = errors.New("invalid room name")
+	ErrRetention   = errors.New("invalid retention")
+)
+
+type Room struct {
+	Id          int32
+	Name        string
+	MemberCount int32
+	// The owner moderates the room
+	OwnerId int32
+	// Name of the owner, unlike the owner id it stays the same when the owner reconnects
+	OwnerName string
+	// Messages older than this are removed from the history, zero keeps them forever
+	Retention time.Duration
+}
+
+type Registry struct {
+	mtx    *sync.RWMutex
+	lastId int32
+	rooms  map[int32]*room
+	byName map[string]int32
+}
+
+type room struct {
+	id        int32
+	name      string
+	ownerId   int32
+	ownerName string
+	retention time.Duration
+	members   map[int32]bool
+	// Lower case names of the members. Unlike the member ids the names stay when the members disconnect, they are
+	// removed when the members leave the room
+	names map[string]bool
+}
+
+func (r *room) snapshot() Room {
+	return Room{
+		Id:          r.id,
+		Name:        r.name,
+		MemberCount: int32(len(r.members)),
+		OwnerId:     r.ownerId,
+		OwnerName:   r.ownerName,
+		Retention:   r.retention,
+	}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mtx:    new(sync.RWMutex),
+		rooms:  make(map[int32]*room),
+		byName: make(map[string]int32),
+	}
+}
+
+// SkipIds makes the rooms created from now on get ids greater than lastId. Rooms live in the process memory, the ids
+// of the rooms that have a history must not be reused after a restart, see history.MessageStore.LastRoomId
+func (r *Registry) SkipIds(lastId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if lastId > r.lastId {
+		r.lastId = lastId
+	}
+}
+
+// Create creates a new room, the owner becomes its first member
+func (r *Registry) Create(name string, ownerId int32, ownerName string) (Room, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxNameLength {
+		return Room{}, fmt.Errorf("%w: name must be 1 to %d characters long", ErrInvalidName, MaxNameLength)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	key := strings.ToLower(name)
+	if _, ok := r.byName[key]; ok {
+		return Room{}, ErrNameTaken
+	}
+	r.lastId++
+	created := &room{
+		id:        r.lastId,
+		name:      name,
+		ownerId:   ownerId,
+		ownerName: ownerName,
+		members:   map[int32]bool{ownerId: true},
+		names:     map[string]bool{strings.ToLower(ownerName): true},
+	}
+	r.rooms[created.id] = created
+	r.byName[key] = created.id
+	return created.snapshot(), nil
+}
+
+func (r *Registry) Join(roomId int32, userId int32, name string) (Room, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.rooms[roomId]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	existing.members[userId] = true
+	existing.names[strings.ToLower(name)] = true
+	return existing.snapshot(), nil
+}
+
+func (r *Registry) Leave(roomId int32, userId int32, name string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.rooms[roomId]
+	if !ok {
+		return ErrNotFound
+	}
+	if !existing.members[userId] {
+		return ErrNotMember
+	}
+	delete(existing.members, userId)
+	delete(existing.names, strings.ToLower(name))
+	return nil
+}
+
+// LeaveAll removes the user from every room, used when the user disconnects. The rooms keep the user name, see
+// HasMemberNamed
+func (r *Registry) LeaveAll(userId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, existing := range r.rooms {
+		delete(existing.members, userId)
+	}
+}
+
+// SetRetention changes how long the room keeps its messages, zero keeps them forever
+func (r *Registry) SetRetention(roomId int32, retention time.Duration) (Room, error) {
+	if retention < 0 {
+		return Room{}, fmt.Errorf("%w: retention must not be negative", ErrRetention)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.rooms[roomId]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	existing.retention = retention
+	return existing.snapshot(), nil
+}
+
+// Retentions returns the retention of every room that does not keep its messages forever
+func (r *Registry) Retentions() map[int32]time.Duration {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	result := make(map[int32]time.Duration)
+	for _, existing := range r.rooms {
+		if existing.retention > 0 {
+			result[existing.id] = existing.retention
+		}
+	}
+	return result
+}
+
+func (r *Registry) Get(roomId int32) (Room, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if existing, ok := r.rooms[roomId]; ok {
+		return existing.snapshot(), nil
+	}
+	return Room{}, ErrNotFound
+}
+
+// FindByName returns ErrNotFound if there is no room with the name, names are case insensitive
+func (r *Registry) FindByName(name string) (Room, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if roomId, ok := r.byName[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return r.rooms[roomId].snapshot(), nil
+	}
+	return Room{}, ErrNotFound
+}
+
+func (r *Registry) List() []Room {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	result := make([]Room, 0, len(r.rooms))
+	for _, existing := range r.rooms {
+		result = append(result, existing.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (r *Registry) IsMember(roomId int32, userId int32) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if existing, ok := r.rooms[roomId]; ok {
+		return existing.members[userId]
+	}
+	return false
+}
+
+// HasMemberNamed tells if the user with the name joined the room and did not leave it, the user may be disconnected.
+// Names are case insensitive
+func (r *Registry) HasMemberNamed(roomId int32, name string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if existing, ok := r.rooms[roomId]; ok {
+		return existing.names[strings.ToLower(name)]
+	}
+	return false
+}
+
+// MemberOf returns the ids of the rooms the user is a member of
+func (r *Registry) MemberOf(userId int32) map[int32]bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	result := make(map[int32]bool)
+	for _, existing := range r.rooms {
+		if existing.members[userId] {
+			result[existing.id] = true
+		}
+	}
+	return result
+}
+
+// Members returns a copy of the room member set
+func (r *Registry) Members(roomId int32) (map[int32]bool, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	existing, ok := r.rooms[roomId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := make(map[int32]bool, len(existing.members))
+	for userId := range existing.members {
+		result[userId] = true
+	}
+	return result, nil
+}
@@ -0,0 +1,395 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/iyarkov2/chat/server/history"
+)
+
+/*
+	Full-text message search. The server keeps an in-memory inverted index of the posted messages: every term points
+	to the messages it appears in and its positions there. A query is a list of words and "quoted phrases", a message
+	matches if it contains all of them. Results are ordered from the newest to the oldest.
+
+	The index lives in memory, Index.Rebuild fills it from the message store when the server starts
+*/
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+var (
+	ErrEmptyQuery    = errors.New("empty query")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+type Query struct {
+	// Every clause is a phrase of one or more terms
+	Clauses [][]string
+	// Optional filters
+	RoomIds map[int32]bool
+	UserId  int32
+	From    time.Time
+	To      time.Time
+	// From a previous Page, empty for the newest messages
+	Cursor string
+	Limit  int
+}
+
+// Highlight is a matched fragment of the message text, in characters
+type Highlight struct {
+	Offset int
+	Length int
+}
+
+type Result struct {
+	Message    history.Message
+	Highlights []Highlight
+}
+
+type Page struct {
+	Results []Result
+	// Empty if there are no more results
+	Next string
+}
+
+// ParseQuery splits the text into words and "quoted phrases", an unterminated quote runs to the end of the text
+func ParseQuery(text string) [][]string {
+	clauses := make([][]string, 0)
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if phrase := terms(part); len(phrase) > 0 {
+				clauses = append(clauses, phrase)
+			}
+			continue
+		}
+		for _, term := range terms(part) {
+			clauses = append(clauses, []string{term})
+		}
+	}
+	return clauses
+}
+
+type token struct {
+	term   string
+	offset int
+	length int
+}
+
+// tokenize splits the text into lower case letter and digit runs. Offsets are in characters
+func tokenize(text string) []token {
+	result := make([]token, 0)
+	var current []rune
+	start, position := 0, 0
+	flush := func() {
+		if len(current) > 0 {
+			result = append(result, token{term: string(current), offset: start, length: len(current)})
+			current = current[:0]
+		}
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(current) == 0 {
+				start = position
+			}
+			current = append(current, unicode.ToLower(r))
+		} else {
+			flush()
+		}
+		position++
+	}
+	flush()
+	return result
+}
+
+func terms(text string) []string {
+	tokens := tokenize(text)
+	result := make([]string, len(tokens))
+	for i, t := range tokens {
+		result[i] = t.term
+	}
+	return result
+}
+
+type document struct {
+	msg    history.Message
+	tokens []token
+}
+
+type Index struct {
+	mtx  *sync.RWMutex
+	docs map[int32]*document
+	// Token positions by message id by term
+	postings map[string]map[int32][]int
+}
+
+func NewIndex() *Index {
+	return &Index{
+		mtx:      new(sync.RWMutex),
+		docs:     make(map[int32]*document),
+		postings: make(map[string]map[int32][]int),
+	}
+}
+
+// Add indexes the message, an already indexed message is replaced. Tombstones are removed from the index
+func (i *Index) Add(msg history.Message) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.remove(msg.Id)
+	if msg.Deleted {
+		return
+	}
+	doc := &document{msg: msg, tokens: tokenize(msg.Text)}
+	i.docs[msg.Id] = doc
+	for position, t := range doc.tokens {
+		posting, ok := i.postings[t.term]
+		if !ok {
+			posting = make(map[int32][]int)
+			i.postings[t.term] = posting
+		}
+		posting[msg.Id] = append(posting[msg.Id], position)
+	}
+}
+
+func (i *Index) Remove(id int32) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	i.remove(id)
+}
+
+// Size returns the number of indexed messages
+func (i *Index) Size() int {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return len(i.docs)
+}
+
+// Rebuild indexes every message of the store, with the replies, and returns the number of indexed messages. It reads
+// the store room by room and must run before the server takes new messages
+func (i *Index) Rebuild(ctx context.Context, messages history.MessageStore) (int, error) {
+	lastRoomId, err := messages.LastRoomId(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for roomId := int32(1); roomId <= lastRoomId; roomId++ {
+		var anchorId int32
+		for {
+			roots, err := messages.Page(ctx, roomId, anchorId, history.Forward, history.MaxPageSize)
+			if err != nil {
+				return 0, fmt.Errorf("room %d: %w", roomId, err)
+			}
+			for _, root := range roots {
+				i.Add(root)
+				if root.ReplyCount > 0 {
+					if err := i.addReplies(ctx, messages, root.Id); err != nil {
+						return 0, fmt.Errorf("room %d: %w", roomId, err)
+					}
+				}
+			}
+			if len(roots) < history.MaxPageSize {
+				break
+			}
+			anchorId = roots[len(roots)-1].Id
+		}
+	}
+	return i.Size(), nil
+}
+
+func (i *Index) addReplies(ctx context.Context, messages history.MessageStore, rootId int32) error {
+	var afterId int32
+	for {
+		replies, err := messages.Replies(ctx, rootId, afterId, history.MaxPageSize)
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			i.Add(reply)
+		}
+		if len(replies) < history.MaxPageSize {
+			return nil
+		}
+		afterId = replies[len(replies)-1].Id
+	}
+}
+
+// remove must be called under the lock
+func (i *Index) remove(id int32) {
+	doc, ok := i.docs[id]
+	if !ok {
+		return
+	}
+	delete(i.docs, id)
+	for _, t := range doc.tokens {
+		posting := i.postings[t.term]
+		delete(posting, id)
+		if len(posting) == 0 {
+			delete(i.postings, t.term)
+		}
+	}
+}
+
+func (i *Index) Search(query Query) (Page, error) {
+	if len(query.Clauses) == 0 {
+		return Page{}, ErrEmptyQuery
+	}
+	anchor, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return Page{}, err
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	result := Page{Results: make([]Result, 0, limit)}
+	for _, id := range i.candidates(query.Clauses) {
+		if anchor > 0 && id >= anchor {
+			continue
+		}
+		doc := i.docs[id]
+		if !matches(doc.msg, query) {
+			continue
+		}
+		highlights, ok := i.highlight(doc, query.Clauses)
+		if !ok {
+			continue
+		}
+		if len(result.Results) == limit {
+			result.Next = encodeCursor(result.Results[limit-1].Message.Id)
+			break
+		}
+		result.Results = append(result.Results, Result{Message: doc.msg, Highlights: highlights})
+	}
+	return result, nil
+}
+
+// candidates returns the ids of the messages with every query term, newest first. Must be called under the lock
+func (i *Index) candidates(clauses [][]string) []int32 {
+	required := make([]map[int32][]int, 0)
+	for _, clause := range clauses {
+		for _, term := range clause {
+			posting, ok := i.postings[term]
+			if !ok {
+				return nil
+			}
+			required = append(required, posting)
+		}
+	}
+	// The shortest posting list is the smallest candidate set
+	sort.Slice(required, func(a, b int) bool {
+		return len(required[a]) < len(required[b])
+	})
+	result := make([]int32, 0, len(required[0]))
+	for id := range required[0] {
+		found := true
+		for _, posting := range required[1:] {
+			if _, ok := posting[id]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a] > result[b]
+	})
+	return result
+}
+
+func matches(msg history.Message, query Query) bool {
+	if query.RoomIds != nil && !query.RoomIds[msg.RoomId] {
+		return false
+	}
+	if query.UserId != 0 && msg.UserId != query.UserId {
+		return false
+	}
+	if !query.From.IsZero() && msg.CreatedAt.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !msg.CreatedAt.Before(query.To) {
+		return false
+	}
+	return true
+}
+
+// highlight finds every occurrence of the clauses in the message, false if any clause does not occur. Must be
+// called under the lock
+func (i *Index) highlight(doc *document, clauses [][]string) ([]Highlight, bool) {
+	result := make([]Highlight, 0)
+	for _, clause := range clauses {
+		found := false
+		for _, start := range i.postings[clause[0]][doc.msg.Id] {
+			if !phraseAt(doc.tokens, start, clause) {
+				continue
+			}
+			found = true
+			last := doc.tokens[start+len(clause)-1]
+			result = append(result, Highlight{
+				Offset: doc.tokens[start].offset,
+				Length: last.offset + last.length - doc.tokens[start].offset,
+			})
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Offset < result[b].Offset
+	})
+	// The same fragment may match several clauses
+	unique := result[:0]
+	for _, h := range result {
+		if len(unique) == 0 || unique[len(unique)-1] != h {
+			unique = append(unique, h)
+		}
+	}
+	return unique, true
+}
+
+func phraseAt(tokens []token, start int, phrase []string) bool {
+	if start+len(phrase) > len(tokens) {
+		return false
+	}
+	for k, term := range phrase {
+		if tokens[start+k].term != term {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeCursor(anchorId int32) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(int64(anchorId), 10)))
+}
+
+func decodeCursor(value string) (int32, error) {
+	if value == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	id, err := strconv.ParseInt(string(raw), 10, 32)
+	if err != nil || id <= 0 {
+		return 0, ErrInvalidCursor
+	}
+	return int32(id), nil
+}
@@ -0,0 +1,143 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iyarkov2/chat/server/history"
+)
+
+func ids(page Page) []int32 {
+	result := make([]int32, 0, len(page.Results))
+	for _, r := range page.Results {
+		result = append(result, r.Message.Id)
+	}
+	return result
+}
+
+func newTestIndex() *Index {
+	index := NewIndex()
+	created := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	for id, text := range map[int32]string{
+		1: "The quick brown fox",
+		2: "A brown dog, quick as a fox",
+		3: "Brown fox again",
+		4: "Nothing to see here",
+	} {
+		index.Add(history.Message{
+			Id:        id,
+			RoomId:    id%2 + 1,
+			UserId:    10 + id,
+			Text:      text,
+			CreatedAt: created.Add(time.Duration(id) * time.Hour),
+		})
+	}
+	return index
+}
+
+func TestSearch(t *testing.T) {
+	index := newTestIndex()
+	for query, expected := range map[string]string{
+		"fox":                  "[3 2 1]",
+		"FOX brown":            "[3 2 1]",
+		`"brown fox"`:          "[3 1]",
+		`quick "brown fox"`:    "[1]",
+		"cat":                  "[]",
+		`"fox brown" nothing`:  "[]",
+		`"brown fox` + " agai": "[]",
+	} {
+		page, err := index.Search(Query{Clauses: ParseQuery(query)})
+		if err != nil {
+			t.Fatalf("search failed: %s", err)
+		}
+		if fmt.Sprint(ids(page)) != expected {
+			t.Errorf("[%s] expected %s, actual %v", query, expected, ids(page))
+		}
+	}
+	if _, err := index.Search(Query{Clauses: ParseQuery(" ,. ")}); !errors.Is(err, ErrEmptyQuery) {
+		t.Errorf("expected ErrEmptyQuery, actual %v", err)
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	index := newTestIndex()
+	clauses := ParseQuery("fox")
+	page, _ := index.Search(Query{Clauses: clauses, RoomIds: map[int32]bool{2: true}})
+	if fmt.Sprint(ids(page)) != "[3 1]" {
+		t.Errorf("unexpected room results %v", ids(page))
+	}
+	page, _ = index.Search(Query{Clauses: clauses, UserId: 12})
+	if fmt.Sprint(ids(page)) != "[2]" {
+		t.Errorf("unexpected author results %v", ids(page))
+	}
+	from := time.Date(2021, 9, 1, 2, 0, 0, 0, time.UTC)
+	page, _ = index.Search(Query{Clauses: clauses, From: from, To: from.Add(time.Hour)})
+	if fmt.Sprint(ids(page)) != "[2]" {
+		t.Errorf("unexpected time range results %v", ids(page))
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	index := newTestIndex()
+	first, err := index.Search(Query{Clauses: ParseQuery("fox"), Limit: 2})
+	if err != nil || fmt.Sprint(ids(first)) != "[3 2]" || first.Next == "" {
+		t.Fatalf("unexpected first page %v %v", ids(first), err)
+	}
+	second, err := index.Search(Query{Clauses: ParseQuery("fox"), Limit: 2, Cursor: first.Next})
+	if err != nil || fmt.Sprint(ids(second)) != "[1]" || second.Next != "" {
+		t.Errorf("unexpected second page %v %v", ids(second), err)
+	}
+	if _, err := index.Search(Query{Clauses: ParseQuery("fox"), Cursor: "garbage"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, actual %v", err)
+	}
+}
+
+func TestHighlightsAndUpdates(t *testing.T) {
+	index := NewIndex()
+	index.Add(history.Message{Id: 1, Text: "Ünïcode fox, and the brown  FOX"})
+	page, _ := index.Search(Query{Clauses: ParseQuery(`fox "brown fox"`)})
+	if len(page.Results) != 1 || fmt.Sprint(page.Results[0].Highlights) != "[{8 3} {21 10} {28 3}]" {
+		t.Errorf("unexpected highlights %v", page.Results)
+	}
+
+	index.Add(history.Message{Id: 1, Text: "edited"})
+	if page, _ := index.Search(Query{Clauses: ParseQuery("fox")}); len(page.Results) != 0 {
+		t.Errorf("edited text expected to be reindexed, actual %v", page.Results)
+	}
+	index.Add(history.Message{Id: 1, Deleted: true})
+	if index.Size() != 0 {
+		t.Errorf("tombstone expected to be removed")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	messages := history.NewMemoryStore()
+	for _, msg := range []history.Message{
+		{RoomId: 1, Text: "quick fox"},
+		{RoomId: 2, Text: "lazy dog"},
+		{RoomId: 2, Text: "quick dog"},
+	} {
+		if _, err := messages.Insert(ctx, msg); err != nil {
+			t.Fatalf("insert failed: %s", err)
+		}
+	}
+	if _, err := messages.Insert(ctx, history.Message{RoomId: 2, ParentId: 2, Text: "quick reply"}); err != nil {
+		t.Fatalf("insert failed: %s", err)
+	}
+	if _, err := messages.Delete(ctx, 1); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+
+	index := NewIndex()
+	if indexed, err := index.Rebuild(ctx, messages); err != nil || indexed != 3 {
+		t.Fatalf("expected 3 messages, actual %d %v", indexed, err)
+	}
+	page, err := index.Search(Query{Clauses: ParseQuery("quick")})
+	if err != nil || fmt.Sprint(ids(page)) != "[4 3]" {
+		t.Errorf("unexpected results %v %v", ids(page), err)
+	}
+}
@@ -2,61 +2,417 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/iyarkov2/chat/core/tlsconfig"
 	"github.com/iyarkov2/chat/server/api"
+	"github.com/iyarkov2/chat/server/attachment"
+	"github.com/iyarkov2/chat/server/auth"
+	"github.com/iyarkov2/chat/server/block"
+	"github.com/iyarkov2/chat/server/chat"
+	"github.com/iyarkov2/chat/server/cluster"
+	"github.com/iyarkov2/chat/server/cluster/kafka"
+	"github.com/iyarkov2/chat/server/filter"
+	"github.com/iyarkov2/chat/server/gateway"
+	"github.com/iyarkov2/chat/server/history"
+	"github.com/iyarkov2/chat/server/hub"
+	"github.com/iyarkov2/chat/server/inbox"
+	"github.com/iyarkov2/chat/server/metrics"
+	"github.com/iyarkov2/chat/server/presence"
+	"github.com/iyarkov2/chat/server/purge"
+	"github.com/iyarkov2/chat/server/ratelimit"
+	"github.com/iyarkov2/chat/server/room"
+	"github.com/iyarkov2/chat/server/search"
+	"github.com/iyarkov2/chat/server/thread"
+	"github.com/iyarkov2/chat/server/user"
+	_ "github.com/lib/pq"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
 )
 
-type chatServer struct {
-	api.UnimplementedChatServiceServer
-}
+var (
+	bufferSize   = flag.Int("buffer", 64, "Number of messages buffered for every Post stream")
+	slowConsumer = flag.String("slow-consumer", hub.Drop.String(), "Slow consumer policy: drop, disconnect or block")
+	blockTimeout = flag.Duration("block-timeout", time.Second, "How long the block policy waits for a slow consumer")
+	dbUrl        = flag.String("db", "", "Postgres connection string, messages are kept in memory if not set")
+	messageTable = flag.String("message-table", "message", "Message history table")
+	seqTable     = flag.String("sequence-table", "room_sequence", "Room sequence number table")
+	requestTable = flag.String("request-table", "request_record", "Idempotency request table")
+	retention    = flag.Uint("request-retention", 3600, "How long post requests are remembered, seconds")
+	tokenSecret  = flag.String("token-secret", "", "Session token HMAC secret, at least 32 bytes. Random if not set")
+	tokenTTL     = flag.Duration("token-ttl", 24*time.Hour, "Session token lifetime")
+	heartbeat    = flag.Duration("heartbeat-timeout", 30*time.Second, "Users without a heartbeat or a Post stream go offline")
+	typing       = flag.Duration("typing-timeout", 5*time.Second, "How long a typing indicator lasts")
+	userRate     = flag.Float64("user-rate", 5, "Messages per second a user may post, 0 disables the limit")
+	userBurst    = flag.Int("user-burst", 10, "Messages a user may post at once")
+	roomRate     = flag.Float64("room-rate", 50, "Messages per second posted to a room, 0 disables the limit")
+	roomBurst    = flag.Int("room-burst", 100, "Messages posted to a room at once")
+	ratePolicy   = flag.String("rate-limit-policy", ratelimit.Throttle.String(), "What happens to posts over the limit: reject or throttle")
+	tlsCert      = flag.String("tls-cert", "", "Server certificate PEM file, the server listens in plaintext if not set")
+	tlsKey       = flag.String("tls-key", "", "Server key PEM file")
+	tlsCA        = flag.String("tls-ca", "", "Client CA PEM file, enables mutual TLS")
+	tlsReload    = flag.Duration("tls-reload", time.Minute, "How often the certificate files are checked for changes, 0 disables the reload")
+	httpAddr     = flag.String("http", "", "HTTP gateway address for browser clients, e.g. localhost:8080. Disabled if not set")
+	gatewayIdle  = flag.Duration("gateway-idle", time.Minute, "How long a gateway session without WebSocket connections is kept")
+	gatewayBody  = flag.Int64("gateway-max-body", 1024*1024, "Largest gateway request body and WebSocket frame in bytes")
+	maxLength    = flag.Int("max-length", 4000, "Longest message in characters, 0 disables the limit")
+	blockLinks   = flag.Bool("block-links", false, "Reject messages with links")
+	profanity    = flag.String("profanity", "", "Comma separated words masked in every message")
+	bannedWords  = flag.String("banned-words", "", `JSON file of the words banned per room, {"room name": ["word", ...]}`)
+	blobDir      = flag.String("attachment-dir", "attachments", "Directory of the uploaded attachments")
+	blobMaxSize  = flag.Int64("attachment-max-size", 10*1024*1024, "Largest attachment in bytes")
+	blobChunk    = flag.Int("attachment-chunk", 64*1024, "Attachments are downloaded in chunks of this size, bytes")
+	kafkaServers = flag.String("kafka", "", "Kafka bootstrap servers of the cluster fan-out, the server runs alone if not set")
+	kafkaTopic   = flag.String("kafka-topic", "chat-events", "Kafka topic of the cluster fan-out")
+	nodeId       = flag.String("node-id", "", "Unique id of the cluster node, host name and process id if not set")
+	inboxSize    = flag.Int("inbox-size", 1000, "Most notifications kept per user")
+	purgeEvery   = flag.Duration("purge-interval", time.Minute, "How often expired messages and messages out of the room retention are removed")
+	purgeBatch   = flag.Int("purge-batch", 1000, "Most messages removed by one purge query")
+	adminToken   = flag.String("admin-token", "", "Bearer token of the ChatAdmin service, at least 32 bytes")
+	adminNames   = flag.String("admin-names", "", "Comma separated client certificate names allowed to call the ChatAdmin service")
+	metricsAddr  = flag.String("metrics", "localhost:9090", "Address of the Prometheus /metrics endpoint. Disabled if empty")
+)
 
-func (s *chatServer) Connect(ctx context.Context, request *api.ConnectRequest) (*api.ConnectResponse, error) {
-	fmt.Printf("Received request [%v]\n", request)
-	result := &api.ConnectResponse{
-		Status : api.ConnectResponse_SUCCESS,
-		UserId: 1,
+func serveMetrics(m *metrics.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	log.Printf("Metrics listening on %s", *metricsAddr)
+	if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+		log.Fatalf("failed to serve metrics: %v", err)
 	}
-	return result, nil
 }
 
-func (s *chatServer) Post(stream api.ChatService_PostServer) error {
-	for {
-		in, err := stream.Recv()
-		if err == io.EOF {
-			return nil
+// newCluster returns nil if the cluster fan-out is not configured
+func newCluster() *cluster.Node {
+	if *kafkaServers == "" {
+		return nil
+	}
+	id := *nodeId
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("failed to read host name: %v", err)
 		}
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	transport, err := kafka.New(kafka.Config{
+		BootstrapServers: *kafkaServers,
+		Topic:            *kafkaTopic,
+		GroupId:          "chat-node-" + id,
+		BufferSize:       *bufferSize,
+	})
+	if err != nil {
+		log.Fatalf("failed to create Kafka transport: %v", err)
+	}
+	node, err := cluster.NewNode(cluster.Config{
+		NodeId:     id,
+		Transport:  transport,
+		BufferSize: *bufferSize,
+		DedupSize:  10000,
+	})
+	if err != nil {
+		log.Fatalf("failed to create cluster node: %v", err)
+	}
+	log.Printf("Cluster node %s, Kafka topic %s", id, *kafkaTopic)
+	return node
+}
+
+func newAttachments() *attachment.Service {
+	blobs, err := attachment.NewFileStore(*blobDir)
+	if err != nil {
+		log.Fatalf("failed to create attachment store: %v", err)
+	}
+	service, err := attachment.NewService(blobs, attachment.Config{
+		MaxSize:   *blobMaxSize,
+		ChunkSize: *blobChunk,
+	})
+	if err != nil {
+		log.Fatalf("failed to create attachment service: %v", err)
+	}
+	return service
+}
+
+// newFilters builds the moderation chain, the filters run in the order they are listed here
+func newFilters() *filter.Chain {
+	filters := make([]filter.MessageFilter, 0)
+	if *maxLength > 0 {
+		filters = append(filters, filter.MaxLength(*maxLength))
+	}
+	if *blockLinks {
+		filters = append(filters, filter.LinkBlocker())
+	}
+	if *bannedWords != "" {
+		content, err := ioutil.ReadFile(*bannedWords)
 		if err != nil {
-			return err
+			log.Fatalf("failed to read banned words: %v", err)
+		}
+		rooms := make(map[string][]string)
+		if err := json.Unmarshal(content, &rooms); err != nil {
+			log.Fatalf("invalid banned words file: %v", err)
+		}
+		banned := filter.NewBannedWords()
+		for roomName, words := range rooms {
+			banned.Set(roomName, words)
 		}
-		fmt.Printf("Received: %v", in)
+		filters = append(filters, banned)
+	}
+	if *profanity != "" {
+		filters = append(filters, filter.ProfanityMask(strings.Split(*profanity, ",")))
+	}
+	return filter.NewChain(filters...)
+}
+
+// newTLSLoader returns nil if TLS is not configured
+func newTLSLoader() *tlsconfig.Loader {
+	if *tlsCert == "" {
+		log.Printf("TLS is not configured, listening in plaintext")
+		return nil
+	}
+	loader, err := tlsconfig.NewLoader(tlsconfig.Config{
+		CertFile:       *tlsCert,
+		KeyFile:        *tlsKey,
+		CAFile:         *tlsCA,
+		ReloadInterval: *tlsReload,
+	})
+	if err != nil {
+		log.Fatalf("failed to load certificates: %v", err)
+	}
+	return loader
+}
+
+// newTLSConfig returns nil if TLS is not configured, see tlsconfig.Loader.ServerConfig for the ALPN protocols
+func newTLSConfig(loader *tlsconfig.Loader, nextProtos ...string) *tls.Config {
+	if loader == nil {
+		return nil
+	}
+	config, err := loader.ServerConfig(nextProtos...)
+	if err != nil {
+		log.Fatalf("invalid TLS configuration: %v", err)
+	}
+	return config
+}
+
+// serveGateway serves the HTTP gateway, the gateway reaches the gRPC server through an in-memory listener
+func serveGateway(grpcServer *grpc.Server, tlsConfig *tls.Config) {
+	internal := bufconn.Listen(1024 * 1024)
+	go func() {
+		if err := grpcServer.Serve(internal); err != nil {
+			log.Fatalf("failed to serve the gateway: %v", err)
+		}
+	}()
+	gw, err := gateway.New(gateway.Config{
+		Dial: func(ctx context.Context) (*grpc.ClientConn, error) {
+			options := append(api.WithClientVersion(),
+				grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+					return internal.Dial()
+				}),
+				grpc.WithInsecure())
+			return grpc.DialContext(ctx, "internal", options...)
+		},
+		IdleTimeout: *gatewayIdle,
+		MaxBodySize: *gatewayBody,
+	})
+	if err != nil {
+		log.Fatalf("failed to create gateway: %v", err)
+	}
+	lis, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	log.Printf("HTTP gateway listening on %s", *httpAddr)
+	if err := http.Serve(lis, gw.Handler()); err != nil {
+		log.Fatalf("failed to serve the gateway: %v", err)
+	}
+}
 
-		msg := &api.PostResponse{
-			Id: 1,
-			UserId: 2,
-			Text: "Response: " + in.Text,
+func newSigner() *auth.Signer {
+	secret := []byte(*tokenSecret)
+	if len(secret) == 0 {
+		log.Printf("Token secret is not set, tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("failed to generate token secret: %v", err)
 		}
-		stream.Send(msg)
 	}
+	signer, err := auth.NewSigner(secret, *tokenTTL)
+	if err != nil {
+		log.Fatalf("failed to create token signer: %v", err)
+	}
+	return signer
 }
 
-func newServer() *chatServer {
-	s := &chatServer{}
+func newAdmins() *auth.Admins {
+	if *adminToken == "" && *adminNames == "" {
+		log.Printf("Admin credentials are not set, the ChatAdmin service is disabled")
+		return nil
+	}
+	names := make([]string, 0)
+	if *adminNames != "" {
+		names = strings.Split(*adminNames, ",")
+	}
+	admins, err := auth.NewAdmins(*adminToken, names)
+	if err != nil {
+		log.Fatalf("failed to create admin credentials: %v", err)
+	}
+	return admins
+}
+
+func newMessageStore() history.MessageStore {
+	if *dbUrl == "" {
+		return history.NewMemoryStore()
+	}
+	db, err := sql.Open("postgres", *dbUrl)
+	if err != nil {
+		log.Fatalf("failed to open DB: %v", err)
+	}
+	store, err := history.NewSQLStore(context.Background(), db, history.SQLConfig{
+		TableName:                 *messageTable,
+		SequenceTableName:         *seqTable,
+		RequestTableName:          *requestTable,
+		RequestRetentionPeriodSec: *retention,
+	})
+	if err != nil {
+		log.Fatalf("failed to create message store: %v", err)
+	}
+	return store
+}
+
+func newServer(m *metrics.Metrics) *chat.Server {
+	users, err := user.NewRegistry(user.NewMemoryStore())
+	if err != nil {
+		log.Fatalf("failed to create user registry: %v", err)
+	}
+	policy, err := hub.ParsePolicy(*slowConsumer)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	h, err := hub.New(hub.Config{
+		BufferSize:   *bufferSize,
+		Policy:       policy,
+		BlockTimeout: *blockTimeout,
+	})
+	if err != nil {
+		log.Fatalf("failed to create hub: %v", err)
+	}
+	tracker, err := presence.NewTracker(presence.Config{
+		Timeout:       *heartbeat,
+		TypingTimeout: *typing,
+		SweepInterval: time.Second,
+		BufferSize:    *bufferSize,
+	})
+	if err != nil {
+		log.Fatalf("failed to create presence tracker: %v", err)
+	}
+	limitPolicy, err := ratelimit.ParsePolicy(*ratePolicy)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	limiter, err := ratelimit.New(ratelimit.Config{
+		User:   ratelimit.Limit{Rate: *userRate, Burst: *userBurst},
+		Room:   ratelimit.Limit{Rate: *roomRate, Burst: *roomBurst},
+		Policy: limitPolicy,
+	})
+	if err != nil {
+		log.Fatalf("failed to create rate limiter: %v", err)
+	}
+	notifications, err := inbox.NewInbox(inbox.Config{
+		MaxPerUser: *inboxSize,
+		BufferSize: *bufferSize,
+	})
+	if err != nil {
+		log.Fatalf("failed to create inbox: %v", err)
+	}
+	rooms := room.NewRegistry()
+	messages := newMessageStore()
+	lastRoomId, err := messages.LastRoomId(context.Background())
+	if err != nil {
+		log.Fatalf("failed to read the last room id: %v", err)
+	}
+	rooms.SkipIds(lastRoomId)
+	index := search.NewIndex()
+	indexed, err := index.Rebuild(context.Background(), messages)
+	if err != nil {
+		log.Fatalf("failed to rebuild the search index: %v", err)
+	}
+	log.Printf("%d messages indexed", indexed)
+	sweeper, err := purge.NewSweeper(messages, rooms, purge.Config{
+		Interval:  *purgeEvery,
+		BatchSize: *purgeBatch,
+		Timeout:   *purgeEvery,
+	})
+	if err != nil {
+		log.Fatalf("failed to create sweeper: %v", err)
+	}
+	s, err := chat.NewServer(chat.Config{
+		Users:       users,
+		Hub:         h,
+		Rooms:       rooms,
+		Messages:    messages,
+		Signer:      newSigner(),
+		Presence:    tracker,
+		Limiter:     limiter,
+		Filters:     newFilters(),
+		Search:      index,
+		Attachments: newAttachments(),
+		Metrics:     m,
+		Threads:     thread.NewRegistry(),
+		Inbox:       notifications,
+		Sweeper:     sweeper,
+		Blocks:      block.NewRegistry(),
+		Bans:        user.NewBans(),
+		Admins:      newAdmins(),
+		Cluster:     newCluster(),
+	})
+	if err != nil {
+		log.Fatalf("failed to create chat server: %v", err)
+	}
 	return s
 }
 
 func main() {
+	flag.Parse()
 	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", 8888))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	log.Printf("API version %s\n", api.Version)
-	grpcServer := grpc.NewServer(api.WithServerVersion())
-	api.RegisterChatServiceServer(grpcServer, newServer())
+	m := metrics.New()
+	chatServer := newServer(m)
+	// The version interceptors are installed with grpc.UnaryInterceptor and grpc.StreamInterceptor, gRPC runs them
+	// before the chained ones. The chain runs in the order it is installed: the metrics interceptors come first to see
+	// the RPCs rejected by the admin and auth interceptors of the chat server
+	options := append(m.ServerOptions(), chatServer.ServerOptions()...)
+	options = append(options, api.WithServerVersion()...)
+	loader := newTLSLoader()
+	if tlsConfig := newTLSConfig(loader, "h2"); tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	api.RegisterChatServiceServer(grpcServer, chatServer)
+	api.RegisterChatAdminServer(grpcServer, chatServer.AdminServer())
+	if *httpAddr != "" {
+		// The gateway serves HTTP/1.1, it must not negotiate h2
+		go serveGateway(grpcServer, newTLSConfig(loader))
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(m)
+	}
 	err2 := grpcServer.Serve(lis)
 	if err != nil {
 		log.Fatalf("failed to serve: %v", err2)
@@ -0,0 +1,82 @@
+package thread
+
+import (
+	"sync"
+)
+
+/*
+	Thread followers. Replies to a message are delivered to the followers of its thread only: the author of the root
+	message, the authors of the replies and the users who follow the thread explicitly. A user who unfollowed the
+	thread is not followed back by replying
+*/
+
+type Registry struct {
+	mtx *sync.RWMutex
+	// Users by root message id, false if the user unfollowed the thread
+	threads map[int32]map[int32]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mtx:     new(sync.RWMutex),
+		threads: make(map[int32]map[int32]bool),
+	}
+}
+
+// Participate makes the user a follower unless the user unfollowed the thread before
+func (r *Registry) Participate(rootId int32, userId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	users := r.users(rootId)
+	if _, ok := users[userId]; !ok {
+		users[userId] = true
+	}
+}
+
+func (r *Registry) Follow(rootId int32, userId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.users(rootId)[userId] = true
+}
+
+func (r *Registry) Unfollow(rootId int32, userId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.users(rootId)[userId] = false
+}
+
+func (r *Registry) IsFollowing(rootId int32, userId int32) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.threads[rootId][userId]
+}
+
+// Followers returns a copy of the thread followers
+func (r *Registry) Followers(rootId int32) map[int32]bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	result := make(map[int32]bool)
+	for userId, following := range r.threads[rootId] {
+		if following {
+			result[userId] = true
+		}
+	}
+	return result
+}
+
+// Forget drops the followers of the thread, e.g. after the root message was removed
+func (r *Registry) Forget(rootId int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.threads, rootId)
+}
+
+// users returns the users of the thread, must be called under the write lock
+func (r *Registry) users(rootId int32) map[int32]bool {
+	users, ok := r.threads[rootId]
+	if !ok {
+		users = make(map[int32]bool)
+		r.threads[rootId] = users
+	}
+	return users
+}
@@ -0,0 +1,30 @@
+package thread
+
+import (
+	"testing"
+)
+
+func TestFollowers(t *testing.T) {
+	r := NewRegistry()
+	r.Participate(1, 10)
+	r.Participate(1, 20)
+	r.Follow(1, 30)
+	r.Unfollow(1, 20)
+	// Replying again does not follow back
+	r.Participate(1, 20)
+
+	followers := r.Followers(1)
+	if len(followers) != 2 || !followers[10] || !followers[30] {
+		t.Errorf("expected followers 10 and 30, actual %v", followers)
+	}
+	if r.IsFollowing(1, 20) || !r.IsFollowing(1, 10) {
+		t.Errorf("unexpected following state")
+	}
+	r.Follow(1, 20)
+	if !r.IsFollowing(1, 20) {
+		t.Errorf("explicit follow expected to win")
+	}
+	if len(r.Followers(2)) != 0 {
+		t.Errorf("unknown thread expected to have no followers")
+	}
+}
@@ -0,0 +1,44 @@
+package user
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bans keeps the names that may not connect until the ban expires. Names are matched regardless of the case
+type Bans struct {
+	mtx *sync.Mutex
+	// Expiration time by name key
+	byName map[string]time.Time
+}
+
+func NewBans() *Bans {
+	return &Bans{
+		mtx:    new(sync.Mutex),
+		byName: make(map[string]time.Time),
+	}
+}
+
+// Ban bans the name until the given time, replacing the previous ban
+func (b *Bans) Ban(name string, until time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.byName[nameKey(strings.TrimSpace(name))] = until
+}
+
+// Until returns the expiration time of the ban, false if the name is not banned. Expired bans are dropped
+func (b *Bans) Until(name string, now time.Time) (time.Time, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := nameKey(strings.TrimSpace(name))
+	until, ok := b.byName[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(until) {
+		delete(b.byName, key)
+		return time.Time{}, false
+	}
+	return until, true
+}
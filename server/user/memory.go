@@ -0,0 +1,86 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mtx    *sync.RWMutex
+	nextId int32
+	byId   map[int32]User
+	byName map[string]int32
+}
+
+// NewMemoryStore creates a Store that keeps users in the process memory
+func NewMemoryStore() Store {
+	return &memoryStore{
+		mtx:    new(sync.RWMutex),
+		byId:   make(map[int32]User),
+		byName: make(map[string]int32),
+	}
+}
+
+func (s *memoryStore) Create(ctx context.Context, name string) (User, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := nameKey(name)
+	if _, ok := s.byName[key]; ok {
+		return User{}, ErrNameTaken
+	}
+	s.nextId++
+	result := User{
+		Id:          s.nextId,
+		Name:        name,
+		ConnectedAt: time.Now(),
+	}
+	s.byId[result.Id] = result
+	s.byName[key] = result.Id
+	return result, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id int32) (User, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if result, ok := s.byId[id]; ok {
+		return result, nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryStore) FindByName(ctx context.Context, name string) (User, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if id, ok := s.byName[nameKey(name)]; ok {
+		return s.byId[id], nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id int32) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	existing, ok := s.byId[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.byId, id)
+	delete(s.byName, nameKey(existing.Name))
+	return nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]User, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	result := make([]User, 0, len(s.byId))
+	for _, u := range s.byId {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Registry of connected chat users. Names are unique (case-insensitive) while a user is connected,
+	ids are assigned by the server
+*/
+
+const (
+	MaxNameLength = 64
+)
+
+var (
+	ErrNameTaken   = errors.New("name taken")
+	ErrNotFound    = errors.New("user not found")
+	ErrInvalidName = errors.New("invalid name")
+)
+
+type User struct {
+	Id          int32
+	Name        string
+	ConnectedAt time.Time
+}
+
+/*
+Storage of the registered users. Implementations must be safe for concurrent use and must enforce name uniqueness,
+see NewMemoryStore
+*/
+type Store interface {
+	// Create stores a new user and assigns it an id. Returns ErrNameTaken if the name is in use
+	Create(ctx context.Context, name string) (User, error)
+
+	Get(ctx context.Context, id int32) (User, error)
+
+	FindByName(ctx context.Context, name string) (User, error)
+
+	// Delete removes the user and releases the name. Returns ErrNotFound if the user does not exist
+	Delete(ctx context.Context, id int32) error
+
+	List(ctx context.Context) ([]User, error)
+}
+
+type Registry struct {
+	store Store
+}
+
+func NewRegistry(store Store) (*Registry, error) {
+	if store == nil {
+		return nil, errors.New("store must not be nil")
+	}
+	return &Registry{store: store}, nil
+}
+
+// Connect registers a new user with the given name. Returns ErrNameTaken if the name is already in use
+func (r *Registry) Connect(ctx context.Context, name string) (User, error) {
+	name = strings.TrimSpace(name)
+	if err := validateName(name); err != nil {
+		return User{}, err
+	}
+	return r.store.Create(ctx, name)
+}
+
+// Disconnect ends the user's session and releases the name
+func (r *Registry) Disconnect(ctx context.Context, id int32) error {
+	return r.store.Delete(ctx, id)
+}
+
+func (r *Registry) Get(ctx context.Context, id int32) (User, error) {
+	return r.store.Get(ctx, id)
+}
+
+func (r *Registry) FindByName(ctx context.Context, name string) (User, error) {
+	return r.store.FindByName(ctx, strings.TrimSpace(name))
+}
+
+func (r *Registry) List(ctx context.Context) ([]User, error) {
+	return r.store.List(ctx)
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name must not be empty", ErrInvalidName)
+	}
+	if utf8.RuneCountInString(name) > MaxNameLength {
+		return fmt.Errorf("%w: name must not be longer than %d characters", ErrInvalidName, MaxNameLength)
+	}
+	return nil
+}
+
+// Names are unique regardless of the case
+func nameKey(name string) string {
+	return strings.ToLower(name)
+}
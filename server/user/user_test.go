@@ -0,0 +1,110 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	registry, err := NewRegistry(NewMemoryStore())
+	if err != nil {
+		t.Fatalf("failed to create registry: %s", err)
+	}
+	return registry
+}
+
+func TestConnectAssignsIds(t *testing.T) {
+	registry := newTestRegistry(t)
+	first, err := registry.Connect(context.Background(), "John")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	second, err := registry.Connect(context.Background(), "Jane")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if first.Id == 0 || second.Id == 0 || first.Id == second.Id {
+		t.Errorf("expected unique non-zero ids, actual %d and %d", first.Id, second.Id)
+	}
+}
+
+func TestConnectNameTaken(t *testing.T) {
+	registry := newTestRegistry(t)
+	if _, err := registry.Connect(context.Background(), "John"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if _, err := registry.Connect(context.Background(), " john "); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("expected ErrNameTaken, actual %v", err)
+	}
+}
+
+func TestDisconnectReleasesName(t *testing.T) {
+	registry := newTestRegistry(t)
+	u, err := registry.Connect(context.Background(), "John")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := registry.Disconnect(context.Background(), u.Id); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if _, err := registry.Connect(context.Background(), "John"); err != nil {
+		t.Errorf("name expected to be released, actual %s", err)
+	}
+	if err := registry.Disconnect(context.Background(), u.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, actual %v", err)
+	}
+}
+
+func TestConnectInvalidName(t *testing.T) {
+	registry := newTestRegistry(t)
+	if _, err := registry.Connect(context.Background(), "  "); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, actual %v", err)
+	}
+}
+
+func TestConcurrentConnect(t *testing.T) {
+	registry := newTestRegistry(t)
+	const count = 50
+	wg := sync.WaitGroup{}
+	var mtx sync.Mutex
+	succeeded := 0
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every name is requested twice, only one of the attempts may win
+			if _, err := registry.Connect(context.Background(), fmt.Sprintf("user-%d", i%(count/2))); err == nil {
+				mtx.Lock()
+				succeeded++
+				mtx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != count/2 {
+		t.Errorf("expected %d users, actual %d", count/2, succeeded)
+	}
+}
+
+func TestBans(t *testing.T) {
+	bans := NewBans()
+	now := time.Now()
+	bans.Ban("John", now.Add(time.Minute))
+
+	if until, ok := bans.Until("john", now); !ok || !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected john banned, actual %v %v", until, ok)
+	}
+	if _, ok := bans.Until("Jane", now); ok {
+		t.Errorf("Jane not expected to be banned")
+	}
+	if _, ok := bans.Until("John", now.Add(time.Minute)); ok {
+		t.Errorf("expired ban not expected to apply")
+	}
+	if _, ok := bans.Until("John", now); ok {
+		t.Errorf("expired ban expected to be dropped")
+	}
+}
@@ -14,6 +14,11 @@ import (
 
 var rev *string
 
+const (
+	grpcPackage    = protogen.GoImportPath("google.golang.org/grpc")
+	versionPackage = protogen.GoImportPath("github.com/iyarkov2/chat/server/version")
+)
+
 func main() {
 	var flags flag.FlagSet
 	rev = flags.String("rev", "0", "Git Revision")
@@ -81,32 +86,40 @@ func generateFile(gen *protogen.Plugin, file *protogen.File, extTypes *protoregi
 	g.P(fmt.Sprintf("const Version = \"%s.%s\"", version, *rev))
 	g.P()
 
-	// Add client-side interceptor
-	g.P(fmt.Sprintf("func WithServerVersion() grpc.ServerOption {"))
-	g.P(fmt.Sprintf("\treturn version.WithServerInterceptor()"))
-	g.P(fmt.Sprintf("}"))
-
-	// Add client-side interceptor
-	g.P(fmt.Sprintf("func WithClientVersion() grpc.DialOption {"))
-	g.P(fmt.Sprintf("\treturn version.WithClientInterceptor(Version, methods)"))
-	g.P(fmt.Sprintf("}"))
+	// Add server-side interceptors, unary and stream
+	g.P("func WithServerVersion() []", grpcPackage.Ident("ServerOption"), " {")
+	g.P("\treturn []", grpcPackage.Ident("ServerOption"), "{")
+	g.P("\t\t", versionPackage.Ident("WithServerInterceptor"), "(),")
+	g.P("\t\t", versionPackage.Ident("WithServerStreamInterceptor"), "(),")
+	g.P("\t}")
+	g.P("}")
+
+	// Add client-side interceptors, unary and stream
+	g.P("func WithClientVersion() []", grpcPackage.Ident("DialOption"), " {")
+	g.P("\treturn []", grpcPackage.Ident("DialOption"), "{")
+	g.P("\t\t", versionPackage.Ident("WithClientInterceptor"), "(Version, methods),")
+	g.P("\t\t", versionPackage.Ident("WithClientStreamInterceptor"), "(Version, methods),")
+	g.P("\t}")
+	g.P("}")
 
 	// Add version method to every server side stub
 	for _, service := range file.Services {
-		serviceName := service.Desc.FullName()
 		g.P(fmt.Sprintf("func (Unimplemented%sServer) Version() string {", service.GoName))
 		g.P(fmt.Sprintf("\treturn Version"))
 		g.P(fmt.Sprintf("}"))
+		g.P(fmt.Sprintf(""))
+	}
 
+	// Methods of every service are versioned
+	g.P(fmt.Sprintf("var methods = map[string]bool {"))
+	for _, service := range file.Services {
+		serviceName := service.Desc.FullName()
 		methods := service.Desc.Methods()
-
-		g.P(fmt.Sprintf(""))
-		g.P(fmt.Sprintf("var methods = map[string]bool {"))
 		for i := 0; i < methods.Len(); i++ {
 			g.P(fmt.Sprintf("\t \"/%s/%s\": true,", serviceName,  methods.Get(i).Name()))
 		}
-		g.P(fmt.Sprintf("}"))
 	}
+	g.P(fmt.Sprintf("}"))
 
 
 }
@@ -2,16 +2,22 @@ package version
 
 import (
 	"context"
-	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 	"log"
 )
 
+// Header carries the API version of the client in the requests and the API version of the server in the responses
+const Header = "api-version"
+
 func WithServerInterceptor() grpc.ServerOption {
 	return grpc.UnaryInterceptor(serverInterceptor)
 }
 
+func WithServerStreamInterceptor() grpc.ServerOption {
+	return grpc.StreamInterceptor(serverStreamInterceptor)
+}
+
 type Versioned interface {
 	Version() string
 }
@@ -19,17 +25,17 @@ type Versioned interface {
 func serverInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	// Check client's header
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		clientVersion := md.Get("api-version")
+		clientVersion := md.Get(Header)
 		log.Printf("Client API Version [%s]", clientVersion)
 	}
 	// Calls the handler
 	result, err := handler(ctx, req)
 
 	// Check if the server support the version
-	if versioned := info.Server.(Versioned); versioned != nil {
+	if versioned, ok := info.Server.(Versioned); ok {
 		// Set server header
 		log.Printf("Intercepted versioned, Server API Version [%s]", versioned.Version())
-		header := metadata.Pairs("api-version", versioned.Version())
+		header := metadata.Pairs(Header, versioned.Version())
 		if e := grpc.SendHeader(ctx, header); e != nil {
 			log.Printf("Failed to add a header %s", e)
 		}
@@ -37,34 +43,47 @@ func serverInterceptor(ctx context.Context, req interface{}, info *grpc.UnarySer
 	return result, err
 }
 
+func serverStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// Check client's header
+	if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+		clientVersion := md.Get(Header)
+		log.Printf("Client API Version [%s]", clientVersion)
+	}
+
+	// Stream headers go out with the first message, they must be set before the handler runs
+	if versioned, ok := srv.(Versioned); ok {
+		log.Printf("Intercepted versioned stream, Server API Version [%s]", versioned.Version())
+		header := metadata.Pairs(Header, versioned.Version())
+		if e := ss.SetHeader(header); e != nil {
+			log.Printf("Failed to add a header %s", e)
+		}
+	}
+	return handler(srv, ss)
+}
+
 func WithClientInterceptor(version string, versionedMethods map[string]bool) grpc.DialOption {
 	clientInterceptor := func(ctx context.Context, method string, req interface{}, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 		// Append client-side version
 		if _, ok := versionedMethods[method]; ok {
-			ctx = metadata.AppendToOutgoingContext(ctx, "api-version", version)
+			ctx = metadata.AppendToOutgoingContext(ctx, Header, version)
 		}
 
-		// TODO Add header extractor - for dev/log purpose only. Should be removed before release
-		header := grpc.HeaderCallOption{}
-		for _, o := range opts {
-			if ho := o.(grpc.HeaderCallOption); ho.HeaderAddr != nil {
-				header = ho
-			}
-		}
-		if header.HeaderAddr == nil {
-			md := metadata.New(make(map[string]string))
-			header = grpc.Header(&md).(grpc.HeaderCallOption)
-			opts = append(opts, header)
-		}
+		// Calls the invoker to execute RPC, the server version is in the response header
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return grpc.WithUnaryInterceptor(clientInterceptor)
+}
 
-		// Calls the invoker to execute RPC
-		err := invoker(ctx, method, req, reply, cc, opts...)
 
-		// Retrieve server-side version
-		fmt.Println("Server Version: ", header.HeaderAddr.Get("api-version"))
+func WithClientStreamInterceptor(version string, versionedMethods map[string]bool) grpc.DialOption {
+	clientInterceptor := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		// Append client-side version
+		if _, ok := versionedMethods[method]; ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, Header, version)
+		}
 
-		return err
+		// Calls the streamer to open the stream, the server version is in the stream header
+		return streamer(ctx, desc, cc, method, opts...)
 	}
-	return grpc.WithUnaryInterceptor(clientInterceptor)
+	return grpc.WithStreamInterceptor(clientInterceptor)
 }
-
@@ -0,0 +1,80 @@
+package version
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+const echoMethod = "/test.Echo/Echo"
+
+type echoServer struct {
+	// api-version of the last stream
+	clientVersion chan []string
+}
+
+func (echoServer) Version() string {
+	return "2.0.0"
+}
+
+func (s echoServer) echo(stream grpc.ServerStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.clientVersion <- md.Get("api-version")
+	return stream.SendMsg(&emptypb.Empty{})
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	server := echoServer{clientVersion: make(chan []string, 1)}
+	desc := grpc.StreamDesc{
+		StreamName: "Echo",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(echoServer).echo(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer(WithServerInterceptor(), WithServerStreamInterceptor())
+	grpcServer.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Streams:     []grpc.StreamDesc{desc},
+	}, server)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+		WithClientInterceptor("1.0.0", map[string]bool{echoMethod: true}),
+		WithClientStreamInterceptor("1.0.0", map[string]bool{echoMethod: true}))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &desc, echoMethod)
+	if err != nil {
+		t.Fatalf("stream failed: %s", err)
+	}
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		t.Fatalf("recv failed: %s", err)
+	}
+	if version := <-server.clientVersion; len(version) != 1 || version[0] != "1.0.0" {
+		t.Errorf("expected client version 1.0.0, actual %v", version)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("header failed: %s", err)
+	}
+	if version := header.Get("api-version"); len(version) != 1 || version[0] != "2.0.0" {
+		t.Errorf("expected server version 2.0.0, actual %v", version)
+	}
+}